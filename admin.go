@@ -0,0 +1,276 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// LEADERSHIP_TRANSFER_TIMEOUT bounds how long a leader waits for the target
+// of a transfer to catch up and win its election. As in the Raft thesis it is
+// on the order of an election timeout, after which the leader resumes.
+const LEADERSHIP_TRANSFER_TIMEOUT = 2 * MAXELECTION_TIMEOUT
+
+// AdminOp is an operation of the Admin RPC.
+type AdminOp uint8
+
+const (
+	AdminListMembers AdminOp = iota + 1
+	AdminTransferLeader
+	AdminStepDown
+)
+
+func (op AdminOp) String() string {
+	switch op {
+	case AdminListMembers:
+		return "list-members"
+	case AdminTransferLeader:
+		return "transfer-leader"
+	case AdminStepDown:
+		return "step-down"
+	}
+	return fmt.Sprintf("AdminOp(%d)", uint8(op))
+}
+
+type AdminArgs struct {
+	Op AdminOp
+	ID int // the node to transfer leadership to
+}
+
+type AdminReply struct {
+	Success  bool
+	IsLeader bool
+	LeaderID int      // the leader after the operation; -1 if unknown
+	Members  []Member // AdminListMembers
+	Error    string   // set when the leader could not perform the operation
+}
+
+// Member is a node of the cluster as the leader sees it.
+type Member struct {
+	ID         int    `json:"id"`
+	Addr       string `json:"addr"`
+	Leader     bool   `json:"leader"`
+	Reachable  bool   `json:"reachable"`
+	MatchIndex int    `json:"match_index"` // highest log index known to be replicated on it
+}
+
+// Admin runs an admin operation on the leader. Like Execute, a follower
+// answers with IsLeader false and the leader it knows of.
+func (r *Raft) Admin(args *AdminArgs, reply *AdminReply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), EXECUTE_TIMEOUT)
+	defer cancel()
+
+	var err error
+	reply.LeaderID = r.me
+	switch args.Op {
+	case AdminListMembers:
+		reply.Members, err = r.Members()
+	case AdminTransferLeader:
+		reply.LeaderID, err = r.TransferLeadership(ctx, args.ID)
+	case AdminStepDown:
+		reply.LeaderID, err = r.StepDown(ctx)
+	default:
+		err = fmt.Errorf("%w: unknown admin operation %d", ErrInvalidCommand, args.Op)
+	}
+	var notLeader *NotLeaderError
+	switch {
+	case errors.As(err, &notLeader):
+		reply.LeaderID = notLeader.LeaderID
+		return nil
+	case err == ErrShutdown:
+		return err
+	}
+	reply.IsLeader = true
+	reply.Success = err == nil
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	return nil
+}
+
+// checkLeaderLocked fails with ErrShutdown or a *NotLeaderError unless the
+// node is the leader.
+func (r *Raft) checkLeaderLocked() error {
+	if r.shutdown {
+		return ErrShutdown
+	}
+	if r.state != LEADER {
+		return r.notLeaderError(r.leaderID)
+	}
+	return nil
+}
+
+// Members lists the nodes of the cluster, with their replication progress.
+// It is only served by the leader.
+func (r *Raft) Members() ([]Member, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := r.checkLeaderLocked(); err != nil {
+		return nil, err
+	}
+	members := make([]Member, 0, len(r.peerIPPort))
+	for id, addr := range r.peerIPPort {
+		m := Member{ID: id, Addr: addr, Reachable: true, MatchIndex: r.matchIndex[id]}
+		if id == r.me {
+			m.Leader = true
+			m.MatchIndex = r.durableIndex
+		} else if reachable, ok := r.peerReachable[id]; ok {
+			m.Reachable = reachable
+		}
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members, nil
+}
+
+// StepDown hands leadership to the reachable follower with the most of the
+// log, as TransferLeadership does, and returns the new leader.
+func (r *Raft) StepDown(ctx context.Context) (int, error) {
+	return r.TransferLeadership(ctx, -1)
+}
+
+// TransferLeadership makes node id the leader, or the reachable follower
+// with the most of the log if id is -1, and returns the new leader. New
+// requests are refused while the target catches up; once it has the whole
+// log it is told to start an election at once, which it wins before any
+// other node's election timer fires. If that does not happen within
+// LEADERSHIP_TRANSFER_TIMEOUT or before ctx ends, the node resumes as the
+// leader and ErrTransferFailed or ctx.Err() is returned.
+func (r *Raft) TransferLeadership(ctx context.Context, id int) (int, error) {
+	r.mu.Lock()
+	if err := r.checkLeaderLocked(); err != nil {
+		r.mu.Unlock()
+		return -1, err
+	}
+	if id == -1 {
+		id = r.transferTargetLocked()
+		if id == -1 {
+			r.mu.Unlock()
+			return -1, fmt.Errorf("%w: no reachable follower to hand leadership to", ErrTransferFailed)
+		}
+	}
+	if _, ok := r.peerIPPort[id]; !ok {
+		r.mu.Unlock()
+		return -1, fmt.Errorf("%w: node %d", ErrUnknownMember, id)
+	}
+	if id == r.me {
+		r.mu.Unlock()
+		return id, nil
+	}
+	if r.transferring {
+		r.mu.Unlock()
+		return -1, fmt.Errorf("%w: another transfer is in progress", ErrTransferFailed)
+	}
+	r.transferring = true
+	term := r.currentTerm
+	r.logEventLocked(slog.LevelInfo, "Transferring leadership", "target", id)
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.transferring = false
+		r.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, LEADERSHIP_TRANSFER_TIMEOUT)
+	defer cancel()
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	sent := false
+	for {
+		r.mu.RLock()
+		shutdown := r.shutdown
+		stillLeader := r.state == LEADER && r.currentTerm == term
+		caughtUp := r.matchIndex[id] >= len(r.log)-1
+		leaderID := r.leaderID
+		r.mu.RUnlock()
+		switch {
+		case shutdown:
+			return -1, ErrShutdown
+		case !stillLeader && leaderID != -1:
+			r.logEvent(slog.LevelInfo, "Leadership transferred", "leader", leaderID)
+			return leaderID, nil
+		case stillLeader && caughtUp && !sent:
+			sent = r.sendTimeoutNow(id, term)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if !stillLeader {
+				// Deposed, but the new leader has not been heard from yet.
+				return -1, nil
+			}
+			r.logEvent(slog.LevelWarn, "Leadership transfer timed out", "target", id)
+			if ctx.Err() == context.DeadlineExceeded {
+				return -1, fmt.Errorf("%w: node %d did not take over in time", ErrTransferFailed, id)
+			}
+			return -1, ctx.Err()
+		}
+	}
+}
+
+// transferTargetLocked returns the reachable follower with the highest
+// match index, or -1 if there is none.
+func (r *Raft) transferTargetLocked() int {
+	target := -1
+	for id := range r.peerIPPort {
+		if id == r.me || !r.peerReachable[id] || r.rpcConns[id] == nil {
+			continue
+		}
+		if target == -1 || r.matchIndex[id] > r.matchIndex[target] ||
+			(r.matchIndex[id] == r.matchIndex[target] && id < target) {
+			target = id
+		}
+	}
+	return target
+}
+
+type TimeoutNowArgs struct {
+	Term     int
+	LeaderID int
+}
+
+type TimeoutNowReply struct {
+	Term    int
+	Success bool
+}
+
+// TimeoutNow is sent by a leader handing its leadership over: the receiver
+// starts an election without waiting for its election timeout.
+func (r *Raft) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.shutdown {
+		return ErrShutdown
+	}
+	reply.Term = r.currentTerm
+	if args.Term != r.currentTerm || r.state != FOLLOWER {
+		return nil
+	}
+	reply.Success = true
+	select {
+	case r.timeoutNowCh <- true:
+	default:
+	}
+	return nil
+}
+
+// sendTimeoutNow tells server to start an election, reporting whether it
+// agreed to.
+func (r *Raft) sendTimeoutNow(server, term int) bool {
+	r.mu.Lock()
+	client := r.rpcConns[server]
+	r.mu.Unlock()
+	if client == nil {
+		r.dialRPCToPeer(server)
+		return false
+	}
+	reply := &TimeoutNowReply{}
+	if err := client.Call(TimeoutNow, &TimeoutNowArgs{Term: term, LeaderID: r.me}, reply); err != nil {
+		r.logEvent(slog.LevelWarn, "TimeoutNow RPC failed", "peer", server, "err", err)
+		return false
+	}
+	return reply.Success
+}
@@ -0,0 +1,635 @@
+// Package client is a Go client for a raft cluster. It finds and caches the
+// leader, pools RPC connections, retries failed requests with exponential
+// backoff and tags writes with a client session so that a retry is never
+// applied twice.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"raft"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_CONNS_PER_NODE  = 2
+	DEFAULT_DIAL_TIMEOUT    = 1 * time.Second
+	DEFAULT_MAX_ATTEMPTS    = 10
+	DEFAULT_INITIAL_BACKOFF = 10 * time.Millisecond
+	DEFAULT_MAX_BACKOFF     = 1 * time.Second
+)
+
+// ErrClosed is returned for requests made on a closed Client.
+var ErrClosed = errors.New("client: closed")
+
+// RetryPolicy controls how a request is retried when a node cannot be
+// reached, is not the leader, or fails with a retriable error. Zero fields
+// take the defaults.
+type RetryPolicy struct {
+	MaxAttempts    int           // RPCs per request (default: 10)
+	InitialBackoff time.Duration // wait after the first failure (default: 10ms)
+	MaxBackoff     time.Duration // upper bound of the doubling wait (default: 1s)
+}
+
+type Config struct {
+	// ConfPath is a cluster.conf to read the nodes from; ignored if Peers
+	// is set.
+	ConfPath string
+	// Peers maps node IDs to their RPC addresses.
+	Peers        map[int]string
+	ConnsPerNode int           // RPC connections kept per node (default: 2)
+	DialTimeout  time.Duration // default: 1s
+	Retry        RetryPolicy
+	// TracerProvider, if set, records a span for every RPC attempt. The
+	// trace context of a request's ctx is passed on to the node either way.
+	TracerProvider trace.TracerProvider
+}
+
+// Client sends commands to the cluster's leader. It is safe for concurrent
+// use.
+type Client struct {
+	peers   map[int]string
+	peerIDs []int
+	cfg     Config
+	tracer  trace.Tracer // nil unless Config.TracerProvider is set
+
+	mu       sync.Mutex
+	pools    map[int]*connPool
+	leaderID int // -1 if unknown
+	next     int // position in peerIDs of the next node to try without a leader
+	sessions []*session
+	closed   bool
+}
+
+// New creates a client for the cluster described by cfg. Connections are
+// made on first use.
+func New(cfg Config) (*Client, error) {
+	peers := cfg.Peers
+	if peers == nil {
+		var err error
+		if peers, err = raft.ParseConfig(cfg.ConfPath); err != nil {
+			return nil, err
+		}
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("%w: no nodes given", raft.ErrInvalidConfig)
+	}
+	if cfg.ConnsPerNode <= 0 {
+		cfg.ConnsPerNode = DEFAULT_CONNS_PER_NODE
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+	if cfg.Retry.MaxAttempts <= 0 {
+		cfg.Retry.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if cfg.Retry.InitialBackoff <= 0 {
+		cfg.Retry.InitialBackoff = DEFAULT_INITIAL_BACKOFF
+	}
+	if cfg.Retry.MaxBackoff <= 0 {
+		cfg.Retry.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+
+	ids := make([]int, 0, len(peers))
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	c := &Client{
+		peers:    peers,
+		peerIDs:  ids,
+		cfg:      cfg,
+		pools:    make(map[int]*connPool),
+		leaderID: -1,
+	}
+	if cfg.TracerProvider != nil {
+		c.tracer = cfg.TracerProvider.Tracer("raft/client")
+	}
+	return c, nil
+}
+
+// Get returns the value of key, read through the leader's quorum-read path,
+// or "" if it does not exist.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	res, err := c.Do(ctx, raft.KVCommand{Op: raft.KVGet, Key: []byte(key)})
+	return string(res.Value), err
+}
+
+// Set sets key to value.
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	_, err := c.Do(ctx, raft.KVCommand{Op: raft.KVSet, Key: []byte(key), Value: []byte(value)})
+	return err
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.Do(ctx, raft.KVCommand{Op: raft.KVDelete, Key: []byte(key)})
+	return err
+}
+
+// CompareAndSwap sets key to value if its current value is expect, and
+// reports whether it did.
+func (c *Client) CompareAndSwap(ctx context.Context, key, expect, value string) (bool, error) {
+	res, err := c.Do(ctx, raft.KVCommand{Op: raft.KVCompareAndSwap, Key: []byte(key), Expect: []byte(expect), Value: []byte(value)})
+	return res.OK, err
+}
+
+// SetIfAbsent sets key to value if it does not exist, and reports whether it
+// did.
+func (c *Client) SetIfAbsent(ctx context.Context, key, value string) (bool, error) {
+	res, err := c.Do(ctx, raft.KVCommand{Op: raft.KVSetIfAbsent, Key: []byte(key), Value: []byte(value)})
+	return res.OK, err
+}
+
+// Incr adds delta to the integer stored at key and returns the new value.
+func (c *Client) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	res, err := c.Do(ctx, raft.KVCommand{Op: raft.KVIncr, Key: []byte(key), Delta: delta})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(res.Value), 10, 64)
+}
+
+// Range reads up to limit keys (0: the server's maximum), in order, from
+// start up to but not including end (empty: no bound). The keys are in the
+// result's Results; if more are left, its More is set and its Key is where
+// the next call should start.
+func (c *Client) Range(ctx context.Context, start, end string, limit uint64) (raft.KVResult, error) {
+	return c.Do(ctx, raft.KVCommand{Op: raft.KVRange, Key: []byte(start), End: []byte(end), Limit: limit})
+}
+
+// Prefix reads up to limit keys starting with prefix, like Range.
+func (c *Client) Prefix(ctx context.Context, prefix string, limit uint64) (raft.KVResult, error) {
+	return c.Do(ctx, raft.KVCommand{Op: raft.KVRange, Key: []byte(prefix), End: raft.PrefixEnd([]byte(prefix)), Limit: limit})
+}
+
+// Count returns the number of keys from start up to but not including end
+// (empty: no bound).
+func (c *Client) Count(ctx context.Context, start, end string) (uint64, error) {
+	res, err := c.Do(ctx, raft.KVCommand{Op: raft.KVCount, Key: []byte(start), End: []byte(end)})
+	return res.Count, err
+}
+
+// GetAt returns key as it was at store revision rev. Found is false if the
+// key did not exist then.
+func (c *Client) GetAt(ctx context.Context, key string, rev uint64) (raft.KVResult, error) {
+	return c.Do(ctx, raft.KVCommand{Op: raft.KVGet, Key: []byte(key), Revision: rev})
+}
+
+// Compact discards the versions that are not needed to read at rev or later.
+func (c *Client) Compact(ctx context.Context, rev uint64) error {
+	_, err := c.Do(ctx, raft.KVCommand{Op: raft.KVCompact, Revision: rev})
+	return err
+}
+
+// SetWithLease sets key to value and attaches it to lease, so it is deleted
+// when the lease expires or is revoked.
+func (c *Client) SetWithLease(ctx context.Context, key, value string, lease uint64) error {
+	_, err := c.Do(ctx, raft.KVCommand{Op: raft.KVSet, Key: []byte(key), Value: []byte(value), Lease: lease})
+	return err
+}
+
+// Grant creates a lease that expires ttl after it was granted or last kept
+// alive, and returns its ID.
+func (c *Client) Grant(ctx context.Context, ttl time.Duration) (uint64, error) {
+	res, err := c.Do(ctx, raft.KVCommand{Op: raft.KVLeaseGrant, TTL: ttl})
+	return res.Lease, err
+}
+
+// KeepAlive restarts the TTL of lease. It fails with raft.ErrLeaseNotFound if
+// the lease has already expired.
+func (c *Client) KeepAlive(ctx context.Context, lease uint64) error {
+	_, err := c.Do(ctx, raft.KVCommand{Op: raft.KVLeaseKeepAlive, Lease: lease})
+	return err
+}
+
+// Revoke deletes lease and every key attached to it.
+func (c *Client) Revoke(ctx context.Context, lease uint64) error {
+	_, err := c.Do(ctx, raft.KVCommand{Op: raft.KVLeaseRevoke, Lease: lease})
+	return err
+}
+
+// Txn runs txn atomically and returns whether its compares held, with the
+// results of the ops of the branch it took.
+func (c *Client) Txn(ctx context.Context, txn raft.KVTxn) (bool, []raft.KVResult, error) {
+	res, err := c.Do(ctx, raft.KVCommand{Op: raft.KVTransaction, Txn: &txn})
+	return res.OK, res.Results, err
+}
+
+// Do runs any KVStore command, e.g. a conditional delete or a swap on
+// revision, and returns its result. Read-only commands are served as reads.
+func (c *Client) Do(ctx context.Context, cmd raft.KVCommand) (raft.KVResult, error) {
+	res, _, err := c.DoServed(ctx, cmd)
+	return res, err
+}
+
+// DoServed is Do that also reports how the command was served.
+func (c *Client) DoServed(ctx context.Context, cmd raft.KVCommand) (raft.KVResult, Served, error) {
+	value, served, err := c.ExecuteServed(ctx, cmd.Encode(), cmd.ReadOnly())
+	if err != nil {
+		return raft.KVResult{}, served, err
+	}
+	res, err := raft.DecodeKVResult(value)
+	return res, served, err
+}
+
+// Execute submits cmd to the leader and returns the state machine's result.
+// A read is served by Query on the leader; a write is committed to the log
+// under one of the client's sessions, so retrying it is safe.
+func (c *Client) Execute(ctx context.Context, cmd []byte, read bool) ([]byte, error) {
+	value, _, err := c.ExecuteServed(ctx, cmd, read)
+	return value, err
+}
+
+// Served describes the leader's answer to a request.
+type Served struct {
+	NodeID      int    // the node that served it, -1 if none did
+	Index       uint64 // log index a write was committed at
+	CommitIndex int    // the leader's commit index when it answered
+}
+
+// ExecuteServed is Execute that also reports how cmd was served.
+func (c *Client) ExecuteServed(ctx context.Context, cmd []byte, read bool) ([]byte, Served, error) {
+	args := &raft.ExecuteArgs{Command: cmd, Read: read}
+	if !read {
+		s := c.acquireSession()
+		defer c.releaseSession(s)
+		s.seq++
+		args.ClientID, args.Seq = s.clientID, s.seq
+	}
+	return c.do(ctx, args)
+}
+
+// Admin runs an admin operation on the leader and returns its reply. Failed
+// operations are not retried, except those that failed because the node was
+// not or no longer the leader.
+func (c *Client) Admin(ctx context.Context, args raft.AdminArgs) (raft.AdminReply, error) {
+	var reply raft.AdminReply
+	_, err := c.retry(ctx, func(id int) (outcome, error) {
+		reply = raft.AdminReply{}
+		if err := c.invoke(ctx, id, raft.Admin, &args, &reply); err != nil {
+			return outcome{}, err
+		}
+		return outcome{reply.IsLeader, reply.LeaderID, reply.Success, reply.Error}, nil
+	})
+	return reply, err
+}
+
+// Status asks node id, which need not be the leader, for its status. It is
+// not retried.
+func (c *Client) Status(ctx context.Context, id int) (raft.NodeStatus, error) {
+	if _, ok := c.peers[id]; !ok {
+		return raft.NodeStatus{}, fmt.Errorf("client: unknown node %d", id)
+	}
+	var s raft.NodeStatus
+	if err := c.invoke(ctx, id, raft.Status, &raft.StatusArgs{}, &s); err != nil {
+		if msg, ok := err.(rpc.ServerError); ok {
+			return raft.NodeStatus{}, replyError(string(msg))
+		}
+		return raft.NodeStatus{}, err
+	}
+	return s, nil
+}
+
+// Close closes every pooled connection. Requests in flight fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, pool := range c.pools {
+		pool.close()
+		delete(c.pools, id)
+	}
+	return nil
+}
+
+// do sends args until a leader answers, see retry.
+func (c *Client) do(ctx context.Context, args *raft.ExecuteArgs) ([]byte, Served, error) {
+	var reply *raft.ExecuteReply
+	id, err := c.retry(ctx, func(id int) (outcome, error) {
+		var err error
+		if reply, err = c.call(ctx, id, args); err != nil {
+			return outcome{}, err
+		}
+		return outcome{reply.IsLeader, reply.LeaderID, reply.Success, reply.Error}, nil
+	})
+	if err != nil {
+		return nil, Served{NodeID: -1}, err
+	}
+	return reply.Value, Served{NodeID: id, Index: reply.Index, CommitIndex: reply.CommitIndex}, nil
+}
+
+// outcome is what retry needs to know of a reply.
+type outcome struct {
+	isLeader bool
+	leaderID int    // the leader a follower knows of, -1 if none
+	success  bool   // the leader performed the request
+	err      string // why it did not
+}
+
+// retry runs attempt on the leader until it succeeds, fails with an error
+// that is not retriable, the retry policy is exhausted or ctx ends, and
+// returns the node that served it. Following a leader hint is retried at
+// once; other failures back off.
+func (c *Client) retry(ctx context.Context, attempt func(id int) (outcome, error)) (int, error) {
+	backoff := c.cfg.Retry.InitialBackoff
+	var lastErr error
+	for n := 0; n < c.cfg.Retry.MaxAttempts; n++ {
+		id, err := c.target()
+		if err != nil {
+			return -1, err
+		}
+		reply, err := attempt(id)
+		switch {
+		case err == nil && reply.isLeader && reply.success:
+			return id, nil
+		case err == nil && reply.isLeader:
+			err = replyError(reply.err)
+			if !retriable(err) {
+				return id, err
+			}
+			c.forgetLeader(id)
+		case err == nil:
+			err = &raft.NotLeaderError{LeaderID: reply.leaderID, LeaderAddr: c.peers[reply.leaderID]}
+			if reply.leaderID != -1 && reply.leaderID != id {
+				c.setLeader(reply.leaderID)
+				lastErr = err
+				continue
+			}
+			c.forgetLeader(id)
+		case ctx.Err() != nil:
+			return -1, ctx.Err()
+		default:
+			c.forgetLeader(id)
+		}
+		lastErr = err
+
+		select {
+		case <-time.After(jitter(backoff)):
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
+		backoff = min(2*backoff, c.cfg.Retry.MaxBackoff)
+	}
+	return -1, fmt.Errorf("client: giving up after %d attempts: %w", c.cfg.Retry.MaxAttempts, lastErr)
+}
+
+// target returns the node to send the next attempt to: the cached leader,
+// or else the nodes in turn.
+func (c *Client) target() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if c.leaderID != -1 {
+		return c.leaderID, nil
+	}
+	id := c.peerIDs[c.next%len(c.peerIDs)]
+	c.next++
+	return id, nil
+}
+
+func (c *Client) setLeader(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.peers[id]; ok {
+		c.leaderID = id
+	}
+}
+
+// forgetLeader drops the cached leader if it is id, so that the next attempt
+// moves on to another node.
+func (c *Client) forgetLeader(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leaderID == id {
+		c.leaderID = -1
+	}
+}
+
+// call runs the Execute RPC on node id.
+func (c *Client) call(ctx context.Context, id int, args *raft.ExecuteArgs) (_ *raft.ExecuteReply, err error) {
+	if c.tracer != nil {
+		var span trace.Span
+		ctx, span = c.tracer.Start(ctx, "raft.client.Execute", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.Int("raft.node", id), attribute.Bool("raft.read", args.Read)))
+		defer func() {
+			if err != nil {
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}()
+	}
+	args.TraceContext = nil
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		args.TraceContext = make(map[string]string)
+		raft.TracePropagator.Inject(ctx, propagation.MapCarrier(args.TraceContext))
+	}
+
+	reply := &raft.ExecuteReply{}
+	if err := c.invoke(ctx, id, raft.Execute, args, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// invoke runs the RPC method on node id over a pooled connection. A
+// connection that fails is dropped from the pool.
+func (c *Client) invoke(ctx context.Context, id int, method string, args, reply any) error {
+	pool, err := c.pool(id)
+	if err != nil {
+		return err
+	}
+	conn, err := pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	call := conn.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.Error != nil {
+		if _, ok := call.Error.(rpc.ServerError); !ok {
+			pool.drop(conn)
+		}
+		return call.Error
+	}
+	return nil
+}
+
+func (c *Client) pool(id int) (*connPool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	pool, ok := c.pools[id]
+	if !ok {
+		pool = &connPool{addr: c.peers[id], size: c.cfg.ConnsPerNode, dialTimeout: c.cfg.DialTimeout}
+		c.pools[id] = pool
+	}
+	return pool, nil
+}
+
+// session is a client session. Each one is used by one request at a time,
+// so its sequence numbers reach the cluster in order.
+type session struct {
+	clientID uint64
+	seq      uint64
+}
+
+func (c *Client) acquireSession() *session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.sessions); n > 0 {
+		s := c.sessions[n-1]
+		c.sessions = c.sessions[:n-1]
+		return s
+	}
+	return &session{clientID: rand.Uint64() | 1} // 0 means no session
+}
+
+func (c *Client) releaseSession(s *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions = append(c.sessions, s)
+}
+
+// connPool holds up to size RPC connections to one node and hands them out
+// in turn; net/rpc connections can carry concurrent calls.
+type connPool struct {
+	addr        string
+	size        int
+	dialTimeout time.Duration
+
+	mu      sync.Mutex
+	conns   []*rpc.Client
+	next    int
+	dialing int // dials in flight, counted against size
+	closed  bool
+}
+
+// get returns a pooled connection, dialing a new one while the pool and the
+// dials in flight are short of size. Once every slot is taken, callers share
+// the open connections; only while none is open yet do they dial regardless,
+// and a connection that finds the pool full or closed when its dial
+// completes is closed again.
+func (p *connPool) get(ctx context.Context) (*rpc.Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if len(p.conns) > 0 && len(p.conns)+p.dialing >= p.size {
+		conn := p.nextLocked()
+		p.mu.Unlock()
+		return conn, nil
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	d := net.Dialer{Timeout: p.dialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", p.addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if err != nil {
+		return nil, err
+	}
+	conn := rpc.NewClient(nc)
+	switch {
+	case p.closed:
+		conn.Close()
+		return nil, ErrClosed
+	case len(p.conns) >= p.size:
+		conn.Close()
+		return p.nextLocked(), nil
+	}
+	p.conns = append(p.conns, conn)
+	return conn, nil
+}
+
+func (p *connPool) nextLocked() *rpc.Client {
+	conn := p.conns[p.next%len(p.conns)]
+	p.next++
+	return conn
+}
+
+func (p *connPool) drop(conn *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c == conn {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			break
+		}
+	}
+	conn.Close()
+}
+
+// close closes the pooled connections. Dials still in flight close theirs
+// when they complete.
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+// replyError turns the error message of an ExecuteReply back into the raft
+// error it came from, so callers can match it with errors.Is.
+func replyError(msg string) error {
+	for _, err := range []error{
+		raft.ErrShutdown, raft.ErrReadQuorum, raft.ErrLeadershipLost,
+		raft.ErrEntryOverwritten, raft.ErrStaleSequence, raft.ErrInvalidCommand,
+		raft.ErrNotInteger, raft.ErrLeaseNotFound, raft.ErrCompacted, raft.ErrFutureRevision,
+		raft.ErrUnknownMember, raft.ErrTransferFailed,
+		context.DeadlineExceeded,
+	} {
+		if msg == err.Error() {
+			return err
+		}
+		if detail, ok := strings.CutPrefix(msg, err.Error()+": "); ok {
+			return fmt.Errorf("%w: %s", err, detail)
+		}
+	}
+	return errors.New(msg)
+}
+
+// retriable reports whether a leader's error may not recur on another try.
+// Retrying a write that failed with ErrLeadershipLost is safe because it
+// carries the same session sequence number.
+func retriable(err error) bool {
+	return errors.Is(err, raft.ErrShutdown) || errors.Is(err, raft.ErrReadQuorum) ||
+		errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrEntryOverwritten) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// jitter spreads d over [d/2, d) so that clients do not retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
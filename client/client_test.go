@@ -0,0 +1,229 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"raft"
+)
+
+// fakeNode serves the Execute RPC with answer and records the requests it
+// got.
+type fakeNode struct {
+	mu     sync.Mutex
+	answer func(n int, args *raft.ExecuteArgs, reply *raft.ExecuteReply)
+	calls  []raft.ExecuteArgs
+}
+
+func (f *fakeNode) Execute(args *raft.ExecuteArgs, reply *raft.ExecuteReply) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, *args)
+	f.answer(len(f.calls), args, reply)
+	return nil
+}
+
+func (f *fakeNode) requests() []raft.ExecuteArgs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]raft.ExecuteArgs(nil), f.calls...)
+}
+
+// serve starts an RPC server for f and returns its address.
+func serve(t *testing.T, f *fakeNode) string {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Raft", f); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Accept(ln)
+	return ln.Addr().String()
+}
+
+// leader answers as the leader, echoing the command.
+func leader(_ int, args *raft.ExecuteArgs, reply *raft.ExecuteReply) {
+	reply.IsLeader, reply.Success, reply.Value = true, true, args.Command
+}
+
+// follower answers as a follower that knows of leaderID.
+func follower(leaderID int) func(int, *raft.ExecuteArgs, *raft.ExecuteReply) {
+	return func(_ int, _ *raft.ExecuteArgs, reply *raft.ExecuteReply) {
+		reply.LeaderID = leaderID
+	}
+}
+
+// newTestClient returns a client for nodes, with IDs from 1, that backs off
+// briefly.
+func newTestClient(t *testing.T, nodes ...*fakeNode) *Client {
+	t.Helper()
+	peers := make(map[int]string)
+	for i, f := range nodes {
+		peers[i+1] = serve(t, f)
+	}
+	c, err := New(Config{Peers: peers, Retry: RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientFollowsLeaderHint(t *testing.T) {
+	nodes := []*fakeNode{{answer: follower(3)}, {answer: follower(3)}, {answer: leader}}
+	c := newTestClient(t, nodes...)
+	ctx := context.Background()
+
+	value, served, err := c.ExecuteServed(ctx, []byte("x"), false)
+	if err != nil || string(value) != "x" || served.NodeID != 3 {
+		t.Fatalf("ExecuteServed = %q from node %d, %v; want x from node 3", value, served.NodeID, err)
+	}
+	if n := len(nodes[0].requests()); n != 1 {
+		t.Fatalf("node 1 got %d requests, want 1 before the redirect", n)
+	}
+	// The leader is cached: later requests go to it directly.
+	if _, err := c.Execute(ctx, []byte("y"), true); err != nil {
+		t.Fatal(err)
+	}
+	if n1, n2, n3 := len(nodes[0].requests()), len(nodes[1].requests()), len(nodes[2].requests()); n1 != 1 || n2 != 0 || n3 != 2 {
+		t.Fatalf("nodes got %d, %d and %d requests; want 1, 0 and 2", n1, n2, n3)
+	}
+}
+
+func TestClientGivesUpWithoutLeader(t *testing.T) {
+	node := &fakeNode{answer: follower(-1)}
+	c := newTestClient(t, node)
+	_, err := c.Execute(context.Background(), []byte("x"), false)
+	var nle *raft.NotLeaderError
+	if !errors.As(err, &nle) || nle.LeaderID != -1 {
+		t.Fatalf("Execute with no leader = %v, want a NotLeaderError", err)
+	}
+	if n := len(node.requests()); n != 5 {
+		t.Fatalf("node got %d requests, want MaxAttempts", n)
+	}
+}
+
+func TestClientRetriesWriteInSameSession(t *testing.T) {
+	node := &fakeNode{answer: func(n int, args *raft.ExecuteArgs, reply *raft.ExecuteReply) {
+		if n == 1 {
+			reply.IsLeader, reply.Error = true, raft.ErrLeadershipLost.Error()
+			return
+		}
+		leader(n, args, reply)
+	}}
+	c := newTestClient(t, node)
+	ctx := context.Background()
+	if _, err := c.Execute(ctx, []byte("x"), false); err != nil {
+		t.Fatalf("write after ErrLeadershipLost: %v", err)
+	}
+	if _, err := c.Execute(ctx, []byte("y"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := node.requests()
+	if len(reqs) != 3 {
+		t.Fatalf("node got %d requests, want 3", len(reqs))
+	}
+	if reqs[0].ClientID == 0 || reqs[0].ClientID != reqs[1].ClientID || reqs[0].Seq != reqs[1].Seq {
+		t.Fatalf("retry sent session %d seq %d, first try %d seq %d; want the same",
+			reqs[1].ClientID, reqs[1].Seq, reqs[0].ClientID, reqs[0].Seq)
+	}
+	if reqs[2].ClientID != reqs[0].ClientID || reqs[2].Seq != reqs[0].Seq+1 {
+		t.Fatalf("next write sent session %d seq %d, want %d seq %d",
+			reqs[2].ClientID, reqs[2].Seq, reqs[0].ClientID, reqs[0].Seq+1)
+	}
+}
+
+func TestClientReturnsLeaderErrors(t *testing.T) {
+	node := &fakeNode{answer: func(_ int, _ *raft.ExecuteArgs, reply *raft.ExecuteReply) {
+		reply.IsLeader, reply.Error = true, raft.ErrNotInteger.Error()+": value is \"one\""
+	}}
+	c := newTestClient(t, node)
+	_, err := c.Execute(context.Background(), []byte("x"), false)
+	if !errors.Is(err, raft.ErrNotInteger) {
+		t.Fatalf("Execute = %v, want ErrNotInteger", err)
+	}
+	if n := len(node.requests()); n != 1 {
+		t.Fatalf("node got %d requests, want 1: the error is not retriable", n)
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	for _, tt := range []struct {
+		msg       string
+		want      error // nil: matches no known error
+		retriable bool
+	}{
+		{raft.ErrLeadershipLost.Error(), raft.ErrLeadershipLost, true},
+		{raft.ErrReadQuorum.Error() + ": 1 of 3 nodes", raft.ErrReadQuorum, true},
+		{raft.ErrShutdown.Error(), raft.ErrShutdown, true},
+		{context.DeadlineExceeded.Error(), context.DeadlineExceeded, true},
+		{raft.ErrStaleSequence.Error() + ": seq 3", raft.ErrStaleSequence, false},
+		{raft.ErrCompacted.Error(), raft.ErrCompacted, false},
+		{raft.ErrLeadershipLost.Error() + "x", nil, false},
+		{"disk full", nil, false},
+	} {
+		err := replyError(tt.msg)
+		if err.Error() != tt.msg {
+			t.Fatalf("replyError(%q) reads %q", tt.msg, err)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Fatalf("replyError(%q) = %v, want it to match %v", tt.msg, err, tt.want)
+		}
+		if got := retriable(err); got != tt.retriable {
+			t.Fatalf("retriable(%q) = %v, want %v", tt.msg, got, tt.retriable)
+		}
+	}
+}
+
+func TestConnPoolStaysWithinSize(t *testing.T) {
+	addr := serve(t, &fakeNode{answer: leader})
+	p := &connPool{addr: addr, size: 2, dialTimeout: time.Second}
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.get(context.Background()); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if len(p.conns) > p.size || p.dialing != 0 {
+		t.Fatalf("pool holds %d connections with %d dials in flight, size %d", len(p.conns), p.dialing, p.size)
+	}
+
+	p.close()
+	if conn, err := p.get(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("get on a closed pool = %v, %v; want ErrClosed", conn, err)
+	}
+	if len(p.conns) != 0 {
+		t.Fatalf("closed pool holds %d connections", len(p.conns))
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	c := newTestClient(t, &fakeNode{answer: leader})
+	c.Close()
+	if _, err := c.Execute(context.Background(), []byte("x"), true); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Execute on a closed client = %v, want ErrClosed", err)
+	}
+	if _, err := c.Status(context.Background(), 1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Status on a closed client = %v, want ErrClosed", err)
+	}
+}
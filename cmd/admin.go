@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"raft"
+	"raft/client"
+
+	"github.com/urfave/cli/v2"
+)
+
+// adminResult is the JSON output of an admin subcommand.
+type adminResult struct {
+	Op       string        `json:"op"`
+	Success  bool          `json:"success"`
+	LeaderID int           `json:"leader_id"` // the leader after the operation, -1 if unknown
+	Members  []raft.Member `json:"members,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// adminCommand is the admin command group. Every subcommand finds the leader
+// and runs its operation there through the Admin RPC.
+func adminCommand() *cli.Command {
+	idFlag := func() cli.Flag { return &cli.IntFlag{Name: "id", Usage: "ID of the node", Required: true} }
+	return &cli.Command{
+		Name:  "admin",
+		Usage: "Inspect the membership and hand over leadership",
+		Subcommands: []*cli.Command{
+			adminSubcommand("list-members", "List the members of the cluster as the leader sees them", raft.AdminListMembers),
+			adminSubcommand("transfer-leader", "Hand leadership to the node given by --id", raft.AdminTransferLeader, idFlag()),
+			adminSubcommand("step-down", "Hand leadership to the most up-to-date reachable follower", raft.AdminStepDown),
+		},
+	}
+}
+
+func adminSubcommand(name, usage string, op raft.AdminOp, flags ...cli.Flag) *cli.Command {
+	return &cli.Command{
+		Name:  name,
+		Usage: usage,
+		Action: func(c *cli.Context) error {
+			args := raft.AdminArgs{Op: op, ID: c.Int("id")}
+			return runAdmin(c.String("conf"), c.Duration("timeout"), args, c.Bool("json"))
+		},
+		Flags: append(flags,
+			&cli.StringFlag{
+				Name:  "conf",
+				Usage: "Path to config file",
+				Value: "cluster.conf",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "How long to wait for the operation, including finding the leader",
+				Value: 10 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the result as JSON",
+				Value: false,
+			},
+		),
+	}
+}
+
+// runAdmin runs args on the leader of the cluster in confPath and prints the
+// result. A failed operation makes the command fail.
+func runAdmin(confPath string, timeout time.Duration, args raft.AdminArgs, asJSON bool) error {
+	kv, err := client.New(client.Config{ConfPath: confPath, ConnsPerNode: 1})
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := kv.Admin(ctx, args)
+	if asJSON {
+		res := adminResult{Op: args.Op.String(), Success: err == nil, LeaderID: reply.LeaderID, Members: reply.Members}
+		if err != nil {
+			res.LeaderID, res.Error = -1, err.Error()
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(res); encErr != nil {
+			return encErr
+		}
+		if err != nil {
+			return cli.Exit("", 1)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch args.Op {
+	case raft.AdminListMembers:
+		rows := [][]string{{"ID", "ADDR", "LEADER", "REACHABLE", "MATCH"}}
+		for _, m := range reply.Members {
+			leader, reachable := "", "yes"
+			if m.Leader {
+				leader = "*"
+			}
+			if !m.Reachable {
+				reachable = "no"
+			}
+			rows = append(rows, []string{fmt.Sprint(m.ID), m.Addr, leader, reachable, fmt.Sprint(m.MatchIndex)})
+		}
+		printTable(rows, nil, false)
+	case raft.AdminTransferLeader, raft.AdminStepDown:
+		if reply.LeaderID == -1 {
+			fmt.Println("Leadership handed over; the new leader is not known yet")
+		} else {
+			fmt.Printf("Node %d is the leader\n", reply.LeaderID)
+		}
+	default:
+		fmt.Printf("%s done\n", args.Op)
+	}
+	return nil
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
-	"net/rpc"
-	"sort"
 	"sync"
 	"time"
 
 	r "raft"
+	"raft/client"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -23,112 +24,31 @@ type WorkerResult struct {
 }
 
 type Client struct {
+	kv       *client.Client
 	peers    map[int]string
-	peerIDs  []int
-	conns    map[int]*rpc.Client
-	mu       sync.Mutex
-	leaderID int
 	workers  int
 	numKeys  int
 	workload int
 	debug    bool
 }
 
-func NewClient(confPath string, workers, numKeys, workload int, debug bool) *Client {
-	peers := r.ParseConfig(confPath)
-	ids := make([]int, 0, len(peers))
-	for id := range peers {
-		ids = append(ids, id)
+func NewClient(confPath string, workers, numKeys, workload int, debug bool, tp trace.TracerProvider) (*Client, error) {
+	peers, err := r.ParseConfig(confPath)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := client.New(client.Config{Peers: peers, TracerProvider: tp})
+	if err != nil {
+		return nil, err
 	}
-	sort.Ints(ids)
-
 	return &Client{
+		kv:       kv,
 		peers:    peers,
-		peerIDs:  ids,
-		conns:    make(map[int]*rpc.Client),
-		leaderID: -1,
 		workers:  workers,
 		numKeys:  numKeys,
 		workload: workload,
 		debug:    debug,
-	}
-}
-
-func (c *Client) getConn(id int) *rpc.Client {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.conns[id] == nil {
-		conn, err := rpc.Dial("tcp", c.peers[id])
-		if err != nil {
-			return nil
-		}
-		c.conns[id] = conn
-	}
-	return c.conns[id]
-}
-
-func (c *Client) invalidateConn(id int) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.conns[id] != nil {
-		c.conns[id].Close()
-		c.conns[id] = nil
-	}
-	if c.leaderID == id {
-		c.leaderID = -1
-	}
-}
-
-func (c *Client) execute(command []byte) (string, bool) {
-	c.mu.Lock()
-	startID := c.leaderID
-	c.mu.Unlock()
-
-	// Build try list: cached leader first, then others
-	tryList := make([]int, 0, len(c.peerIDs))
-	if startID != -1 {
-		tryList = append(tryList, startID)
-	}
-	for _, id := range c.peerIDs {
-		if id != startID {
-			tryList = append(tryList, id)
-		}
-	}
-
-	tried := make(map[int]bool)
-	for len(tryList) > 0 {
-		id := tryList[0]
-		tryList = tryList[1:]
-		if tried[id] {
-			continue
-		}
-		tried[id] = true
-
-		conn := c.getConn(id)
-		if conn == nil {
-			continue
-		}
-		args := &r.ExecuteArgs{Command: command}
-		reply := &r.ExecuteReply{}
-		if err := conn.Call(r.Execute, args, reply); err != nil {
-			c.invalidateConn(id)
-			continue
-		}
-		if reply.IsLeader {
-			c.mu.Lock()
-			c.leaderID = id
-			c.mu.Unlock()
-			return string(reply.Value), reply.Success
-		}
-		// Use leader hint: prepend hinted node to front of remaining list
-		if reply.LeaderID != -1 && !tried[reply.LeaderID] {
-			c.mu.Lock()
-			c.leaderID = reply.LeaderID
-			c.mu.Unlock()
-			tryList = append([]int{reply.LeaderID}, tryList...)
-		}
-	}
-	return "", false
+	}, nil
 }
 
 func (c *Client) Run() {
@@ -138,6 +58,7 @@ func (c *Client) Run() {
 
 	time.Sleep(2 * time.Second)
 	c.runBenchmark()
+	c.kv.Close()
 }
 
 func (c *Client) runBenchmark() {
@@ -188,16 +109,15 @@ func (c *Client) worker(ctx context.Context) WorkerResult {
 
 		key := fmt.Sprintf("k%d", rand.Intn(c.numKeys))
 		start := time.Now()
-		var ok bool
+		var err error
 
 		if rand.Intn(100) < c.workload {
-			value := randomValue(VALUE_MAX)
-			_, ok = c.execute([]byte(fmt.Sprintf("SET %s %s", key, value)))
+			err = c.kv.Set(ctx, key, randomValue(VALUE_MAX))
 		} else {
-			_, ok = c.execute([]byte(fmt.Sprintf("GET %s", key)))
+			_, err = c.kv.Get(ctx, key)
 		}
 
-		if ok {
+		if err == nil {
 			res.count++
 			res.duration += time.Since(start)
 		}
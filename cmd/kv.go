@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"raft"
+	"raft/client"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	KV_SCAN_LIMIT    = 100     // keys scan shows unless told otherwise
+	KV_MAX_LINE_SIZE = 1 << 20 // longest line the shell reads; use set KEY @FILE for more
+)
+
+// errKeyNotFound makes a one-shot get exit with status 1.
+var errKeyNotFound = errors.New("key not found")
+
+// kvShell runs KVStore commands against the cluster's leader. Values and keys
+// go to out and the details of how a request was served to info, so that a
+// value can be piped on its own.
+type kvShell struct {
+	kv      *client.Client
+	timeout time.Duration
+	out     io.Writer
+	info    io.Writer
+}
+
+// kvCommand is the kv command: one-shot get, set, delete and scan
+// subcommands, or an interactive shell if none is given.
+func kvCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "kv",
+		Usage:     "Read and write keys of the built-in KVStore, or open an interactive shell",
+		ArgsUsage: " ",
+		Action: func(c *cli.Context) error {
+			if c.NArg() > 0 {
+				return fmt.Errorf("unknown kv command %q", c.Args().First())
+			}
+			sh, err := newKVShell(c)
+			if err != nil {
+				return err
+			}
+			defer sh.kv.Close()
+			return sh.repl(os.Stdin)
+		},
+		Flags: kvFlags(),
+		Subcommands: []*cli.Command{
+			{
+				Name:      "get",
+				Usage:     "Print the value of a key",
+				ArgsUsage: "KEY",
+				Flags:     kvFlags(),
+				Action: kvAction(1, func(sh *kvShell, c *cli.Context) error {
+					return sh.get(c.Args().Get(0))
+				}),
+			},
+			{
+				Name:      "set",
+				Usage:     "Set a key to VALUE, to the contents of --file, or to stdin if VALUE is - or missing",
+				ArgsUsage: "[--file PATH] KEY [VALUE]",
+				Flags: append(kvFlags(), &cli.StringFlag{
+					Name:  "file",
+					Usage: "Read the value from this file",
+				}),
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 || c.NArg() > 2 {
+						return fmt.Errorf("usage: kv set [--file PATH] KEY [VALUE] (flags go before KEY)")
+					}
+					value, err := readValue(c.Args().Get(1), c.NArg() == 2, c.String("file"), os.Stdin)
+					if err != nil {
+						return err
+					}
+					return kvAction(-1, func(sh *kvShell, c *cli.Context) error {
+						return sh.set(c.Args().Get(0), value)
+					})(c)
+				},
+			},
+			{
+				Name:      "delete",
+				Aliases:   []string{"del"},
+				Usage:     "Delete a key",
+				ArgsUsage: "KEY",
+				Flags:     kvFlags(),
+				Action: kvAction(1, func(sh *kvShell, c *cli.Context) error {
+					return sh.delete(c.Args().Get(0))
+				}),
+			},
+			{
+				Name:      "scan",
+				Usage:     "List the keys starting with PREFIX, or from --start up to --end, with their values",
+				ArgsUsage: "[--limit N] [PREFIX | --start KEY [--end KEY]]",
+				Flags: append(kvFlags(),
+					&cli.StringFlag{
+						Name:  "start",
+						Usage: "First key to list (instead of a prefix)",
+					},
+					&cli.StringFlag{
+						Name:  "end",
+						Usage: "List keys before this one; empty for no bound",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Most keys to list",
+						Value: KV_SCAN_LIMIT,
+					},
+				),
+				Action: func(c *cli.Context) error {
+					if c.NArg() > 1 || (c.NArg() == 1 && (c.IsSet("start") || c.IsSet("end"))) {
+						return fmt.Errorf("usage: kv scan [--limit N] [PREFIX | --start KEY [--end KEY]] (flags go before PREFIX)")
+					}
+					start, end := c.String("start"), c.String("end")
+					if c.NArg() == 1 {
+						start, end = c.Args().Get(0), string(raft.PrefixEnd([]byte(c.Args().Get(0))))
+					}
+					return kvAction(-1, func(sh *kvShell, c *cli.Context) error {
+						return sh.scan(start, end, c.Int("limit"))
+					})(c)
+				},
+			},
+		},
+	}
+}
+
+func kvFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "conf",
+			Usage: "Path to config file",
+			Value: "cluster.conf",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "How long to wait for each request, including finding the leader",
+			Value: 5 * time.Second,
+		},
+	}
+}
+
+// kvAction runs f with a shell for a one-shot subcommand taking nargs
+// arguments (-1: checked by the caller).
+func kvAction(nargs int, f func(sh *kvShell, c *cli.Context) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		if nargs >= 0 && c.NArg() != nargs {
+			return fmt.Errorf("usage: kv %s %s", c.Command.Name, c.Command.ArgsUsage)
+		}
+		sh, err := newKVShell(c)
+		if err != nil {
+			return err
+		}
+		defer sh.kv.Close()
+		sh.info = os.Stderr
+		if err := f(sh, c); err != nil {
+			if err == errKeyNotFound {
+				return cli.Exit("", 1)
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+func newKVShell(c *cli.Context) (*kvShell, error) {
+	kv, err := client.New(client.Config{ConfPath: c.String("conf"), ConnsPerNode: 1})
+	if err != nil {
+		return nil, err
+	}
+	return &kvShell{kv: kv, timeout: c.Duration("timeout"), out: os.Stdout, info: os.Stdout}, nil
+}
+
+// readValue returns the value of kv set: arg if given (stdin if it is -), the
+// contents of file, or stdin if neither is given.
+func readValue(arg string, given bool, file string, stdin *os.File) ([]byte, error) {
+	switch {
+	case given && file != "":
+		return nil, fmt.Errorf("give either VALUE or --file, not both")
+	case file != "":
+		return os.ReadFile(file)
+	case given && arg != "-":
+		return []byte(arg), nil
+	case !given && isTerminal(stdin):
+		return nil, fmt.Errorf("missing VALUE (or --file, or a value on stdin)")
+	}
+	return io.ReadAll(stdin)
+}
+
+func (sh *kvShell) do(cmd raft.KVCommand) (raft.KVResult, client.Served, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sh.timeout)
+	defer cancel()
+	return sh.kv.DoServed(ctx, cmd)
+}
+
+// served describes how a request was served, for the info output.
+func served(s client.Served, rev uint64) string {
+	detail := fmt.Sprintf("node %d", s.NodeID)
+	if s.Index != 0 {
+		detail += fmt.Sprintf(", index %d", s.Index)
+	}
+	detail += fmt.Sprintf(", commit index %d", s.CommitIndex)
+	if rev != 0 {
+		detail += fmt.Sprintf(", revision %d", rev)
+	}
+	return detail
+}
+
+func (sh *kvShell) get(key string) error {
+	res, s, err := sh.do(raft.KVCommand{Op: raft.KVGet, Key: []byte(key)})
+	if err != nil {
+		return err
+	}
+	if !res.Found {
+		fmt.Fprintf(sh.info, "(not found; %s)\n", served(s, 0))
+		return errKeyNotFound
+	}
+	sh.out.Write(res.Value)
+	// A value piped on its own is written as it is.
+	if !bytes.HasSuffix(res.Value, []byte("\n")) && (sh.info == sh.out || isTerminal(os.Stdout)) {
+		fmt.Fprintln(sh.out)
+	}
+	fmt.Fprintf(sh.info, "(%d bytes; %s)\n", len(res.Value), served(s, res.Revision))
+	return nil
+}
+
+func (sh *kvShell) set(key string, value []byte) error {
+	res, s, err := sh.do(raft.KVCommand{Op: raft.KVSet, Key: []byte(key), Value: value})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.info, "OK (%d bytes; %s)\n", len(value), served(s, res.Revision))
+	return nil
+}
+
+func (sh *kvShell) delete(key string) error {
+	res, s, err := sh.do(raft.KVCommand{Op: raft.KVDelete, Key: []byte(key)})
+	if err != nil {
+		return err
+	}
+	if !res.Found {
+		fmt.Fprintf(sh.info, "(not found; %s)\n", served(s, 0))
+		return errKeyNotFound
+	}
+	fmt.Fprintf(sh.info, "OK (%s)\n", served(s, 0))
+	return nil
+}
+
+// scan prints up to limit keys from start up to end, one "key<TAB>value"
+// line each.
+func (sh *kvShell) scan(start, end string, limit int) error {
+	if limit <= 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+	res, s, err := sh.do(raft.KVCommand{Op: raft.KVRange, Key: []byte(start), End: []byte(end), Limit: uint64(limit)})
+	if err != nil {
+		return err
+	}
+	for _, kv := range res.Results {
+		fmt.Fprintf(sh.out, "%s\t%s", kv.Key, kv.Value)
+		if !bytes.HasSuffix(kv.Value, []byte("\n")) {
+			fmt.Fprintln(sh.out)
+		}
+	}
+	noun := "keys"
+	if len(res.Results) == 1 {
+		noun = "key"
+	}
+	fmt.Fprintf(sh.info, "(%d %s; %s)\n", len(res.Results), noun, served(s, res.Revision))
+	if res.More {
+		fmt.Fprintf(sh.info, "(more keys from %q)\n", res.Key)
+	}
+	return nil
+}
+
+const kvShellHelp = `Commands:
+  get KEY               print the value of KEY
+  set KEY VALUE         set KEY to the rest of the line
+  set KEY @FILE         set KEY to the contents of FILE
+  set KEY @@VALUE       set KEY to @VALUE (a value starting with @)
+  delete KEY            delete KEY (also: del)
+  scan [PREFIX [LIMIT]] list keys starting with PREFIX (default limit 100)
+  help                  show this help
+  exit                  leave the shell (also: quit, Ctrl-D)
+`
+
+// repl reads commands from in until it ends or exit is given. Errors are
+// printed and the shell goes on.
+func (sh *kvShell) repl(in *os.File) error {
+	interactive := isTerminal(in)
+	if interactive {
+		fmt.Fprintln(sh.out, `Type "help" for the commands.`)
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), KV_MAX_LINE_SIZE)
+	for {
+		if interactive {
+			fmt.Fprint(sh.out, "kv> ")
+		}
+		if !scanner.Scan() {
+			if interactive {
+				fmt.Fprintln(sh.out)
+			}
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "exit" || line == "quit" {
+			return nil
+		}
+		if err := sh.run(line); err != nil && err != errKeyNotFound {
+			fmt.Fprintln(sh.out, "error:", err)
+		}
+	}
+}
+
+// run runs one line of the shell.
+func (sh *kvShell) run(line string) error {
+	name, rest := cutField(line)
+	key, value := cutField(rest)
+	switch name {
+	case "get", "delete", "del":
+		if key == "" || value != "" {
+			return fmt.Errorf("usage: %s KEY", name)
+		}
+		if name == "get" {
+			return sh.get(key)
+		}
+		return sh.delete(key)
+	case "set":
+		if key == "" || value == "" {
+			return fmt.Errorf("usage: set KEY VALUE or set KEY @FILE")
+		}
+		// A leading @ names a file; @@ stands for a literal @.
+		if literal, ok := strings.CutPrefix(value, "@@"); ok {
+			return sh.set(key, []byte("@"+literal))
+		}
+		if file, ok := strings.CutPrefix(value, "@"); ok {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			return sh.set(key, data)
+		}
+		return sh.set(key, []byte(value))
+	case "scan":
+		limit := KV_SCAN_LIMIT
+		if value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("usage: scan [PREFIX [LIMIT]]")
+			}
+			limit = n
+		}
+		return sh.scan(key, string(raft.PrefixEnd([]byte(key))), limit)
+	case "help":
+		fmt.Fprint(sh.out, kvShellHelp)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q (try help)", name)
+}
+
+// cutField splits s into its first whitespace-separated field and the rest,
+// trimmed.
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i:])
+	}
+	return s, ""
+}
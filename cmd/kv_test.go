@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"raft"
+	"raft/client"
+)
+
+// fakeLeader serves the Execute RPC from a KVStore, as a one-node cluster
+// would.
+type fakeLeader struct {
+	kv *raft.KVStore
+}
+
+func (f *fakeLeader) Execute(args *raft.ExecuteArgs, reply *raft.ExecuteReply) error {
+	var err error
+	if args.Read {
+		reply.Value, err = f.kv.Query(args.Command)
+	} else {
+		reply.Value, err = f.kv.Apply(args.Command)
+	}
+	reply.IsLeader, reply.Success = true, err == nil
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	return nil
+}
+
+// newTestShell returns a shell on a fake leader that writes everything to
+// out.
+func newTestShell(t *testing.T) (*kvShell, *bytes.Buffer) {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Raft", &fakeLeader{kv: raft.NewKVStore()}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Accept(ln)
+
+	kv, err := client.New(client.Config{Peers: map[int]string{1: ln.Addr().String()}, ConnsPerNode: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	out := &bytes.Buffer{}
+	return &kvShell{kv: kv, timeout: 5 * time.Second, out: out, info: out}, out
+}
+
+// writeTemp writes data to a file in a temporary directory and returns its
+// path.
+func writeTemp(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "value")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKVShellRun(t *testing.T) {
+	sh, out := newTestShell(t)
+	file := writeTemp(t, "from\nfile")
+	for _, tt := range []struct {
+		line string
+		out  string // prefix of the output
+		err  string // substring of the error, "" for none
+	}{
+		{"get a", "(not found; node 1", errKeyNotFound.Error()},
+		{"set a hello  world", "OK (12 bytes; node 1, commit index 0, revision 1)\n", ""},
+		{"get a", "hello  world\n(12 bytes; node 1, commit index 0, revision 1)\n", ""},
+		{"set b @" + file, "OK (9 bytes;", ""},
+		{"get b", "from\nfile\n(9 bytes;", ""},
+		{"set c @@at", "OK (3 bytes;", ""},
+		{"get c", "@at\n", ""},
+		{"set d @", "", "no such file"},
+		{"set d @" + file + ".missing", "", "no such file"},
+		{"scan", "a\thello  world\nb\tfrom\nfile\nc\t@at\n(3 keys;", ""},
+		{"scan b 1", "b\tfrom\nfile\n(1 key;", ""},
+		{"  delete   a  ", "OK (node 1", ""},
+		{"del a", "(not found;", errKeyNotFound.Error()},
+		{"help", kvShellHelp, ""},
+		{"get", "", "usage: get KEY"},
+		{"get a b", "", "usage: get KEY"},
+		{"delete", "", "usage: delete KEY"},
+		{"set a", "", "usage: set KEY VALUE"},
+		{"scan b x", "", "usage: scan [PREFIX [LIMIT]]"},
+		{"scan b 0", "", "limit must be positive"},
+		{"frob a", "", `unknown command "frob"`},
+	} {
+		out.Reset()
+		err := sh.run(tt.line)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Fatalf("run(%q) = %v, want error %q", tt.line, err, tt.err)
+		}
+		if !strings.HasPrefix(out.String(), tt.out) {
+			t.Fatalf("run(%q) wrote %q, want it to start with %q", tt.line, out, tt.out)
+		}
+	}
+}
+
+func TestKVShellRepl(t *testing.T) {
+	sh, out := newTestShell(t)
+	in, err := os.Open(writeTemp(t, "set k v\n\nbogus\nget k\nget nope\nexit\nset k w\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if err := sh.repl(in); err != nil {
+		t.Fatal(err)
+	}
+	// A file is no terminal: no prompts, errors are reported and the shell
+	// goes on until exit.
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{"OK (1 bytes;", `error: unknown command "bogus"`, "v", "(1 bytes;", "(not found;"}
+	if len(lines) != len(want) {
+		t.Fatalf("repl wrote %q, want %d lines", lines, len(want))
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(lines[i], w) {
+			t.Fatalf("line %d = %q, want it to start with %q", i, lines[i], w)
+		}
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	file := writeTemp(t, "from file")
+	stdin, err := os.Open(writeTemp(t, "from stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	for _, tt := range []struct {
+		arg   string
+		given bool
+		file  string
+		want  string
+		err   string // substring of the error, "" for none
+	}{
+		{"v", true, "", "v", ""},
+		{"@v", true, "", "@v", ""}, // only the shell reads @ as a file
+		{"", false, file, "from file", ""},
+		{"-", true, "", "from stdin", ""},
+		{"", false, "", "", ""}, // stdin was read to the end above
+		{"v", true, file, "", "not both"},
+		{"", false, file + ".missing", "", "no such file"},
+	} {
+		got, err := readValue(tt.arg, tt.given, tt.file, stdin)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Fatalf("readValue(%q, %v, %q) = %v, want error %q", tt.arg, tt.given, tt.file, err, tt.err)
+		}
+		if string(got) != tt.want {
+			t.Fatalf("readValue(%q, %v, %q) = %q, want %q", tt.arg, tt.given, tt.file, got, tt.want)
+		}
+	}
+}
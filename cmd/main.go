@@ -1,13 +1,43 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"raft"
 
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// newLogger builds the node's logger, writing to stderr in format at level
+// (or debug if debug is set).
+func newLogger(format, level string, debug bool) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid --log-level %q", level)
+	}
+	if debug {
+		lvl = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(raft.NewColorHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid --log-format %q (want text or json)", format)
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "raft",
@@ -23,18 +53,52 @@ func main() {
 					readBatchSize := c.Int("read-batch-size")
 					debug := c.Bool("debug")
 					asyncLog := c.Bool("async-log")
-					r := raft.New(raft.Config{
+					groupCommit := c.Bool("group-commit")
+					sessionTTL := c.Duration("session-ttl")
+					metricsAddr := c.String("metrics-addr")
+					logger, err := newLogger(c.String("log-format"), c.String("log-level"), debug)
+					if err != nil {
+						return err
+					}
+					tp, err := newTracerProvider(c, "raft", attribute.Int("raft.node", id))
+					if err != nil {
+						return err
+					}
+					var tracerProvider trace.TracerProvider
+					if tp != nil {
+						tracerProvider = tp
+						defer tp.Shutdown(context.Background())
+					}
+					r, err := raft.New(raft.Config{
 						ID:             id,
 						ConfPath:       conf,
 						WriteBatchSize: writeBatchSize,
 						ReadBatchSize:  readBatchSize,
 						Debug:          debug,
 						AsyncLog:       asyncLog,
+						GroupCommit:    groupCommit,
+						SessionTTL:     sessionTTL,
+						MetricsAddr:    metricsAddr,
+						Logger:         logger,
+						TracerProvider: tracerProvider,
 					}, raft.NewKVStore())
+					if err != nil {
+						return err
+					}
+
+					shutdownErr := make(chan error, 1)
+					stop := make(chan os.Signal, 1)
+					signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+					go func() {
+						<-stop
+						ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+						defer cancel()
+						shutdownErr <- r.Shutdown(ctx)
+					}()
 					r.Run()
-					return nil
+					return <-shutdownErr
 				},
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.IntFlag{
 						Name:     "id",
 						Usage:    "Node ID",
@@ -57,16 +121,96 @@ func main() {
 					},
 					&cli.BoolFlag{
 						Name:  "debug",
-						Usage: "Enable debug logging",
+						Usage: "Enable debug logging (same as --log-level debug)",
 						Value: false,
 					},
+					&cli.StringFlag{
+						Name:  "log-format",
+						Usage: "Log format: text (coloured by level) or json",
+						Value: "text",
+					},
+					&cli.StringFlag{
+						Name:  "log-level",
+						Usage: "Minimum log level: debug, info, warn or error",
+						Value: "info",
+					},
 					&cli.BoolFlag{
 						Name:  "async-log",
 						Usage: "Enable asynchronous disk writes",
 						Value: false,
 					},
+					&cli.BoolFlag{
+						Name:  "group-commit",
+						Usage: "Flush writes without lingering and share fsyncs between concurrent batches",
+						Value: false,
+					},
+					&cli.DurationFlag{
+						Name:  "session-ttl",
+						Usage: "Idle time after which a client session is forgotten (same on every node)",
+						Value: raft.DEFAULT_SESSION_TTL,
+					},
+					&cli.StringFlag{
+						Name:  "metrics-addr",
+						Usage: "Serve Prometheus metrics at /metrics on this address (e.g. :9100); disabled if empty",
+					},
+				}, traceFlags()...),
+			},
+			{
+				Name:  "migrate",
+				Usage: "Upgrade a node's data files to the current on-disk format",
+				Action: func(c *cli.Context) error {
+					id := c.Int("id")
+					migrated, err := raft.MigrateStorage(id)
+					for _, name := range migrated {
+						fmt.Printf("Migrated %s to format version %d\n", name, raft.FormatVersion)
+					}
+					if err != nil {
+						return err
+					}
+					if len(migrated) == 0 {
+						fmt.Printf("Data files of node %d are already up to date\n", id)
+					}
+					return nil
+				},
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:     "id",
+						Usage:    "Node ID",
+						Required: true,
+					},
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Show the status of every node in the cluster",
+				Action: func(c *cli.Context) error {
+					return runStatus(c.String("conf"), c.Duration("timeout"), c.Int("lag"), c.Bool("json"))
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "conf",
+						Usage: "Path to config file",
+						Value: "cluster.conf",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "How long to wait for each node to answer",
+						Value: 2 * time.Second,
+					},
+					&cli.IntFlag{
+						Name:  "lag",
+						Usage: "Highlight nodes at least this many log entries behind the leader",
+						Value: 100,
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the status of each node as JSON",
+						Value: false,
+					},
 				},
 			},
+			adminCommand(),
+			kvCommand(),
 			{
 				Name:  "client",
 				Usage: "Run the benchmark client",
@@ -84,11 +228,23 @@ func main() {
 					case "ycsb-c":
 						workload = 0
 					}
-					client := NewClient(conf, workers, numKeys, workload, debug)
+					tp, err := newTracerProvider(c, "raft-benchmark")
+					if err != nil {
+						return err
+					}
+					var tracerProvider trace.TracerProvider
+					if tp != nil {
+						tracerProvider = tp
+						defer tp.Shutdown(context.Background())
+					}
+					client, err := NewClient(conf, workers, numKeys, workload, debug, tracerProvider)
+					if err != nil {
+						return err
+					}
 					client.Run()
 					return nil
 				},
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "conf",
 						Usage: "Path to config file",
@@ -114,11 +270,12 @@ func main() {
 						Usage: "Enable debug logging",
 						Value: false,
 					},
-				},
+				}, traceFlags()...),
 			},
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"raft"
+	"raft/client"
+)
+
+const (
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// nodeStatus is the answer of one node to the status command.
+type nodeStatus struct {
+	ID     int              `json:"id"`
+	Addr   string           `json:"addr"`
+	Status *raft.NodeStatus `json:"status,omitempty"`
+	Error  string           `json:"error,omitempty"` // why the node could not be asked
+}
+
+// queryStatus asks every node in peers for its status at the same time.
+func queryStatus(peers map[int]string, timeout time.Duration) ([]nodeStatus, error) {
+	kv, err := client.New(client.Config{Peers: peers, ConnsPerNode: 1, DialTimeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	nodes := make([]nodeStatus, 0, len(peers))
+	for id, addr := range peers {
+		nodes = append(nodes, nodeStatus{ID: id, Addr: addr})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := kv.Status(ctx, nodes[i].ID)
+			if err != nil {
+				nodes[i].Error = err.Error()
+				return
+			}
+			nodes[i].Status = &s
+		}()
+	}
+	wg.Wait()
+	return nodes, nil
+}
+
+// printStatus prints the cluster as a table, one row per node, followed by
+// what looks wrong: nodes that did not answer, nodes lagBehind or more
+// entries behind the leader, peers a node cannot reach and disagreement on
+// the leader. Those rows are coloured if color is set.
+func printStatus(nodes []nodeStatus, lagBehind int, color bool) {
+	// The leader of the highest term knows how far each follower's log is
+	// replicated; without one the nodes are compared by their last index.
+	var leader *raft.NodeStatus
+	maxLast := 0
+	for _, n := range nodes {
+		if s := n.Status; s != nil {
+			if s.State == "leader" && (leader == nil || s.Term > leader.Term) {
+				leader = s
+			}
+			maxLast = max(maxLast, s.LastLogIndex)
+		}
+	}
+	lag := func(s *raft.NodeStatus) int {
+		if leader == nil {
+			return maxLast - s.LastLogIndex
+		}
+		for _, p := range leader.Peers {
+			if p.ID == s.ID {
+				return p.Lag
+			}
+		}
+		return 0
+	}
+
+	rows := [][]string{{"NODE", "ADDR", "STATE", "TERM", "LEADER", "VOTED", "LOG", "COMMIT", "APPLIED", "LAG", "PEERS", "LOG SIZE"}}
+	colors := []string{""}
+	var problems []string
+	leaders := make(map[int]bool)
+	for _, n := range nodes {
+		s := n.Status
+		if s == nil {
+			rows = append(rows, []string{fmt.Sprint(n.ID), n.Addr, "DOWN", "-", "-", "-", "-", "-", "-", "-", "-", "-"})
+			colors = append(colors, colorRed)
+			problems = append(problems, fmt.Sprintf("node %d did not answer: %s", n.ID, n.Error))
+			continue
+		}
+		if s.LeaderID != -1 {
+			// A node that knows of no leader, e.g. mid-election, does not
+			// disagree with the others.
+			leaders[s.LeaderID] = true
+		}
+		connected := 0
+		for _, p := range s.Peers {
+			if p.Connected {
+				connected++
+			}
+			if !p.Reachable {
+				problems = append(problems, fmt.Sprintf("node %d cannot reach node %d", s.ID, p.ID))
+			}
+		}
+		behind := lag(s)
+		row := []string{
+			fmt.Sprint(s.ID), n.Addr, s.State, fmt.Sprint(s.Term), idOrDash(s.LeaderID), idOrDash(s.VotedFor),
+			fmt.Sprintf("%d-%d", s.FirstLogIndex, s.LastLogIndex), fmt.Sprint(s.CommitIndex), fmt.Sprint(s.AppliedIndex),
+			fmt.Sprint(behind), fmt.Sprintf("%d/%d", connected, len(s.Peers)), formatBytes(s.LogFileSize),
+		}
+		if s == leader {
+			row[9] = "-"
+		}
+		c := ""
+		switch {
+		case behind >= lagBehind && s != leader:
+			c = colorYellow
+			problems = append(problems, fmt.Sprintf("node %d is %d entries behind", s.ID, behind))
+		case connected < len(s.Peers):
+			c = colorYellow
+		}
+		rows = append(rows, row)
+		colors = append(colors, c)
+	}
+	switch {
+	case leader == nil:
+		problems = append(problems, "no node is the leader")
+	case len(leaders) > 1:
+		problems = append(problems, "the nodes do not agree on the leader")
+	}
+
+	printTable(rows, colors, color)
+	if len(problems) > 0 {
+		fmt.Println()
+		for _, p := range problems {
+			if color {
+				p = colorYellow + p + colorReset
+			}
+			fmt.Println("! " + p)
+		}
+	}
+}
+
+// runStatus prints the status of every node in confPath, as a table or as
+// JSON.
+func runStatus(confPath string, timeout time.Duration, lagBehind int, asJSON bool) error {
+	peers, err := raft.ParseConfig(confPath)
+	if err != nil {
+		return err
+	}
+	nodes, err := queryStatus(peers, timeout)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(nodes)
+	}
+	printStatus(nodes, lagBehind, isTerminal(os.Stdout))
+	return nil
+}
+
+// printTable prints rows as left-aligned columns, each row in its colour
+// from colors (nil, or "" for a row: none) if color is set.
+func printTable(rows [][]string, colors []string, color bool) {
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	for i, row := range rows {
+		var line strings.Builder
+		for j, cell := range row {
+			if j == len(row)-1 {
+				line.WriteString(cell)
+			} else {
+				fmt.Fprintf(&line, "%-*s  ", widths[j], cell)
+			}
+		}
+		if color && colors != nil && colors[i] != "" {
+			fmt.Println(colors[i] + line.String() + colorReset)
+		} else {
+			fmt.Println(line.String())
+		}
+	}
+}
+
+func idOrDash(id int) string {
+	if id < 0 {
+		return "-"
+	}
+	return fmt.Sprint(id)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// isTerminal reports whether f is a terminal, so output may be coloured.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("NO_COLOR") == ""
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// traceFlags are the flags of the commands that can export traces.
+func traceFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "trace-otlp",
+			Usage: "Export traces over OTLP/HTTP to this collector endpoint (e.g. localhost:4318)",
+		},
+		&cli.StringFlag{
+			Name:  "trace-file",
+			Usage: "Append traces as JSON to this file",
+		},
+		&cli.Float64Flag{
+			Name:  "trace-sample-ratio",
+			Usage: "Fraction of requests to trace when tracing is enabled",
+			Value: 1,
+		},
+	}
+}
+
+// newTracerProvider returns the tracer provider the trace flags ask for, or
+// nil if tracing is off. Call its Shutdown to flush the remaining spans.
+func newTracerProvider(c *cli.Context, service string, attrs ...attribute.KeyValue) (*sdktrace.TracerProvider, error) {
+	endpoint, path := c.String("trace-otlp"), c.String("trace-file")
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch {
+	case endpoint != "" && path != "":
+		return nil, fmt.Errorf("--trace-otlp and --trace-file cannot be used together")
+	case endpoint != "":
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	case path != "":
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	attrs = append(attrs, attribute.String("service.name", service))
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.Float64("trace-sample-ratio")))),
+	), nil
+}
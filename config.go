@@ -3,30 +3,89 @@ package raft
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"os"
 )
 
 type Node struct {
-	ID   int    `json:"id"`
-	IP   string `json:"ip"`
-	Port int    `json:"port"`
+	ID       int    `json:"id"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	HTTPPort int    `json:"http_port,omitempty"` // HTTP client API, disabled if 0
+	RESPPort int    `json:"resp_port,omitempty"` // Redis protocol front-end, disabled if 0
 }
 
-func ParseConfig(confPath string) map[int]string {
-	file, err := ioutil.ReadFile(confPath)
+// ParseConfig reads the cluster configuration at confPath and returns the RPC
+// address of every node keyed by ID. Errors match ErrInvalidConfig.
+func ParseConfig(confPath string) (map[int]string, error) {
+	nodes, err := parseNodes(confPath)
 	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
+		return nil, err
+	}
+	peerIPs := make(map[int]string)
+	for _, node := range nodes {
+		peerIPs[node.ID] = fmt.Sprintf("%s:%d", node.IP, node.Port)
+	}
+	return peerIPs, nil
+}
+
+// ParseHTTPConfig reads the cluster configuration at confPath and returns the
+// HTTP API address of every node that has one, keyed by ID. Errors match
+// ErrInvalidConfig.
+func ParseHTTPConfig(confPath string) (map[int]string, error) {
+	return parseServiceConfig(confPath, func(node Node) int { return node.HTTPPort })
+}
+
+// ParseRESPConfig reads the cluster configuration at confPath and returns the
+// RESP address of every node that has one, keyed by ID. Errors match
+// ErrInvalidConfig.
+func ParseRESPConfig(confPath string) (map[int]string, error) {
+	return parseServiceConfig(confPath, func(node Node) int { return node.RESPPort })
+}
+
+func parseServiceConfig(confPath string, port func(Node) int) (map[int]string, error) {
+	nodes, err := parseNodes(confPath)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[int]string)
+	for _, node := range nodes {
+		if p := port(node); p != 0 {
+			addrs[node.ID] = fmt.Sprintf("%s:%d", node.IP, p)
+		}
+	}
+	return addrs, nil
+}
+
+func parseNodes(confPath string) ([]Node, error) {
+	file, err := os.ReadFile(confPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
 
 	var nodes []Node
 	if err := json.Unmarshal(file, &nodes); err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+		return nil, fmt.Errorf("%w: parse %s: %w", ErrInvalidConfig, confPath, err)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%w: %s lists no nodes", ErrInvalidConfig, confPath)
 	}
 
-	peerIPs := make(map[int]string)
+	seen := make(map[int]bool)
 	for _, node := range nodes {
-		peerIPs[node.ID] = fmt.Sprintf("%s:%d", node.IP, node.Port)
+		if seen[node.ID] {
+			return nil, fmt.Errorf("%w: %s lists node %d twice", ErrInvalidConfig, confPath, node.ID)
+		}
+		seen[node.ID] = true
+		if node.Port <= 0 || node.Port > 65535 {
+			return nil, fmt.Errorf("%w: node %d has invalid port %d", ErrInvalidConfig, node.ID, node.Port)
+		}
+		if node.HTTPPort < 0 || node.HTTPPort > 65535 || node.HTTPPort == node.Port {
+			return nil, fmt.Errorf("%w: node %d has invalid http_port %d", ErrInvalidConfig, node.ID, node.HTTPPort)
+		}
+		if node.RESPPort < 0 || node.RESPPort > 65535 || node.RESPPort == node.Port ||
+			(node.RESPPort != 0 && node.RESPPort == node.HTTPPort) {
+			return nil, fmt.Errorf("%w: node %d has invalid resp_port %d", ErrInvalidConfig, node.ID, node.RESPPort)
+		}
 	}
-	return peerIPs
+	return nodes, nil
 }
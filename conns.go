@@ -4,56 +4,81 @@ import (
 	"fmt"
 	"net"
 	"net/rpc"
-
-	"github.com/pkg/errors"
+	"time"
 )
 
+const DIAL_TIMEOUT = 1 * time.Second
+
 func (r *Raft) dialRPCToPeer(peerID int) error {
 	if peerID == r.me {
 		return nil
 	}
-	client, err := rpc.Dial("tcp", r.peerIPPort[peerID])
+	select {
+	case <-r.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", r.peerIPPort[peerID], DIAL_TIMEOUT)
 	if err != nil {
-		logMsg := fmt.Sprintf("Failed to connect to peer %d at %s: %v", peerID, r.peerIPPort[peerID], err)
-		r.logPut(logMsg, PURPLE)
-		return errors.WithStack(err)
+		r.logger.Debug("Failed to connect to peer", "peer", peerID, "addr", r.peerIPPort[peerID], "err", err)
+		r.mu.Lock()
+		r.setPeerReachableLocked(peerID, false, err)
+		r.mu.Unlock()
+		return fmt.Errorf("dial node %d: %w", peerID, err)
 	}
+	client := rpc.NewClient(conn)
 	r.mu.Lock()
+	if r.shutdown {
+		r.mu.Unlock()
+		client.Close()
+		return ErrShutdown
+	}
 	r.rpcConns[peerID] = client
+	r.setPeerReachableLocked(peerID, true, nil)
 	r.mu.Unlock()
-	msg := fmt.Sprintf("Connected to peer %d at %s", peerID, r.peerIPPort[peerID])
-	r.logPut(msg, GREEN)
+	r.logger.Info("Connected to peer", "peer", peerID, "addr", r.peerIPPort[peerID])
 	return nil
 }
 
 func (r *Raft) dialRPCToAllPeers() error {
 	for peerID := range r.peerIPPort {
 		if peerID != r.me {
-			logMsg := fmt.Sprintf("Dialing RPC to peer %d at %s", peerID, r.peerIPPort[peerID])
-			r.logPut(logMsg, CYAN)
-			go r.dialRPCToPeer(peerID)
+			r.logger.Debug("Dialing peer", "peer", peerID, "addr", r.peerIPPort[peerID])
+			r.goFunc(func() { r.dialRPCToPeer(peerID) })
 		}
 	}
 	return nil
 }
 
-func (r *Raft) listenRPC(peerIPPort map[int]string) error {
-	_ = rpc.Register(r)
-	l, err := net.Listen("tcp", peerIPPort[r.me])
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	msg := fmt.Sprintf("Listening for RPC connections on %s", peerIPPort[r.me])
-	r.logPut(msg, PURPLE)
+func (r *Raft) listenRPC() {
+	addr := r.listener.Addr().String()
+	r.logger.Info("Listening for RPC connections", "addr", addr)
 	for {
-		logMsg := fmt.Sprintf("Waiting to accept RPC connection on %s", peerIPPort[r.me])
-		r.logPut(logMsg, CYAN)
-		conn, err := l.Accept()
+		conn, err := r.listener.Accept()
 		if err != nil {
-			logMsg := fmt.Sprintf("Failed to accept RPC connection: %v", err)
-			r.logPut(logMsg, PURPLE)
+			select {
+			case <-r.shutdownCh:
+				return
+			default:
+			}
+			r.logger.Warn("Failed to accept RPC connection", "err", err)
 			continue
 		}
-		go rpc.ServeConn(conn)
+
+		r.mu.Lock()
+		if r.shutdown {
+			r.mu.Unlock()
+			conn.Close()
+			return
+		}
+		r.inboundConns[conn] = struct{}{}
+		r.mu.Unlock()
+
+		r.goFunc(func() {
+			r.rpcServer.ServeConn(conn)
+			r.mu.Lock()
+			delete(r.inboundConns, conn)
+			r.mu.Unlock()
+		})
 	}
 }
@@ -1,8 +1,8 @@
 package raft
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
 	"math/rand"
 	"sync/atomic"
 	"time"
@@ -14,40 +14,74 @@ const (
 	COMMUNICATION_LATENCY = 100 * time.Millisecond
 	AFTER_START_DELAY     = 1000 * time.Millisecond
 	HEARTBEAT_INTERVAL    = 10 * time.Millisecond
+	TICK_INTERVAL         = 100 * time.Millisecond
 )
 
+// Run drives the node's consensus loop until Shutdown is called.
 func (r *Raft) Run() {
-	time.Sleep(AFTER_START_DELAY) //wait for connections to establish
+	r.mu.Lock()
+	if r.shutdown {
+		r.mu.Unlock()
+		return
+	}
+	r.wg.Add(1)
+	r.mu.Unlock()
+	defer r.wg.Done()
+
+	if !r.sleep(AFTER_START_DELAY) { //wait for connections to establish
+		return
+	}
 	r.dialRPCToAllPeers()
-	time.Sleep(AFTER_START_DELAY) //wait for connections to establish
+	if !r.sleep(AFTER_START_DELAY) { //wait for connections to establish
+		return
+	}
 	for {
+		select {
+		case <-r.shutdownCh:
+			return
+		default:
+		}
 		state := r.state
 		switch state {
 		case FOLLOWER:
 			if err := r.doFollower(); err != nil {
-				log.Println("Error in follower state:", err)
+				r.logEvent(slog.LevelError, "Follower loop failed", "err", err)
 			}
 		case LEADER:
 			if err := r.doLeader(); err != nil {
-				r.logPut("I am a leader", YELLOW)
-				log.Println("Error in leader state:", err)
+				r.logEvent(slog.LevelError, "Leader loop failed", "err", err)
 			}
 		}
 	}
 }
 
+// sleep waits for d and reports false if the node was shut down meanwhile.
+func (r *Raft) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.shutdownCh:
+		return false
+	}
+}
+
 func (r *Raft) doFollower() error {
 	timeout := MINELECTION_TIMEOUT + time.Duration(rand.Intn(int(MAXELECTION_TIMEOUT-MINELECTION_TIMEOUT)))
 	timer := time.NewTimer(timeout)
 	select {
 	case <-timer.C:
 		//election timeout
-		r.logPut("Haven't received heartbeat, starting election", RED)
+		r.logEvent(slog.LevelInfo, "Election timeout, starting election", "timeout", timeout)
 		r.startElection()
 	case <-r.heartBeatCh:
-		r.logPut("Received heartbeat, resetting election timer", WHITE)
+		r.logEvent(slog.LevelDebug, "Received heartbeat, resetting election timer")
 		//received heartbeat
+	case <-r.timeoutNowCh:
+		r.logEvent(slog.LevelInfo, "Leader is handing over leadership, starting election")
+		r.startElection()
+	case <-r.shutdownCh:
 	}
+	timer.Stop()
 	return nil
 }
 
@@ -62,33 +96,63 @@ func (r *Raft) doLeader() error {
 		if id != r.me {
 			if !r.replicating[id] {
 				r.replicating[id] = true
-				go func(target int) {
-					msg := fmt.Sprintf("Sending heartbeat/appendEntries to node %d", target)
-					r.logPut(msg, WHITE)
+				target := id
+				r.goFunc(func() {
+					r.logEvent(slog.LevelDebug, "Sending AppendEntries", "peer", target)
 					r.sendAppendEntries(target)
 
 					r.mu.Lock()
 					delete(r.replicating, target)
 					r.mu.Unlock()
-				}(id)
+				})
 			}
 		}
 	}
 	r.mu.Unlock()
 
+	if t, ok := r.sm.(Ticker); ok && time.Since(r.lastTick) >= TICK_INTERVAL && r.ticking.CompareAndSwap(false, true) {
+		r.lastTick = time.Now()
+		leaderSince := r.leaderSince
+		r.goFunc(func() {
+			defer r.ticking.Store(false)
+			r.tick(t, leaderSince)
+		})
+	}
+
 	select {
 	case <-r.newLogEntryCh:
 	case reqs := <-r.ReadCh:
-		go r.processReadBatch(reqs)
+		r.goFunc(func() { r.processReadBatch(reqs) })
 	case <-time.After(HEARTBEAT_INTERVAL):
+	case <-r.shutdownCh:
 	}
 
 	return nil
 }
 
+// tick proposes the commands t returns and waits for them to be applied.
+func (r *Raft) tick(t Ticker, leaderSince time.Time) {
+	cmds := t.Tick(time.Now(), leaderSince)
+	if len(cmds) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), EXECUTE_TIMEOUT)
+	defer cancel()
+	futures := make([]*ApplyFuture, len(cmds))
+	for i, cmd := range cmds {
+		futures[i] = r.submit(ctx, ClientRequest{Command: cmd})
+	}
+	for _, f := range futures {
+		if _, err := f.wait(ctx); err != nil {
+			r.logEvent(slog.LevelWarn, "Failed to propose state machine tick", "err", err)
+		}
+	}
+}
+
 func (r *Raft) processReadBatch(reqs []ClientRequest) {
 	votes := 1 // Leader votes for itself
 	voteCh := make(chan bool, len(r.peerIPPort))
+	start := time.Now()
 	timeout := time.After(500 * time.Millisecond)
 
 	if int32(votes) > r.clusterSize/2 {
@@ -97,20 +161,23 @@ func (r *Raft) processReadBatch(reqs []ClientRequest) {
 
 	for peerID := range r.peerIPPort {
 		if peerID != r.me {
-			go func(target int) {
+			target := peerID
+			r.goFunc(func() {
 				if r.sendRead(target) {
 					voteCh <- true
 				}
-			}(peerID)
+			})
 		}
 	}
 
 	for {
 		select {
 		case <-timeout:
-			for _, req := range reqs {
-				req.RespCh <- Response{success: false}
-			}
+			r.recordBatchSpan(reqs, "raft.read_quorum", start, time.Now(), ErrReadQuorum)
+			respondError(reqs, ErrReadQuorum)
+			return
+		case <-r.shutdownCh:
+			respondError(reqs, ErrShutdown)
 			return
 		case <-voteCh:
 			votes++
@@ -121,9 +188,13 @@ func (r *Raft) processReadBatch(reqs []ClientRequest) {
 	}
 
 QuorumReached:
+	r.metrics.observeReadQuorum(time.Since(start))
+	r.recordBatchSpan(reqs, "raft.read_quorum", start, time.Now(), nil)
 	for _, req := range reqs {
-		result := r.sm.Query(req.Command)
-		req.RespCh <- Response{success: true, value: result}
+		queryStart := time.Now()
+		result, err := r.sm.Query(req.Command)
+		r.recordSpan(req.future, "raft.query", queryStart, time.Now(), err)
+		req.future.respond(Response{value: result, err: err})
 	}
 }
 
@@ -132,22 +203,28 @@ func (r *Raft) runApplier() {
 	defer r.mu.Unlock()
 
 	for {
-		for r.lastApplied >= r.commitIndex {
+		for r.lastApplied >= r.commitIndex && !r.shutdown {
 			r.commitCond.Wait()
 		}
+		if r.shutdown {
+			return
+		}
 
-		startIdx := r.lastApplied + 1
+		startIdx := max(r.lastApplied+1, 1) // index 0 is the dummy entry
 		endIdx := r.commitIndex
 		entries := make([]LogEntry, endIdx-startIdx+1)
 		copy(entries, r.log[startIdx:endIdx+1])
 
 		r.mu.Unlock()
 
-		for i, entry := range entries {
-			idx := startIdx + i
-			r.applyCommand(entry.Command, idx)
-			logMsg := fmt.Sprintf("Applied log entry %d to state machine: %s", idx, string(entry.Command))
-			r.logPut(logMsg, ORANGE)
+		if ba, ok := r.sm.(BatchApplier); ok && len(entries) > 0 {
+			r.applyBatch(ba, entries, startIdx)
+		} else {
+			for i, entry := range entries {
+				idx := startIdx + i
+				r.applyCommand(entry, idx)
+				r.logEvent(slog.LevelDebug, "Applied log entry", "index", idx)
+			}
 		}
 
 		r.mu.Lock()
@@ -159,7 +236,8 @@ func (r *Raft) updateCommitIndex() {
 	if r.state != LEADER {
 		return
 	}
-	for i := r.commitIndex + 1; i < len(r.log); i++ {
+	defer r.endCommitLocked(r.commitIndex)
+	for i := r.commitIndex + 1; i <= r.durableIndex; i++ {
 		var cnt int32 = 1 //count self
 		for peerID, matchIdx := range r.matchIndex {
 			if peerID != r.me && matchIdx >= i && r.log[i].Term == r.currentTerm {
@@ -173,12 +251,48 @@ func (r *Raft) updateCommitIndex() {
 	}
 }
 
+// becomeFollowerLocked moves to a newer term as a follower. A leader that
+// steps down fails its outstanding writes with ErrLeadershipLost, since it can
+// no longer tell whether they will be committed.
+func (r *Raft) becomeFollowerLocked(term int) {
+	if r.state == LEADER {
+		r.failPendingLocked(ErrLeadershipLost)
+	}
+	r.setTermLocked(term)
+	r.votedFor = NOTVOTED
+	r.setStateLocked(FOLLOWER)
+	if r.leaderID == r.me {
+		r.setLeaderLocked(-1)
+	}
+}
+
+// stepDownLocked makes a leader a follower in its current term. Its vote in
+// the term stands, so it can only lead again after winning a later one.
+func (r *Raft) stepDownLocked() {
+	r.failPendingLocked(ErrLeadershipLost)
+	r.setStateLocked(FOLLOWER)
+	r.setLeaderLocked(-1)
+}
+
+// startElection runs one election round. It holds r.mu while it changes
+// state, but not across the vote RPCs or the wait for their replies, so the
+// node keeps answering RPCs meanwhile; a reply or request with a higher term
+// can make it a follower before it counts the votes.
 func (r *Raft) startElection() {
-	r.state = CANDIDATE
-	r.currentTerm++
+	r.mu.Lock()
+	r.setTermLocked(r.currentTerm + 1)
+	r.setStateLocked(CANDIDATE)
+	r.setLeaderLocked(-1)
 	r.votedFor = r.me
-	r.persistState()
+	if err := r.persistState(); err != nil {
+		r.logger.Error("Failed to persist state, abandoning election", "term", r.currentTerm, "err", err)
+		r.setStateLocked(FOLLOWER)
+		r.mu.Unlock()
+		return
+	}
 	termBeforeRPC := r.currentTerm
+	r.mu.Unlock()
+	r.metrics.electionStarted()
 	var cnt int32 = 1 //vote for self already
 	ids := make([]int, 0, len(r.peerIPPort))
 	for peerID := range r.peerIPPort {
@@ -187,27 +301,33 @@ func (r *Raft) startElection() {
 		}
 	}
 	for _, id := range ids {
-		go func(target int) {
-			msg := fmt.Sprintf("Requesting vote from node %d", target)
-			r.logPut(msg, MAGENTA)
+		target := id
+		r.goFunc(func() {
+			r.logEvent(slog.LevelDebug, "Requesting vote", "peer", target)
 			if gotVoted := r.sendRequestVote(target); gotVoted {
-				msg := fmt.Sprintf("Received vote from node %d", target)
-				r.logPut(msg, CYAN)
+				r.logEvent(slog.LevelDebug, "Received vote", "peer", target)
 				atomic.AddInt32(&cnt, 1)
 			}
-		}(id)
+		})
 	}
 	time.Sleep(COMMUNICATION_LATENCY)
-	if atomic.LoadInt32(&cnt) > r.clusterSize/2 && r.state == CANDIDATE && termBeforeRPC == r.currentTerm {
-		msg := fmt.Sprintf("Won election  with %d votes, becoming leader", cnt)
-		r.logPut(msg, GREEN)
-		r.state = LEADER
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	votes := atomic.LoadInt32(&cnt)
+	if r.state != CANDIDATE || r.currentTerm != termBeforeRPC {
+		r.logEventLocked(slog.LevelInfo, "Election superseded", "votes", votes, "term", termBeforeRPC)
+		return
+	}
+	if votes > r.clusterSize/2 {
+		r.setStateLocked(LEADER)
+		r.setLeaderLocked(r.me)
+		r.leaderSince = time.Now()
+		r.metrics.electionWon()
+		r.logEventLocked(slog.LevelInfo, "Won election, becoming leader", "votes", votes)
 		// Here you would add code to start sending heartbeats to other nodes
 	} else {
-		msg := fmt.Sprintf("Lost election with only %d votes, reverting to follower", cnt)
-		r.logPut(msg, RED)
-		msg = fmt.Sprintf("Current connection is %d", r.rpcConns)
-		r.logPut(msg, BLUE)
-		r.state = FOLLOWER
+		r.logEventLocked(slog.LevelInfo, "Lost election, reverting to follower", "votes", votes)
+		r.setStateLocked(FOLLOWER)
 	}
 }
@@ -0,0 +1,75 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+// unreachablePeers points r's peers at a closed port, so their RPCs fail
+// at once.
+func unreachablePeers(r *Raft) {
+	r.peerIPPort = map[int]string{1: "127.0.0.1:1", 2: "127.0.0.1:1", 3: "127.0.0.1:1"}
+}
+
+func TestStartElectionWithoutQuorum(t *testing.T) {
+	r := newTestNode(t, NewKVStore())
+	unreachablePeers(r)
+	r.currentTerm = 4
+
+	done := make(chan struct{})
+	go func() {
+		r.startElection()
+		close(done)
+	}()
+	// The node's state stays readable while the votes are out.
+	for {
+		r.mu.RLock()
+		state, term := r.state, r.currentTerm
+		r.mu.RUnlock()
+		if state == CANDIDATE && term == 5 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+	r.wg.Wait()
+
+	if r.state != FOLLOWER || r.currentTerm != 5 || r.votedFor != r.me || r.leaderID != -1 {
+		t.Fatalf("after a lost election: state %v, term %d, votedFor %d, leader %d",
+			r.state, r.currentTerm, r.votedFor, r.leaderID)
+	}
+	term, votedFor, err := r.storage.LoadState()
+	if err != nil || term != 5 || votedFor != r.me {
+		t.Fatalf("persisted term %d, vote %d, %v; want term 5 and its own vote", term, votedFor, err)
+	}
+}
+
+func TestStartElectionSupersededByHigherTerm(t *testing.T) {
+	r := newTestNode(t, NewKVStore())
+	unreachablePeers(r)
+
+	done := make(chan struct{})
+	go func() {
+		r.startElection()
+		close(done)
+	}()
+	// A message of a later term arrives while the votes are out.
+	for {
+		r.mu.Lock()
+		if r.state == CANDIDATE {
+			r.setTermLocked(r.currentTerm + 1)
+			r.setStateLocked(FOLLOWER)
+			r.setLeaderLocked(2)
+			r.mu.Unlock()
+			break
+		}
+		r.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+	r.wg.Wait()
+
+	if r.state != FOLLOWER || r.currentTerm != 2 || r.leaderID != 2 {
+		t.Fatalf("state %v, term %d, leader %d; the later term's should stand", r.state, r.currentTerm, r.leaderID)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -204,7 +205,7 @@ func runClient(targetID int, configPath string) {
 		return
 	}
 
-	address := fmt.Sprintf("%s:%d", targetNode.IP, targetNode.Port)
+	address := net.JoinHostPort(targetNode.IP, strconv.Itoa(targetNode.Port))
 	fmt.Printf("Connecting to Node %d at %s...\n", targetID, address)
 
 	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
@@ -0,0 +1,79 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrShutdown is returned for requests made to a node that is shutting down.
+	ErrShutdown = errors.New("raft: node is shut down")
+	// ErrInvalidConfig is returned when the cluster configuration cannot be
+	// read or does not describe this node.
+	ErrInvalidConfig = errors.New("raft: invalid configuration")
+	// ErrStorageCorrupt is returned when persisted state or log entries
+	// cannot be decoded.
+	ErrStorageCorrupt = errors.New("raft: storage is corrupt")
+	// ErrAddressInUse is returned when the node's RPC or HTTP address is
+	// already bound.
+	ErrAddressInUse = errors.New("raft: address already in use")
+	// ErrNotLeader matches the *NotLeaderError returned by requests made to a
+	// node that is not the leader.
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrReadQuorum is returned when the leader could not confirm with a
+	// quorum that it is still the leader before serving a read.
+	ErrReadQuorum = errors.New("raft: could not reach a quorum for read")
+	// ErrLeadershipLost is returned for a write whose leader stepped down
+	// before it was applied. The command may or may not still be committed.
+	ErrLeadershipLost = errors.New("raft: leadership lost before the command was applied")
+	// ErrEntryOverwritten is returned for a write whose log entry was
+	// replaced by a different leader's entry; the command was not committed.
+	ErrEntryOverwritten = errors.New("raft: log entry was overwritten by another leader")
+	// ErrStaleSequence is returned for a session write whose sequence number
+	// is older than the last one applied for that client.
+	ErrStaleSequence = errors.New("raft: sequence number is older than the session's last applied request")
+	// ErrInvalidCommand is returned for a command the state machine cannot
+	// decode.
+	ErrInvalidCommand = errors.New("raft: invalid command")
+	// ErrNotInteger is returned by KVStore for an INCR of a value that is
+	// not a 64-bit decimal integer, or that would overflow.
+	ErrNotInteger = errors.New("raft: value is not an integer or out of range")
+	// ErrLeaseNotFound is returned by KVStore for a keep-alive of, or a put
+	// attaching a key to, a lease that does not exist or has expired.
+	ErrLeaseNotFound = errors.New("raft: lease not found")
+	// ErrCompacted is returned by KVStore for a read at a revision whose
+	// versions have been compacted.
+	ErrCompacted = errors.New("raft: revision has been compacted")
+	// ErrFutureRevision is returned by KVStore for a read at, or a
+	// compaction to, a revision the store has not reached.
+	ErrFutureRevision = errors.New("raft: revision is newer than the store's")
+	// ErrWatchCompacted is returned by KVStore.Watch for a start index whose
+	// changes are no longer retained.
+	ErrWatchCompacted = errors.New("raft: watch start index is older than the retained history")
+	// ErrWatchLagged ends a watch whose receiver fell too far behind.
+	ErrWatchLagged = errors.New("raft: watcher fell too far behind")
+	// ErrUnknownMember is returned for an admin operation naming a node that
+	// is not a member of the cluster.
+	ErrUnknownMember = errors.New("raft: no such member")
+	// ErrTransferFailed is returned when a leadership transfer could not be
+	// started or did not complete in time; the node is then still the leader.
+	ErrTransferFailed = errors.New("raft: leadership transfer failed")
+)
+
+// NotLeaderError is returned by Propose and Query on a node that is not the
+// leader. LeaderID is -1 and LeaderAddr empty when no leader is known.
+type NotLeaderError struct {
+	LeaderID   int
+	LeaderAddr string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderID == -1 {
+		return "raft: not the leader (leader unknown)"
+	}
+	return fmt.Sprintf("raft: not the leader (leader is node %d at %s)", e.LeaderID, e.LeaderAddr)
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
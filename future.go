@@ -0,0 +1,110 @@
+package raft
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ApplyFuture is the pending outcome of a command submitted with Apply. It
+// resolves exactly once: with the state machine's result and the index and
+// term the command was committed at, or with an error such as
+// ErrLeadershipLost or ErrEntryOverwritten.
+type ApplyFuture struct {
+	done   chan struct{}
+	once   sync.Once
+	resp   Response
+	respCh chan Response // ClientRequest.RespCh of requests queued on ReqCh directly
+	term   int           // term the command was proposed in, once appended
+
+	// The trace of the request, if it is traced (see tracing.go).
+	traceCtx   context.Context
+	queueSpan  trace.Span
+	commitSpan trace.Span
+}
+
+func newApplyFuture(respCh chan Response) *ApplyFuture {
+	return &ApplyFuture{done: make(chan struct{}), respCh: respCh}
+}
+
+// Done is closed once the future has resolved.
+func (f *ApplyFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Error blocks until the future resolves and returns nil if the command was
+// applied.
+func (f *ApplyFuture) Error() error {
+	<-f.done
+	return f.resp.err
+}
+
+// Result blocks until the future resolves and returns the state machine's
+// result, or nil if the command failed.
+func (f *ApplyFuture) Result() []byte {
+	<-f.done
+	return f.resp.value
+}
+
+// Index blocks until the future resolves and returns the log index the
+// command was committed at, or 0 if it was not.
+func (f *ApplyFuture) Index() uint64 {
+	<-f.done
+	return uint64(f.resp.index)
+}
+
+// Term blocks until the future resolves and returns the term the command was
+// committed in, or 0 if it was not.
+func (f *ApplyFuture) Term() uint64 {
+	<-f.done
+	return uint64(f.resp.term)
+}
+
+// wait blocks until the future resolves or ctx ends.
+func (f *ApplyFuture) wait(ctx context.Context) (Response, error) {
+	select {
+	case <-f.done:
+		return f.resp, f.resp.err
+	case <-ctx.Done():
+		return Response{}, ctx.Err()
+	}
+}
+
+func (f *ApplyFuture) respond(resp Response) {
+	f.once.Do(func() {
+		resp.success = resp.err == nil
+		f.resp = resp
+		f.endTrace(resp.err)
+		close(f.done)
+		if f.respCh != nil {
+			select {
+			case f.respCh <- resp:
+			default:
+			}
+		}
+	})
+}
+
+func (f *ApplyFuture) fail(err error) {
+	f.respond(Response{err: err})
+}
+
+// failPendingLocked resolves every outstanding write with err.
+func (r *Raft) failPendingLocked(err error) {
+	for index, f := range r.pendingResponses {
+		delete(r.pendingResponses, index)
+		f.fail(err)
+	}
+}
+
+// failPendingFromLocked resolves the outstanding writes at index and above
+// with err, after those log entries were removed.
+func (r *Raft) failPendingFromLocked(index int, err error) {
+	for i, f := range r.pendingResponses {
+		if i >= index {
+			delete(r.pendingResponses, i)
+			f.fail(err)
+		}
+	}
+}
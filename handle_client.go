@@ -1,14 +1,18 @@
 package raft
 
 import (
+	"context"
 	"fmt"
-	"strings"
+	"log/slog"
 	"time"
 )
 
 type Response struct {
 	success bool
 	value   []byte
+	err     error
+	index   int // log index the command was committed at (writes only)
+	term    int // term of that log entry
 }
 
 const (
@@ -30,14 +34,24 @@ func (r *Raft) handleClientRequest() {
 
 	flushWrites := func() {
 		if len(writeReqs) > 0 {
-			r.appendEntriesToLog(writeReqs)
+			r.metrics.observeBatch("write", len(writeReqs))
+			endQueue(writeReqs)
+			if err := r.appendEntriesToLog(writeReqs); err != nil {
+				r.logEvent(slog.LevelError, "Failed to append to log storage", "entries", len(writeReqs), "err", err)
+			}
 			writeReqs = nil
 		}
 	}
 
 	flushReads := func() {
 		if len(readReqs) > 0 {
-			r.ReadCh <- readReqs
+			r.metrics.observeBatch("read", len(readReqs))
+			endQueue(readReqs)
+			select {
+			case r.ReadCh <- readReqs:
+			case <-r.shutdownCh:
+				failRequests(readReqs)
+			}
 			readReqs = nil
 		}
 	}
@@ -54,7 +68,10 @@ func (r *Raft) handleClientRequest() {
 	for {
 		select {
 		case req := <-r.ReqCh:
-			if strings.HasPrefix(string(req.Command), "GET") {
+			if req.future == nil {
+				req.future = newApplyFuture(req.RespCh)
+			}
+			if req.read {
 				readReqs = append(readReqs, req)
 				if len(readReqs) >= readBatchSize {
 					flushReads()
@@ -69,14 +86,17 @@ func (r *Raft) handleClientRequest() {
 				}
 			} else {
 				writeReqs = append(writeReqs, req)
-				if len(writeReqs) >= writeBatchSize {
+				// With group commit there is no linger: the batch is cut as soon
+				// as the queue runs dry, and batches that pile up behind an fsync
+				// in progress are made durable by the next one.
+				if len(writeReqs) >= writeBatchSize || (r.groupCommit && len(r.ReqCh) == 0) {
 					flushWrites()
 					if writeTimer != nil {
 						stopTimer(writeTimer)
 						writeTimer = nil
 						writeTimerCh = nil
 					}
-				} else if writeTimer == nil {
+				} else if writeTimer == nil && !r.groupCommit {
 					writeTimer = time.NewTimer(WRITE_LINGER_TIME)
 					writeTimerCh = writeTimer.C
 				}
@@ -89,11 +109,111 @@ func (r *Raft) handleClientRequest() {
 			flushReads()
 			readTimer = nil
 			readTimerCh = nil
+		case <-r.shutdownCh:
+			failRequests(writeReqs)
+			failRequests(readReqs)
+			for {
+				select {
+				case req := <-r.ReqCh:
+					if req.future == nil {
+						req.future = newApplyFuture(req.RespCh)
+					}
+					failRequests([]ClientRequest{req})
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
-func (r *Raft) appendToLog(command []byte) int {
+func failRequests(reqs []ClientRequest) {
+	respondError(reqs, ErrShutdown)
+}
+
+func respondError(reqs []ClientRequest, err error) {
+	for _, req := range reqs {
+		req.future.fail(err)
+	}
+}
+
+// Apply submits cmd to be replicated through the log and returns a future
+// for its outcome. On a follower the future fails with a *NotLeaderError; if
+// ctx ends before the command is queued it fails with ctx.Err().
+func (r *Raft) Apply(ctx context.Context, cmd []byte) *ApplyFuture {
+	return r.submit(ctx, ClientRequest{Command: cmd})
+}
+
+// Propose replicates cmd through the log and returns the state machine's
+// result together with the log index it was committed at. It fails with a
+// *NotLeaderError on followers, and with ctx.Err() if ctx ends first, in
+// which case the command may still be committed later.
+func (r *Raft) Propose(ctx context.Context, cmd []byte) ([]byte, uint64, error) {
+	return r.ProposeSession(ctx, 0, 0, cmd)
+}
+
+// ProposeSession is Propose for a command that belongs to a client session.
+// Sequence numbers must increase with every new command of the session; a
+// retry of the same clientID and seq that was already applied returns the
+// cached result instead of applying the command again.
+func (r *Raft) ProposeSession(ctx context.Context, clientID, seq uint64, cmd []byte) ([]byte, uint64, error) {
+	req := ClientRequest{Command: cmd, session: clientID, seq: seq}
+	resp, err := r.submit(ctx, req).wait(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.value, uint64(resp.index), nil
+}
+
+// Query serves cmd from the state machine after the leader has confirmed its
+// leadership with a quorum, without writing to the log. It fails with a
+// *NotLeaderError on followers and with ctx.Err() if ctx ends first.
+func (r *Raft) Query(ctx context.Context, cmd []byte) ([]byte, error) {
+	resp, err := r.submit(ctx, ClientRequest{Command: cmd, read: true}).wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return resp.value, nil
+}
+
+func (r *Raft) submit(ctx context.Context, req ClientRequest) *ApplyFuture {
+	f := newApplyFuture(nil)
+	req.future = f
+
+	r.mu.RLock()
+	isLeader := r.state == LEADER && !r.transferring
+	leaderID := r.leaderID
+	shutdown := r.shutdown
+	r.mu.RUnlock()
+
+	if shutdown {
+		f.fail(ErrShutdown)
+		return f
+	}
+	if !isLeader {
+		f.fail(r.notLeaderError(leaderID))
+		return f
+	}
+	r.startTrace(ctx, f, req.read)
+
+	select {
+	case r.ReqCh <- req:
+	case <-ctx.Done():
+		f.fail(ctx.Err())
+	case <-r.shutdownCh:
+		f.fail(ErrShutdown)
+	}
+	return f
+}
+
+func (r *Raft) notLeaderError(leaderID int) *NotLeaderError {
+	if leaderID == -1 || leaderID == r.me {
+		return &NotLeaderError{LeaderID: -1}
+	}
+	return &NotLeaderError{LeaderID: leaderID, LeaderAddr: r.peerIPPort[leaderID]}
+}
+
+func (r *Raft) appendToLog(command []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	log := LogEntry{
@@ -103,35 +223,150 @@ func (r *Raft) appendToLog(command []byte) int {
 	r.log = append(r.log, log)
 	index := len(r.log) - 1
 	if err := r.storage.AppendEntry(log); err != nil {
-		fmt.Printf("Error appending to log storage: %v\n", err)
+		r.rollbackLogLocked(index)
+		return -1, err
 	}
-	return index
+	r.durableIndex = index
+	return index, nil
 }
 
-func (r *Raft) appendEntriesToLog(reqs []ClientRequest) {
+// appendEntriesToLog appends a batch of client writes to the leader's log.
+// If storage rejects the batch it is removed again, every request in it is
+// failed with the error, and the error is returned.
+func (r *Raft) appendEntriesToLog(reqs []ClientRequest) error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 
 	var logs []LogEntry
 	startLogIndex := len(r.log)
+	now := time.Now().UnixMilli()
 
 	for _, req := range reqs {
 		entry := LogEntry{
-			Command: req.Command,
-			Term:    r.currentTerm,
+			Command:   req.Command,
+			Term:      r.currentTerm,
+			ClientID:  req.session,
+			Seq:       req.seq,
+			Timestamp: now,
 		}
 		logs = append(logs, entry)
 		r.log = append(r.log, entry)
 	}
+	lastLogIndex := len(r.log) - 1
+	term := r.currentTerm
+	start := time.Now()
+
+	if !r.groupCommit {
+		err := r.storage.AppendEntries(logs)
+		r.recordBatchSpan(reqs, "raft.storage.append", start, time.Now(), err)
+		if err != nil {
+			r.abandonBatchLocked(startLogIndex)
+			r.mu.Unlock()
+			respondError(reqs, err)
+			return err
+		}
+		r.durableIndex = lastLogIndex
+		r.registerPendingLocked(reqs, startLogIndex)
+		r.mu.Unlock()
+		r.signalNewLogEntry()
+		return nil
+	}
+
+	// Group commit: only the write happens under the lock. Followers can be
+	// sent the entries right away while the fsync runs in the background,
+	// and the leader counts itself towards the quorum once it completes.
+	seq, err := r.storage.WriteEntries(logs)
+	if err != nil {
+		r.recordBatchSpan(reqs, "raft.storage.append", start, time.Now(), err)
+		r.abandonBatchLocked(startLogIndex)
+		r.mu.Unlock()
+		respondError(reqs, err)
+		return err
+	}
+	r.registerPendingLocked(reqs, startLogIndex)
+	r.mu.Unlock()
+	r.signalNewLogEntry()
+
+	r.goFunc(func() {
+		err := r.storage.Sync(seq)
+		r.recordBatchSpan(reqs, "raft.storage.append", start, time.Now(), err)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err != nil {
+			r.syncFailedLocked(lastLogIndex, term, err)
+			return
+		}
+		r.markDurableLocked(lastLogIndex, term)
+	})
+	return nil
+}
+
+// abandonBatchLocked removes a batch of client writes starting at index that
+// storage failed to write. If it cannot be removed, the leader steps down
+// rather than append after entries it may have lost: the batch's outcome is
+// then up to the next leader.
+func (r *Raft) abandonBatchLocked(index int) {
+	if err := r.rollbackLogLocked(index); err != nil && r.state == LEADER {
+		r.stepDownLocked()
+	}
+}
+
+// syncFailedLocked handles a failed fsync of the log up to index, whose entry
+// there was appended in term. The OS may have dropped the written pages, so
+// no entry after durableIndex can be trusted, even if a later fsync succeeds:
+// they are removed from the log, their writes fail with err and a leader
+// steps down, so that it neither counts itself towards their quorum nor
+// appends other entries in their place in this term. Followers may already
+// hold the removed entries and still commit them.
+func (r *Raft) syncFailedLocked(index, term int, err error) {
+	r.logEventLocked(slog.LevelError, "Failed to sync log storage", "last_index", index, "err", err)
+	if index <= r.durableIndex || index >= len(r.log) || r.log[index].Term != term {
+		return // made durable by a later write, or no longer in the log
+	}
+	from := r.durableIndex + 1
+	r.failPendingFromLocked(from, err)
+	r.rollbackLogLocked(from)
+	if r.state == LEADER {
+		r.stepDownLocked()
+	}
+}
 
-	if err := r.storage.AppendEntries(logs); err != nil {
-		fmt.Printf("Error appending to log storage: %v\n", err)
+// markDurableLocked records that the log up to index, whose entry there was
+// appended in term, is on stable storage. Nothing is recorded if that entry
+// has been truncated meanwhile: entries appended in its place may not be
+// synced yet. An index and term identify an entry, so if it is still there
+// so are all the entries before it.
+func (r *Raft) markDurableLocked(index, term int) {
+	if index >= len(r.log) || r.log[index].Term != term {
+		return
 	}
+	r.durableIndex = max(r.durableIndex, index)
+	r.updateCommitIndex()
+}
 
+func (r *Raft) registerPendingLocked(reqs []ClientRequest, startLogIndex int) {
 	for i, req := range reqs {
-		r.pendingResponses[startLogIndex+i] = req.RespCh
+		req.future.term = r.currentTerm
+		r.pendingResponses[startLogIndex+i] = req.future
+		r.startCommitLocked(req.future, startLogIndex+i)
 	}
+}
+
+// rollbackLogLocked drops the log entries from index on after storage failed
+// to write them. Storage is truncated first: if that fails too, r.log is left
+// as it is, so that it still matches the file and later appends land at the
+// right offsets, and the error is returned. The entries are not counted as
+// durable either way.
+func (r *Raft) rollbackLogLocked(index int) error {
+	r.durableIndex = min(r.durableIndex, index-1)
+	if err := r.storage.TruncateLog(index - 1); err != nil {
+		r.logEventLocked(slog.LevelError, "Failed to roll back the log", "index", index, "err", err)
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	r.log = r.log[:index]
+	return nil
+}
 
+func (r *Raft) signalNewLogEntry() {
 	select {
 	case r.newLogEntryCh <- true:
 	default:
@@ -0,0 +1,153 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// leaderWithBatch returns a leader in term 2 whose log holds a synced entry
+// and a batch at indices 2-3 that followers 2 and 3 have replicated but that
+// is not yet durable on the leader.
+func leaderWithBatch(t *testing.T) *Raft {
+	r := newTestNode(t, nil,
+		LogEntry{Term: 1, Command: []byte("a")},
+		LogEntry{Term: 2, Command: []byte("b")},
+		LogEntry{Term: 2, Command: []byte("c")},
+	)
+	r.state, r.currentTerm, r.leaderID = LEADER, 2, 1
+	r.durableIndex = 1
+	r.matchIndex[2], r.matchIndex[3] = 3, 3
+	return r
+}
+
+func TestMarkDurableCommitsBatch(t *testing.T) {
+	r := leaderWithBatch(t)
+	r.updateCommitIndex()
+	if r.commitIndex != -1 {
+		t.Fatalf("commitIndex = %d before the batch is synced, want -1", r.commitIndex)
+	}
+	r.markDurableLocked(3, 2)
+	if r.durableIndex != 3 || r.commitIndex != 3 {
+		t.Fatalf("durableIndex %d, commitIndex %d; want 3, 3", r.durableIndex, r.commitIndex)
+	}
+	// A slower sync of an earlier batch does not move it back.
+	r.markDurableLocked(2, 2)
+	if r.durableIndex != 3 {
+		t.Fatalf("durableIndex = %d, want 3", r.durableIndex)
+	}
+}
+
+func TestMarkDurableIgnoresReplacedBatch(t *testing.T) {
+	r := leaderWithBatch(t)
+	// The batch is truncated and entries of a later term take its place
+	// before its fsync returns.
+	r.log = append(r.log[:2], LogEntry{Term: 4, Command: []byte("x")}, LogEntry{Term: 4, Command: []byte("y")})
+	r.currentTerm = 4
+	r.markDurableLocked(3, 2)
+	if r.durableIndex != 1 || r.commitIndex != -1 {
+		t.Fatalf("durableIndex %d, commitIndex %d after a stale sync; want 1, -1", r.durableIndex, r.commitIndex)
+	}
+
+	// The same if the log was only truncated.
+	r = leaderWithBatch(t)
+	r.log = r.log[:2]
+	r.markDurableLocked(3, 2)
+	if r.durableIndex != 1 {
+		t.Fatalf("durableIndex = %d after the batch was truncated, want 1", r.durableIndex)
+	}
+}
+
+func TestSyncFailureRollsBackAndStepsDown(t *testing.T) {
+	r := leaderWithBatch(t)
+	futures := []*ApplyFuture{newApplyFuture(nil), newApplyFuture(nil)}
+	r.pendingResponses[2], r.pendingResponses[3] = futures[0], futures[1]
+	syncErr := errors.New("fsync: input/output error")
+
+	r.syncFailedLocked(3, 2, syncErr)
+	if len(r.log) != 2 || r.durableIndex != 1 {
+		t.Fatalf("log has %d entries, durableIndex %d; want the batch removed", len(r.log)-1, r.durableIndex)
+	}
+	if r.state != FOLLOWER || r.leaderID != -1 || r.currentTerm != 2 {
+		t.Fatalf("state %s, leader %d, term %d; want a follower in term 2 without a leader", stateName(r.state), r.leaderID, r.currentTerm)
+	}
+	for i, f := range futures {
+		if err := f.Error(); err != syncErr {
+			t.Fatalf("write %d failed with %v, want %v", i, err, syncErr)
+		}
+	}
+
+	// A later fsync of a batch that was written before the failure does
+	// not count the removed entries as durable.
+	r.markDurableLocked(3, 2)
+	if r.durableIndex != 1 {
+		t.Fatalf("durableIndex = %d, want 1", r.durableIndex)
+	}
+}
+
+func TestRequestsAreRoutedOnTheReadFlagOnly(t *testing.T) {
+	r := newTestNode(t, NewKVStore())
+	r.state, r.currentTerm, r.leaderID = LEADER, 1, 1
+	r.ReqCh = make(chan ClientRequest, 1)
+	r.ReadCh = make(chan []ClientRequest, 1)
+	r.newLogEntryCh = make(chan bool, 1)
+	r.writeBatchSize, r.readBatchSize = 1, 1
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleClientRequest()
+	}()
+	defer func() {
+		close(r.shutdownCh)
+		<-done
+	}()
+
+	// A command that looks like a read but is not flagged as one goes to
+	// the log, and a flagged one to the read path whatever it contains.
+	r.ReqCh <- ClientRequest{Command: []byte("GET k")}
+	select {
+	case <-r.newLogEntryCh:
+	case reqs := <-r.ReadCh:
+		t.Fatalf("unflagged %q was sent to the read path", reqs[0].Command)
+	case <-time.After(5 * time.Second):
+		t.Fatal("unflagged GET was not appended")
+	}
+	r.mu.RLock()
+	n, cmd := len(r.log), string(r.log[len(r.log)-1].Command)
+	r.mu.RUnlock()
+	if n != 2 || cmd != "GET k" {
+		t.Fatalf("log holds %d entries, the last %q; want the unflagged GET appended", n-1, cmd)
+	}
+
+	r.ReqCh <- ClientRequest{Command: SetCommand([]byte("k"), []byte("v")), read: true}
+	reqs := <-r.ReadCh
+	if len(reqs) != 1 || !reqs[0].read {
+		t.Fatalf("read path got %+v, want the flagged request", reqs)
+	}
+}
+
+func TestRollbackLogKeepsMemoryInStepWithStorage(t *testing.T) {
+	entries := []LogEntry{{Term: 1, Command: []byte("a")}, {Term: 1, Command: []byte("b")}, {Term: 1, Command: []byte("c")}}
+	r := newTestNode(t, nil, entries...)
+	if err := r.storage.AppendEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.rollbackLogLocked(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.log) != 3 || r.durableIndex != 2 || len(r.storage.logOffsets) != 2 {
+		t.Fatalf("after a rollback to 3: log %d, durableIndex %d, stored %d; want 3, 2, 2",
+			len(r.log), r.durableIndex, len(r.storage.logOffsets))
+	}
+
+	// With storage unable to truncate, the log keeps the entries it still
+	// holds on disk, but they no longer count as durable.
+	r.storage.logFile.Close()
+	if err := r.rollbackLogLocked(2); err == nil {
+		t.Fatal("rollback succeeded although storage could not truncate")
+	}
+	if len(r.log) != 3 || r.durableIndex != 1 {
+		t.Fatalf("after a failed rollback: log %d, durableIndex %d; want 3, 1", len(r.log), r.durableIndex)
+	}
+}
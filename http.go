@@ -0,0 +1,460 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MAX_HTTP_BODY bounds the size of an HTTP request body.
+const MAX_HTTP_BODY = 1 << 20
+
+// httpExecuteRequest is the body of POST /execute.
+type httpExecuteRequest struct {
+	Command  string `json:"command"`
+	Read     bool   `json:"read"`                // serve through the quorum-read path
+	ClientID uint64 `json:"client_id,omitempty"` // client session, see ProposeSession
+	Seq      uint64 `json:"seq,omitempty"`
+}
+
+// httpLeaseRequest is the body of POST /leases.
+type httpLeaseRequest struct {
+	ID    uint64 `json:"id,omitempty"` // 0: let the store pick one
+	TTLMs int64  `json:"ttl_ms"`
+}
+
+// httpKV is a key read by a range.
+type httpKV struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Revision uint64 `json:"revision"`
+	Lease    uint64 `json:"lease,omitempty"`
+}
+
+// httpWatchEvent is a line of a GET /watch stream.
+type httpWatchEvent struct {
+	Type     string `json:"type,omitempty"` // "put" or "delete"
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+	Lease    uint64 `json:"lease,omitempty"`
+	Index    uint64 `json:"index,omitempty"`
+	Error    string `json:"error,omitempty"` // set on the last line if the watch was cut off
+}
+
+type httpResponse struct {
+	Key      string   `json:"key,omitempty"`
+	Value    string   `json:"value"`
+	Revision uint64   `json:"revision,omitempty"` // the key's revision (KVStore)
+	Index    uint64   `json:"index,omitempty"`    // log index of a write
+	Lease    uint64   `json:"lease,omitempty"`    // lease of the key, or the lease created
+	Kvs      []httpKV `json:"kvs,omitempty"`      // keys read by a range
+	More     bool     `json:"more,omitempty"`     // the range stopped at its limit
+	Next     string   `json:"next,omitempty"`     // start of the rest of the range, if More
+	Count    *uint64  `json:"count,omitempty"`    // keys counted
+	Error    string   `json:"error,omitempty"`
+	LeaderID *int     `json:"leader_id,omitempty"` // set when the node is not the leader
+}
+
+// newHTTPHandler returns the node's HTTP client API:
+//
+//	GET    /kv/{key}  read a key of the built-in KVStore
+//	GET    /kv        read or count a range of keys
+//	PUT    /kv/{key}  set a key to the request body
+//	DELETE /kv/{key}  delete a key
+//	POST   /compact   discard the versions older than ?revision=N
+//	GET    /watch     stream the changes of a key or prefix
+//	POST   /leases    grant a lease, with a JSON body {"ttl_ms": n}
+//	POST   /leases/{id}/keepalive
+//	DELETE /leases/{id}
+//	POST   /execute   submit a command to any state machine
+//	GET    /status    the node's NodeStatus
+//
+// PUT and DELETE take an optional prev_revision query parameter and then only
+// succeed if the key's revision matches (0: the key must not exist), failing
+// with 412 otherwise. PUT takes an optional lease parameter attaching the key
+// to a lease. A follower answers with a 307 redirect to the leader's HTTP
+// address.
+//
+// A key is the rest of the path after /kv/, so it may contain slashes.
+//
+// GET /kv reads the keys from start up to but not including end, or those
+// starting with prefix, up to limit of them; with count=true it only counts
+// them. If more keys are left, the response's next is where to continue.
+//
+// GET requests take an optional revision parameter reading the store as it
+// was then; the range response's revision is the one read at.
+//
+// GET /watch?key=K or ?prefix=P streams one JSON event per line, from log
+// index start_index on if given. Any node serves it, without a redirect, as
+// does GET /status.
+func (r *Raft) newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	if _, ok := r.sm.(*KVStore); ok {
+		mux.HandleFunc("GET /kv/{key...}", r.handleKVGet)
+		mux.HandleFunc("GET /kv", r.handleKVRange)
+		mux.HandleFunc("PUT /kv/{key...}", r.handleKVPut)
+		mux.HandleFunc("DELETE /kv/{key...}", r.handleKVDelete)
+		mux.HandleFunc("POST /compact", r.handleCompact)
+		mux.HandleFunc("GET /watch", r.handleWatch)
+		mux.HandleFunc("POST /leases", r.handleLeaseGrant)
+		mux.HandleFunc("POST /leases/{id}/keepalive", r.handleLeaseCommand(KVLeaseKeepAlive))
+		mux.HandleFunc("DELETE /leases/{id}", r.handleLeaseCommand(KVLeaseRevoke))
+	}
+	mux.HandleFunc("POST /execute", r.handleExecute)
+	mux.HandleFunc("GET /status", r.handleStatus)
+	return mux
+}
+
+func (r *Raft) serveHTTP() {
+	r.logger.Info("Serving HTTP API", "addr", r.httpListener.Addr().String())
+	if err := r.httpServer.Serve(r.httpListener); err != nil && err != http.ErrServerClosed {
+		r.logger.Error("HTTP server stopped", "err", err)
+	}
+}
+
+func (r *Raft) handleKVGet(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+	rev, _, err := uintParam(req, "revision")
+	if err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), EXECUTE_TIMEOUT)
+	defer cancel()
+	value, err := r.Query(ctx, GetAtCommand([]byte(key), rev))
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	res, err := DecodeKVResult(value)
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	if !res.Found {
+		writeHTTPResponse(w, http.StatusNotFound, httpResponse{Key: key, Error: "key not found"})
+		return
+	}
+	writeHTTPResponse(w, http.StatusOK, httpResponse{Key: key, Value: string(res.Value), Revision: res.Revision, Lease: res.Lease})
+}
+
+func (r *Raft) handleKVRange(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	c := KVCommand{Op: KVRange, Key: []byte(q.Get("start")), End: []byte(q.Get("end"))}
+	if q.Has("prefix") {
+		if q.Has("end") {
+			writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: "prefix and end cannot be combined"})
+			return
+		}
+		prefix := []byte(q.Get("prefix"))
+		if len(c.Key) == 0 {
+			c.Key = prefix
+		}
+		c.End = PrefixEnd(prefix)
+	}
+	var err error
+	if c.Limit, _, err = uintParam(req, "limit"); err == nil {
+		c.Revision, _, err = uintParam(req, "revision")
+	}
+	if err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+		return
+	}
+	if q.Get("count") == "true" {
+		c.Op = KVCount
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), EXECUTE_TIMEOUT)
+	defer cancel()
+	value, err := r.Query(ctx, c.Encode())
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	res, err := DecodeKVResult(value)
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	if c.Op == KVCount {
+		writeHTTPResponse(w, http.StatusOK, httpResponse{Count: &res.Count, Revision: res.Revision})
+		return
+	}
+	resp := httpResponse{Kvs: make([]httpKV, len(res.Results)), More: res.More, Next: string(res.Key), Revision: res.Revision}
+	for i, kv := range res.Results {
+		resp.Kvs[i] = httpKV{Key: string(kv.Key), Value: string(kv.Value), Revision: kv.Revision, Lease: kv.Lease}
+	}
+	writeHTTPResponse(w, http.StatusOK, resp)
+}
+
+func (r *Raft) handleCompact(w http.ResponseWriter, req *http.Request) {
+	rev, ok, err := uintParam(req, "revision")
+	if err == nil && !ok {
+		err = errors.New("revision is required")
+	}
+	if err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), EXECUTE_TIMEOUT)
+	defer cancel()
+	value, index, err := r.Propose(ctx, CompactCommand(rev))
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	res, err := DecodeKVResult(value)
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	writeHTTPResponse(w, http.StatusOK, httpResponse{Revision: res.Revision, Index: index})
+}
+
+func (r *Raft) handleWatch(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	key, prefix := q.Get("key"), q.Has("prefix")
+	switch {
+	case prefix && q.Has("key"):
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: "key and prefix cannot be combined"})
+		return
+	case prefix:
+		key = q.Get("prefix")
+	case !q.Has("key"):
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: "key or prefix is required"})
+		return
+	}
+	start, _, err := uintParam(req, "start_index")
+	if err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+		return
+	}
+	watcher, err := r.sm.(*KVStore).Watch(req.Context(), []byte(key), prefix, start)
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	defer watcher.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for ev := range watcher.C {
+		line := httpWatchEvent{
+			Type: ev.Type.String(), Key: string(ev.Key), Value: string(ev.Value),
+			Revision: ev.Revision, Lease: ev.Lease, Index: ev.Index,
+		}
+		if err := enc.Encode(line); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := watcher.Err(); errors.Is(err, ErrWatchLagged) {
+		enc.Encode(httpWatchEvent{Error: err.Error()})
+	}
+}
+
+func (r *Raft) handleKVPut(w http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, MAX_HTTP_BODY))
+	if err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+		return
+	}
+	c := KVCommand{Op: KVSet, Key: []byte(key), Value: body}
+	if c.Lease, _, err = uintParam(req, "lease"); err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+		return
+	}
+	if rev, ok, err := uintParam(req, "prev_revision"); err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+		return
+	} else if ok {
+		c.Op, c.Revision = KVCompareRevisionAndSwap, rev
+	}
+	r.handleKVWrite(w, req, c)
+}
+
+func (r *Raft) handleKVDelete(w http.ResponseWriter, req *http.Request) {
+	c := KVCommand{Op: KVDelete, Key: []byte(req.PathValue("key"))}
+	if rev, ok, err := uintParam(req, "prev_revision"); err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+		return
+	} else if ok {
+		c.Op, c.Revision = KVCompareRevisionAndDelete, rev
+	}
+	r.handleKVWrite(w, req, c)
+}
+
+func (r *Raft) handleKVWrite(w http.ResponseWriter, req *http.Request, c KVCommand) {
+	ctx, cancel := context.WithTimeout(req.Context(), EXECUTE_TIMEOUT)
+	defer cancel()
+	value, index, err := r.Propose(ctx, c.Encode())
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	res, err := DecodeKVResult(value)
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	resp := httpResponse{Key: string(c.Key), Revision: res.Revision, Index: index, Lease: res.Lease}
+	switch {
+	case !res.OK:
+		resp.Value, resp.Error = string(res.Value), "revision does not match"
+		writeHTTPResponse(w, http.StatusPreconditionFailed, resp)
+	case c.Op == KVDelete && !res.Found:
+		resp.Error = "key not found"
+		writeHTTPResponse(w, http.StatusNotFound, resp)
+	default:
+		writeHTTPResponse(w, http.StatusOK, resp)
+	}
+}
+
+func (r *Raft) handleLeaseGrant(w http.ResponseWriter, req *http.Request) {
+	var args httpLeaseRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MAX_HTTP_BODY)).Decode(&args); err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: "invalid request body: " + err.Error()})
+		return
+	}
+	r.handleLease(w, req, KVCommand{Op: KVLeaseGrant, Lease: args.ID, TTL: time.Duration(args.TTLMs) * time.Millisecond})
+}
+
+// handleLeaseCommand returns the handler running op on the lease in the path.
+func (r *Raft) handleLeaseCommand(op KVOp) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+		if err != nil {
+			writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: fmt.Sprintf("invalid lease %q", req.PathValue("id"))})
+			return
+		}
+		r.handleLease(w, req, KVCommand{Op: op, Lease: id})
+	}
+}
+
+func (r *Raft) handleLease(w http.ResponseWriter, req *http.Request, c KVCommand) {
+	ctx, cancel := context.WithTimeout(req.Context(), EXECUTE_TIMEOUT)
+	defer cancel()
+	value, index, err := r.Propose(ctx, c.Encode())
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	res, err := DecodeKVResult(value)
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	resp := httpResponse{Lease: res.Lease, Index: index}
+	switch {
+	case c.Op == KVLeaseGrant && !res.OK:
+		resp.Error = "lease already exists"
+		writeHTTPResponse(w, http.StatusConflict, resp)
+	case c.Op == KVLeaseRevoke && !res.OK:
+		resp.Error = "lease not found"
+		writeHTTPResponse(w, http.StatusNotFound, resp)
+	default:
+		writeHTTPResponse(w, http.StatusOK, resp)
+	}
+}
+
+// uintParam returns the query parameter name, if present.
+func uintParam(req *http.Request, name string) (uint64, bool, error) {
+	s := req.URL.Query().Get(name)
+	if s == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return n, true, nil
+}
+
+func (r *Raft) handleExecute(w http.ResponseWriter, req *http.Request) {
+	var args httpExecuteRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MAX_HTTP_BODY)).Decode(&args); err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, httpResponse{Error: "invalid request body: " + err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), EXECUTE_TIMEOUT)
+	defer cancel()
+	if args.Read {
+		value, err := r.Query(ctx, []byte(args.Command))
+		if err != nil {
+			r.writeHTTPError(w, req, err)
+			return
+		}
+		writeHTTPResponse(w, http.StatusOK, httpResponse{Value: string(value)})
+		return
+	}
+	value, index, err := r.ProposeSession(ctx, args.ClientID, args.Seq, []byte(args.Command))
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	writeHTTPResponse(w, http.StatusOK, httpResponse{Value: string(value), Index: index})
+}
+
+func (r *Raft) handleStatus(w http.ResponseWriter, req *http.Request) {
+	s, err := r.GetStatus()
+	if err != nil {
+		r.writeHTTPError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// writeHTTPError redirects requests made to a follower to the leader and
+// maps other errors to a status code.
+func (r *Raft) writeHTTPError(w http.ResponseWriter, req *http.Request, err error) {
+	var notLeader *NotLeaderError
+	if errors.As(err, &notLeader) {
+		if addr, ok := r.peerHTTP[notLeader.LeaderID]; ok {
+			http.Redirect(w, req, "http://"+addr+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		leaderID := notLeader.LeaderID
+		writeHTTPResponse(w, http.StatusServiceUnavailable, httpResponse{Error: err.Error(), LeaderID: &leaderID})
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrShutdown), errors.Is(err, ErrReadQuorum),
+		errors.Is(err, ErrLeadershipLost), errors.Is(err, ErrEntryOverwritten):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrStaleSequence):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalidCommand), errors.Is(err, ErrNotInteger):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrLeaseNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrWatchCompacted), errors.Is(err, ErrCompacted):
+		status = http.StatusGone
+	case errors.Is(err, ErrFutureRevision):
+		status = http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+	writeHTTPResponse(w, status, httpResponse{Error: err.Error()})
+}
+
+func writeHTTPResponse(w http.ResponseWriter, status int, resp httpResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,233 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// doHTTP serves a request to h and decodes the JSON response.
+func doHTTP(t *testing.T, h http.Handler, method, target, body string) (int, httpResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	var resp httpResponse
+	if rec.Code != http.StatusTemporaryRedirect {
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("%s %s: decoding the response: %v", method, target, err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestHTTPFollowerRedirects(t *testing.T) {
+	r := newTestNode(t, NewKVStore())
+	r.leaderID = 2
+	r.peerHTTP = map[int]string{2: "n2:8080"}
+	h := r.newHTTPHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("PUT", "/kv/a/b?prev_revision=3", strings.NewReader("v")))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusTemporaryRedirect || loc != "http://n2:8080/kv/a/b?prev_revision=3" {
+		t.Fatalf("PUT on a follower = %d to %q, want 307 to the leader's same URL", rec.Code, loc)
+	}
+
+	// Without the leader's HTTP address, or any leader, there is nowhere to
+	// redirect to.
+	r.peerHTTP = nil
+	if code, resp := doHTTP(t, h, "GET", "/kv/a", ""); code != http.StatusServiceUnavailable || resp.LeaderID == nil || *resp.LeaderID != 2 {
+		t.Fatalf("GET with no leader address = %d, %+v; want 503 naming leader 2", code, resp)
+	}
+	r.leaderID = -1
+	if code, resp := doHTTP(t, h, "GET", "/kv", ""); code != http.StatusServiceUnavailable || resp.LeaderID == nil || *resp.LeaderID != -1 {
+		t.Fatalf("GET with no leader = %d, %+v; want 503 with leader -1", code, resp)
+	}
+}
+
+func TestHTTPErrorStatus(t *testing.T) {
+	r := newTestNode(t, NewKVStore())
+	for _, tt := range []struct {
+		err  error
+		want int
+	}{
+		{ErrShutdown, http.StatusServiceUnavailable},
+		{ErrReadQuorum, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: term 3", ErrLeadershipLost), http.StatusServiceUnavailable},
+		{ErrEntryOverwritten, http.StatusServiceUnavailable},
+		{ErrStaleSequence, http.StatusConflict},
+		{ErrInvalidCommand, http.StatusBadRequest},
+		{ErrNotInteger, http.StatusBadRequest},
+		{ErrFutureRevision, http.StatusBadRequest},
+		{ErrLeaseNotFound, http.StatusNotFound},
+		{ErrCompacted, http.StatusGone},
+		{ErrWatchCompacted, http.StatusGone},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		r.writeHTTPError(rec, httptest.NewRequest("GET", "/kv/a", nil), tt.err)
+		var resp httpResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != tt.want || resp.Error != tt.err.Error() {
+			t.Fatalf("%v: status %d, error %q; want %d", tt.err, rec.Code, resp.Error, tt.want)
+		}
+	}
+}
+
+func TestHTTPKV(t *testing.T) {
+	r := newTestLeader(t, NewKVStore(), 0)
+	h := r.newHTTPHandler()
+
+	if code, resp := doHTTP(t, h, "PUT", "/kv/a/b", "1"); code != http.StatusOK || resp.Revision != 1 || resp.Index != 1 {
+		t.Fatalf("PUT = %d, %+v; want revision 1 at index 1", code, resp)
+	}
+	if code, resp := doHTTP(t, h, "GET", "/kv/a/b", ""); code != http.StatusOK || resp.Key != "a/b" || resp.Value != "1" {
+		t.Fatalf("GET = %d, %+v; want a/b = 1", code, resp)
+	}
+	for _, tt := range []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/kv/nope", http.StatusNotFound},
+		{"DELETE", "/kv/nope", http.StatusNotFound},
+		{"GET", "/kv/a/b?revision=x", http.StatusBadRequest},
+		{"GET", "/kv/a/b?revision=9", http.StatusBadRequest}, // ErrFutureRevision
+		{"POST", "/compact", http.StatusBadRequest},
+		{"DELETE", "/leases/7", http.StatusNotFound},
+		{"POST", "/leases/x/keepalive", http.StatusBadRequest},
+	} {
+		if code, _ := doHTTP(t, h, tt.method, tt.target, ""); code != tt.want {
+			t.Fatalf("%s %s = %d, want %d", tt.method, tt.target, code, tt.want)
+		}
+	}
+
+	doHTTP(t, h, "PUT", "/kv/a/b", "2")
+	if code, resp := doHTTP(t, h, "POST", "/compact?revision=2", ""); code != http.StatusOK || resp.Revision != 2 {
+		t.Fatalf("compact = %d, %+v", code, resp)
+	}
+	if code, _ := doHTTP(t, h, "GET", "/kv/a/b?revision=1", ""); code != http.StatusGone {
+		t.Fatalf("GET below the compacted revision = %d, want 410", code)
+	}
+}
+
+func TestHTTPPrevRevision(t *testing.T) {
+	r := newTestLeader(t, NewKVStore(), 0)
+	h := r.newHTTPHandler()
+
+	for _, tt := range []struct {
+		method, target, body string
+		want                 int
+		revision             uint64 // of the response
+		value                string // of the response
+	}{
+		{"PUT", "/kv/k?prev_revision=0", "a", http.StatusOK, 1, ""},
+		{"PUT", "/kv/k?prev_revision=0", "b", http.StatusPreconditionFailed, 1, "a"},
+		{"PUT", "/kv/k?prev_revision=2", "b", http.StatusPreconditionFailed, 1, "a"},
+		{"PUT", "/kv/k?prev_revision=1", "b", http.StatusOK, 2, ""},
+		{"DELETE", "/kv/k?prev_revision=1", "", http.StatusPreconditionFailed, 2, "b"},
+		{"PUT", "/kv/k?prev_revision=-1", "c", http.StatusBadRequest, 0, ""},
+		{"DELETE", "/kv/k?prev_revision=2", "", http.StatusOK, 0, ""},
+	} {
+		code, resp := doHTTP(t, h, tt.method, tt.target, tt.body)
+		if code != tt.want || resp.Revision != tt.revision || resp.Value != tt.value {
+			t.Fatalf("%s %s = %d, revision %d, value %q; want %d, %d, %q",
+				tt.method, tt.target, code, resp.Revision, resp.Value, tt.want, tt.revision, tt.value)
+		}
+	}
+	if code, _ := doHTTP(t, h, "GET", "/kv/k", ""); code != http.StatusNotFound {
+		t.Fatalf("GET after the conditional DELETE = %d, want 404", code)
+	}
+}
+
+func TestHTTPRangeContinues(t *testing.T) {
+	r := newTestLeader(t, NewKVStore(), 0)
+	h := r.newHTTPHandler()
+	for _, k := range []string{"k/a", "k/b", "k/c", "k/d", "k/e", "l"} {
+		doHTTP(t, h, "PUT", "/kv/"+k, "v")
+	}
+
+	var keys []string
+	target := "/kv?prefix=k/&limit=2"
+	for pages := 1; ; pages++ {
+		code, resp := doHTTP(t, h, "GET", target, "")
+		if code != http.StatusOK || resp.Revision != 6 {
+			t.Fatalf("GET %s = %d, %+v", target, code, resp)
+		}
+		for _, kv := range resp.Kvs {
+			keys = append(keys, kv.Key)
+		}
+		if !resp.More {
+			if pages != 3 || resp.Next != "" {
+				t.Fatalf("range ended after %d pages with next %q, want 3 pages", pages, resp.Next)
+			}
+			break
+		}
+		target = "/kv?prefix=k/&limit=2&start=" + resp.Next
+	}
+	if want := []string{"k/a", "k/b", "k/c", "k/d", "k/e"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("range read %q, want %q", keys, want)
+	}
+
+	if code, resp := doHTTP(t, h, "GET", "/kv?start=k/b&end=k/e&count=true", ""); code != http.StatusOK || resp.Count == nil || *resp.Count != 3 {
+		t.Fatalf("count = %d, %+v; want 3", code, resp)
+	}
+	if code, _ := doHTTP(t, h, "GET", "/kv?prefix=k/&end=z", ""); code != http.StatusBadRequest {
+		t.Fatalf("prefix with end = %d, want 400", code)
+	}
+}
+
+func TestHTTPWatch(t *testing.T) {
+	r := newTestLeader(t, NewKVStore(), 0)
+	srv := httptest.NewServer(r.newHTTPHandler())
+	defer srv.Close()
+	h := r.newHTTPHandler()
+	doHTTP(t, h, "PUT", "/kv/k/a", "1")
+
+	if code, _ := doHTTP(t, h, "GET", "/watch?key=k&prefix=k", ""); code != http.StatusBadRequest {
+		t.Fatalf("watch of a key and a prefix = %d, want 400", code)
+	}
+	if code, _ := doHTTP(t, h, "GET", "/watch", ""); code != http.StatusBadRequest {
+		t.Fatalf("watch of nothing = %d, want 400", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/watch?prefix=k/&start_index=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "application/x-ndjson" {
+		t.Fatalf("watch = %d with content type %q", resp.StatusCode, ct)
+	}
+	doHTTP(t, h, "PUT", "/kv/other", "x")
+	doHTTP(t, h, "PUT", "/kv/k/b", "2")
+	doHTTP(t, h, "DELETE", "/kv/k/a", "")
+
+	want := []httpWatchEvent{
+		{Type: "put", Key: "k/a", Value: "1", Revision: 1, Index: 1},
+		{Type: "put", Key: "k/b", Value: "2", Revision: 3, Index: 3},
+		{Type: "delete", Key: "k/a", Revision: 4, Index: 4},
+	}
+	sc := bufio.NewScanner(resp.Body)
+	for i, w := range want {
+		if !sc.Scan() {
+			t.Fatalf("stream ended after %d events: %v", i, sc.Err())
+		}
+		var ev httpWatchEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		if ev != w {
+			t.Fatalf("event %d = %+v, want %+v", i, ev, w)
+		}
+	}
+}
@@ -0,0 +1,733 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// KVOp is the operation of a KVStore command.
+type KVOp uint8
+
+const (
+	KVGet                      KVOp = iota + 1
+	KVSet                           // set Key to Value
+	KVDelete                        // delete Key
+	KVCompareAndSwap                // set Key to Value if its value is Expect
+	KVCompareRevisionAndSwap        // set Key to Value if its revision is Revision (0: absent)
+	KVSetIfAbsent                   // set Key to Value if it does not exist
+	KVCompareAndDelete              // delete Key if its value is Expect
+	KVCompareRevisionAndDelete      // delete Key if its revision is Revision
+	KVIncr                          // add Delta to the decimal integer at Key (absent: 0)
+	KVTransaction                   // run Txn atomically
+	KVLeaseGrant                    // create lease Lease (0: pick an ID) with TTL
+	KVLeaseRevoke                   // delete lease Lease and the keys attached to it
+	KVLeaseKeepAlive                // restart the TTL of lease Lease
+	KVLeaseExpire                   // revoke lease Lease unless renewed since; proposed by the leader
+	KVRange                         // read up to Limit keys in [Key, End)
+	KVCount                         // count the keys in [Key, End)
+	KVCompact                       // discard the versions older than Revision
+)
+
+var kvOpNames = map[KVOp]string{
+	KVGet:                      "GET",
+	KVSet:                      "SET",
+	KVDelete:                   "DELETE",
+	KVCompareAndSwap:           "CAS",
+	KVCompareRevisionAndSwap:   "CAS_REVISION",
+	KVSetIfAbsent:              "SETNX",
+	KVCompareAndDelete:         "CAD",
+	KVCompareRevisionAndDelete: "CAD_REVISION",
+	KVIncr:                     "INCR",
+	KVTransaction:              "TXN",
+	KVLeaseGrant:               "LEASE_GRANT",
+	KVLeaseRevoke:              "LEASE_REVOKE",
+	KVLeaseKeepAlive:           "LEASE_KEEPALIVE",
+	KVLeaseExpire:              "LEASE_EXPIRE",
+	KVRange:                    "RANGE",
+	KVCount:                    "COUNT",
+	KVCompact:                  "COMPACT",
+}
+
+func (op KVOp) String() string {
+	if name, ok := kvOpNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("KVOp(%d)", uint8(op))
+}
+
+type kvField uint8
+
+const (
+	kvFieldKey kvField = iota
+	kvFieldValue
+	kvFieldExpect
+	kvFieldRevision
+	kvFieldDelta
+	kvFieldTxn
+	kvFieldLease
+	kvFieldTTL
+	// kvFieldAttachLease is Lease, optional at the end of a put: it is left
+	// out when 0, so puts encoded before leases existed still decode.
+	kvFieldAttachLease
+	kvFieldEnd
+	kvFieldLimit
+	// kvFieldReadRevision is Revision, optional at the end of a read: it is
+	// left out when 0, reading the current state.
+	kvFieldReadRevision
+)
+
+// fields lists, in encoding order, the fields commands of op carry.
+func (op KVOp) fields() []kvField {
+	switch op {
+	case KVGet:
+		return []kvField{kvFieldKey, kvFieldReadRevision}
+	case KVDelete:
+		return []kvField{kvFieldKey}
+	case KVSet, KVSetIfAbsent:
+		return []kvField{kvFieldKey, kvFieldValue, kvFieldAttachLease}
+	case KVCompareAndSwap:
+		return []kvField{kvFieldKey, kvFieldExpect, kvFieldValue, kvFieldAttachLease}
+	case KVCompareRevisionAndSwap:
+		return []kvField{kvFieldKey, kvFieldRevision, kvFieldValue, kvFieldAttachLease}
+	case KVCompareAndDelete:
+		return []kvField{kvFieldKey, kvFieldExpect}
+	case KVCompareRevisionAndDelete:
+		return []kvField{kvFieldKey, kvFieldRevision}
+	case KVIncr:
+		return []kvField{kvFieldKey, kvFieldDelta}
+	case KVTransaction:
+		return []kvField{kvFieldTxn}
+	case KVLeaseGrant:
+		return []kvField{kvFieldLease, kvFieldTTL}
+	case KVLeaseRevoke, KVLeaseKeepAlive:
+		return []kvField{kvFieldLease}
+	case KVLeaseExpire:
+		return []kvField{kvFieldLease, kvFieldRevision}
+	case KVRange:
+		return []kvField{kvFieldKey, kvFieldEnd, kvFieldLimit, kvFieldReadRevision}
+	case KVCount:
+		return []kvField{kvFieldKey, kvFieldEnd, kvFieldReadRevision}
+	case KVCompact:
+		return []kvField{kvFieldRevision}
+	}
+	return nil
+}
+
+// isRead reports whether op only reads and is served by Query.
+func (op KVOp) isRead() bool {
+	return op == KVGet || op == KVRange || op == KVCount
+}
+
+// isLease reports whether op manages leases rather than keys.
+func (op KVOp) isLease() bool {
+	return op >= KVLeaseGrant && op <= KVLeaseExpire
+}
+
+// kvBinaryMarker starts every binary KVStore command. No text command can
+// start with it, so both encodings can be told apart.
+const kvBinaryMarker = 0x00
+
+// KVCommand is a KVStore command. Keys and values are arbitrary bytes; which
+// of the other fields are used depends on Op.
+type KVCommand struct {
+	Op     KVOp
+	Key    []byte
+	Value  []byte
+	Expect []byte // value a compare-and-* command requires
+	// Revision is the revision a compare-revision-and-* command requires,
+	// the store revision a GET, RANGE or COUNT reads at (0: the current
+	// one), or the revision COMPACT keeps the versions from.
+	Revision uint64
+	Delta    int64  // INCR
+	Txn      *KVTxn // TXN
+	// Lease is the lease of a lease command, or the lease a SET, SETNX or
+	// CAS attaches Key to (0: none).
+	Lease uint64
+	TTL   time.Duration // LEASE_GRANT, with millisecond precision
+	// End bounds a RANGE or COUNT, which covers the keys from Key up to but
+	// not including End; empty means no bound.
+	End   []byte
+	Limit uint64 // RANGE: most keys to return, 0 for MAX_RANGE_LIMIT
+}
+
+// Encode returns the binary encoding of c: 0x00 | Op(1), followed by the
+// fields of Op in order. Byte fields are a uvarint length and the bytes,
+// Revision, Lease, Limit and TTL (in milliseconds) a uvarint, Delta a varint
+// and Txn as described at KVTxn.
+func (c KVCommand) Encode() []byte {
+	buf := make([]byte, 0, 2+3*binary.MaxVarintLen64+len(c.Key)+len(c.Value)+len(c.Expect))
+	buf = append(buf, kvBinaryMarker, byte(c.Op))
+	for _, f := range c.Op.fields() {
+		switch f {
+		case kvFieldKey:
+			buf = appendKVBytes(buf, c.Key)
+		case kvFieldValue:
+			buf = appendKVBytes(buf, c.Value)
+		case kvFieldExpect:
+			buf = appendKVBytes(buf, c.Expect)
+		case kvFieldRevision:
+			buf = binary.AppendUvarint(buf, c.Revision)
+		case kvFieldDelta:
+			buf = binary.AppendVarint(buf, c.Delta)
+		case kvFieldTxn:
+			buf = appendKVTxn(buf, c.Txn)
+		case kvFieldLease:
+			buf = binary.AppendUvarint(buf, c.Lease)
+		case kvFieldTTL:
+			buf = binary.AppendUvarint(buf, uint64(c.TTL/time.Millisecond))
+		case kvFieldAttachLease:
+			if c.Lease != 0 {
+				buf = binary.AppendUvarint(buf, c.Lease)
+			}
+		case kvFieldReadRevision:
+			if c.Revision != 0 {
+				buf = binary.AppendUvarint(buf, c.Revision)
+			}
+		case kvFieldEnd:
+			buf = appendKVBytes(buf, c.End)
+		case kvFieldLimit:
+			buf = binary.AppendUvarint(buf, c.Limit)
+		}
+	}
+	return buf
+}
+
+func appendKVBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// GetCommand returns the encoded command reading key.
+func GetCommand(key []byte) []byte {
+	return KVCommand{Op: KVGet, Key: key}.Encode()
+}
+
+// SetCommand returns the encoded command setting key to value.
+func SetCommand(key, value []byte) []byte {
+	return KVCommand{Op: KVSet, Key: key, Value: value}.Encode()
+}
+
+// DeleteCommand returns the encoded command deleting key.
+func DeleteCommand(key []byte) []byte {
+	return KVCommand{Op: KVDelete, Key: key}.Encode()
+}
+
+// CompareAndSwapCommand returns the encoded command setting key to value if
+// its current value is expect.
+func CompareAndSwapCommand(key, expect, value []byte) []byte {
+	return KVCommand{Op: KVCompareAndSwap, Key: key, Expect: expect, Value: value}.Encode()
+}
+
+// CompareRevisionAndSwapCommand returns the encoded command setting key to
+// value if its current revision is revision; 0 requires the key to be absent.
+func CompareRevisionAndSwapCommand(key []byte, revision uint64, value []byte) []byte {
+	return KVCommand{Op: KVCompareRevisionAndSwap, Key: key, Revision: revision, Value: value}.Encode()
+}
+
+// SetIfAbsentCommand returns the encoded command setting key to value if it
+// does not exist.
+func SetIfAbsentCommand(key, value []byte) []byte {
+	return KVCommand{Op: KVSetIfAbsent, Key: key, Value: value}.Encode()
+}
+
+// CompareAndDeleteCommand returns the encoded command deleting key if its
+// current value is expect.
+func CompareAndDeleteCommand(key, expect []byte) []byte {
+	return KVCommand{Op: KVCompareAndDelete, Key: key, Expect: expect}.Encode()
+}
+
+// CompareRevisionAndDeleteCommand returns the encoded command deleting key if
+// its current revision is revision.
+func CompareRevisionAndDeleteCommand(key []byte, revision uint64) []byte {
+	return KVCommand{Op: KVCompareRevisionAndDelete, Key: key, Revision: revision}.Encode()
+}
+
+// SetWithLeaseCommand returns the encoded command setting key to value and
+// attaching it to lease, so it is deleted when the lease expires.
+func SetWithLeaseCommand(key, value []byte, lease uint64) []byte {
+	return KVCommand{Op: KVSet, Key: key, Value: value, Lease: lease}.Encode()
+}
+
+// LeaseGrantCommand returns the encoded command creating a lease that
+// expires ttl after it was granted or last kept alive. With id 0 the store
+// picks the ID; the result's Lease holds it.
+func LeaseGrantCommand(id uint64, ttl time.Duration) []byte {
+	return KVCommand{Op: KVLeaseGrant, Lease: id, TTL: ttl}.Encode()
+}
+
+// LeaseRevokeCommand returns the encoded command deleting lease id and every
+// key attached to it.
+func LeaseRevokeCommand(id uint64) []byte {
+	return KVCommand{Op: KVLeaseRevoke, Lease: id}.Encode()
+}
+
+// LeaseKeepAliveCommand returns the encoded command restarting the TTL of
+// lease id.
+func LeaseKeepAliveCommand(id uint64) []byte {
+	return KVCommand{Op: KVLeaseKeepAlive, Lease: id}.Encode()
+}
+
+// RangeCommand returns the encoded command reading up to limit keys, in
+// order, from start up to but not including end (empty: no bound).
+func RangeCommand(start, end []byte, limit uint64) []byte {
+	return KVCommand{Op: KVRange, Key: start, End: end, Limit: limit}.Encode()
+}
+
+// PrefixCommand returns the encoded command reading up to limit keys that
+// start with prefix.
+func PrefixCommand(prefix []byte, limit uint64) []byte {
+	return RangeCommand(prefix, PrefixEnd(prefix), limit)
+}
+
+// GetAtCommand returns the encoded command reading key as it was at store
+// revision revision.
+func GetAtCommand(key []byte, revision uint64) []byte {
+	return KVCommand{Op: KVGet, Key: key, Revision: revision}.Encode()
+}
+
+// CompactCommand returns the encoded command discarding the versions that
+// are no longer needed to read at revision or later.
+func CompactCommand(revision uint64) []byte {
+	return KVCommand{Op: KVCompact, Revision: revision}.Encode()
+}
+
+// CountCommand returns the encoded command counting the keys from start up
+// to but not including end (empty: no bound).
+func CountCommand(start, end []byte) []byte {
+	return KVCommand{Op: KVCount, Key: start, End: end}.Encode()
+}
+
+// PrefixEnd returns the end of the range of keys starting with prefix, or
+// nil if that range has no upper bound.
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// TxnCommand returns the encoded command running txn atomically.
+func TxnCommand(txn KVTxn) []byte {
+	return KVCommand{Op: KVTransaction, Txn: &txn}.Encode()
+}
+
+// IncrCommand returns the encoded command adding delta, which may be
+// negative, to the integer stored at key.
+func IncrCommand(key []byte, delta int64) []byte {
+	return KVCommand{Op: KVIncr, Key: key, Delta: delta}.Encode()
+}
+
+// DecodeKVCommand decodes a binary command or, for compatibility, a legacy
+// text command ("SET key value", "GET key", "DELETE key") whose words cannot
+// contain spaces. Errors match ErrInvalidCommand.
+func DecodeKVCommand(cmd []byte) (KVCommand, error) {
+	c, _, err := decodeKVCommand(cmd)
+	return c, err
+}
+
+// decodeKVCommand is DecodeKVCommand that also reports whether cmd was a
+// legacy text command.
+func decodeKVCommand(cmd []byte) (KVCommand, bool, error) {
+	if len(cmd) > 0 && cmd[0] == kvBinaryMarker {
+		c, err := decodeBinaryKVCommand(cmd[1:])
+		return c, false, err
+	}
+	c, err := decodeTextKVCommand(cmd)
+	return c, true, err
+}
+
+func decodeBinaryKVCommand(buf []byte) (KVCommand, error) {
+	if len(buf) == 0 {
+		return KVCommand{}, fmt.Errorf("%w: missing operation", ErrInvalidCommand)
+	}
+	c := KVCommand{Op: KVOp(buf[0])}
+	fields := c.Op.fields()
+	if fields == nil {
+		return KVCommand{}, fmt.Errorf("%w: unknown operation %d", ErrInvalidCommand, buf[0])
+	}
+	buf = buf[1:]
+	var err error
+	for _, f := range fields {
+		switch f {
+		case kvFieldKey:
+			c.Key, buf, err = readKVField(buf)
+		case kvFieldValue:
+			c.Value, buf, err = readKVField(buf)
+		case kvFieldExpect:
+			c.Expect, buf, err = readKVField(buf)
+		case kvFieldRevision:
+			n, size := binary.Uvarint(buf)
+			if size <= 0 {
+				err = errors.New("bad revision")
+			} else {
+				c.Revision, buf = n, buf[size:]
+			}
+		case kvFieldDelta:
+			n, size := binary.Varint(buf)
+			if size <= 0 {
+				err = errors.New("bad delta")
+			} else {
+				c.Delta, buf = n, buf[size:]
+			}
+		case kvFieldTxn:
+			c.Txn, buf, err = readKVTxn(buf)
+		case kvFieldEnd:
+			c.End, buf, err = readKVField(buf)
+		case kvFieldLease, kvFieldAttachLease:
+			if f == kvFieldAttachLease && len(buf) == 0 {
+				break
+			}
+			c.Lease, buf, err = readKVUvarint(buf, "lease")
+		case kvFieldTTL:
+			var ms uint64
+			ms, buf, err = readKVUvarint(buf, "TTL")
+			c.TTL = time.Duration(ms) * time.Millisecond
+		case kvFieldLimit:
+			c.Limit, buf, err = readKVUvarint(buf, "limit")
+		case kvFieldReadRevision:
+			if len(buf) > 0 {
+				c.Revision, buf, err = readKVUvarint(buf, "revision")
+			}
+		}
+		if err != nil {
+			return KVCommand{}, fmt.Errorf("%w: %s: %w", ErrInvalidCommand, c.Op, err)
+		}
+	}
+	if len(buf) != 0 {
+		return KVCommand{}, fmt.Errorf("%w: %d trailing bytes", ErrInvalidCommand, len(buf))
+	}
+	return c, nil
+}
+
+// readKVUvarint reads a uvarint field called name and returns it and the
+// rest of buf.
+func readKVUvarint(buf []byte, name string) (uint64, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 {
+		return 0, nil, fmt.Errorf("bad %s", name)
+	}
+	return n, buf[size:], nil
+}
+
+// readKVField reads a uvarint length-prefixed field and returns it and the
+// rest of buf.
+func readKVField(buf []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 {
+		return nil, nil, errors.New("bad length")
+	}
+	buf = buf[size:]
+	if uint64(len(buf)) < n {
+		return nil, nil, fmt.Errorf("length %d exceeds the %d bytes left", n, len(buf))
+	}
+	return buf[:n], buf[n:], nil
+}
+
+func decodeTextKVCommand(cmd []byte) (KVCommand, error) {
+	parts := splitCommand(string(cmd))
+	if len(parts) == 0 {
+		return KVCommand{}, fmt.Errorf("%w: empty command", ErrInvalidCommand)
+	}
+	var c KVCommand
+	var args int // text commands have none of the optional binary fields
+	switch parts[0] {
+	case "GET":
+		c.Op, args = KVGet, 1
+	case "SET":
+		c.Op, args = KVSet, 2
+	case "DELETE":
+		c.Op, args = KVDelete, 1
+	default:
+		return KVCommand{}, fmt.Errorf("%w: unknown operation %q", ErrInvalidCommand, parts[0])
+	}
+	if len(parts) != 1+args {
+		return KVCommand{}, fmt.Errorf("%w: %s takes %d arguments, got %d", ErrInvalidCommand, c.Op, args, len(parts)-1)
+	}
+	c.Key = []byte(parts[1])
+	if c.Op == KVSet {
+		c.Value = []byte(parts[2])
+	}
+	return c, nil
+}
+
+// KVResult is the result of a binary KVStore command. Legacy text commands
+// keep their plain results: the value for GET, "1" or "0" for DELETE.
+type KVResult struct {
+	// OK reports whether the command's condition held. It is always true
+	// for GET, SET, DELETE and INCR.
+	OK bool
+	// Found reports whether the key existed before the command.
+	Found bool
+	// Value is the value read by GET, the new value after INCR, or the
+	// current value when a condition failed.
+	Value []byte
+	// Revision is the key's revision after the command, or its current
+	// revision when a condition failed; 0 if the key does not exist. The
+	// store's revision grows with every change, so a key deleted and created
+	// again never gets an old revision back. For RANGE and COUNT it is the
+	// store revision read at, so later pages can read at the same one.
+	Revision uint64
+	// Lease is the lease the key is attached to, or the lease of a lease
+	// command.
+	Lease uint64
+	// Key is the key of a RANGE result item or, if More is set, where a
+	// RANGE stopped: the next call should start from it.
+	Key  []byte
+	More bool
+	// Count is the number of keys counted by COUNT.
+	Count uint64
+	// Results holds a transaction's per-op results, for the ops of the
+	// branch it took, in which case OK reports whether its compares held,
+	// or the keys read by RANGE, in order.
+	Results []KVResult
+}
+
+const (
+	kvResultOK = 1 << iota
+	kvResultFound
+	kvResultMore
+)
+
+// Encode returns the binary encoding of r: Flags(1) | Revision(uvarint) |
+// Lease(uvarint) | Count(uvarint) | KeyLen(uvarint) | Key |
+// ValueLen(uvarint) | Value | N(uvarint), followed by the N encoded
+// Results, each prefixed with its uvarint length.
+func (r KVResult) Encode() []byte {
+	var flags byte
+	if r.OK {
+		flags |= kvResultOK
+	}
+	if r.Found {
+		flags |= kvResultFound
+	}
+	if r.More {
+		flags |= kvResultMore
+	}
+	buf := make([]byte, 0, 1+6*binary.MaxVarintLen64+len(r.Key)+len(r.Value))
+	buf = append(buf, flags)
+	buf = binary.AppendUvarint(buf, r.Revision)
+	buf = binary.AppendUvarint(buf, r.Lease)
+	buf = binary.AppendUvarint(buf, r.Count)
+	buf = appendKVBytes(buf, r.Key)
+	buf = appendKVBytes(buf, r.Value)
+	buf = binary.AppendUvarint(buf, uint64(len(r.Results)))
+	for _, res := range r.Results {
+		buf = appendKVBytes(buf, res.Encode())
+	}
+	return buf
+}
+
+// DecodeKVResult decodes the result of a binary KVStore command.
+func DecodeKVResult(buf []byte) (KVResult, error) {
+	if len(buf) == 0 {
+		return KVResult{}, errors.New("raft: empty KV result")
+	}
+	r := KVResult{OK: buf[0]&kvResultOK != 0, Found: buf[0]&kvResultFound != 0, More: buf[0]&kvResultMore != 0}
+	rev, size := binary.Uvarint(buf[1:])
+	if size <= 0 {
+		return KVResult{}, errors.New("raft: bad revision in KV result")
+	}
+	r.Revision = rev
+	buf = buf[1+size:]
+	lease, size := binary.Uvarint(buf)
+	if size <= 0 {
+		return KVResult{}, errors.New("raft: bad lease in KV result")
+	}
+	r.Lease = lease
+	buf = buf[size:]
+	count, size := binary.Uvarint(buf)
+	if size <= 0 {
+		return KVResult{}, errors.New("raft: bad count in KV result")
+	}
+	r.Count = count
+	key, rest, err := readKVField(buf[size:])
+	if err != nil {
+		return KVResult{}, errors.New("raft: bad key in KV result")
+	}
+	if len(key) > 0 {
+		r.Key = key
+	}
+	value, rest, err := readKVField(rest)
+	if err != nil {
+		return KVResult{}, errors.New("raft: bad value in KV result")
+	}
+	r.Value = value
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || n > uint64(len(rest)) {
+		return KVResult{}, errors.New("raft: bad result count in KV result")
+	}
+	rest = rest[size:]
+	for i := uint64(0); i < n; i++ {
+		var enc []byte
+		if enc, rest, err = readKVField(rest); err != nil {
+			return KVResult{}, errors.New("raft: bad transaction result in KV result")
+		}
+		res, err := DecodeKVResult(enc)
+		if err != nil {
+			return KVResult{}, err
+		}
+		r.Results = append(r.Results, res)
+	}
+	if len(rest) != 0 {
+		return KVResult{}, errors.New("raft: trailing bytes in KV result")
+	}
+	return r, nil
+}
+
+// KVCompareTarget is what a KVCompare looks at.
+type KVCompareTarget uint8
+
+const (
+	KVCompareValue    KVCompareTarget = iota + 1 // the key's value; false for every Result if the key is absent
+	KVCompareRevision                            // the key's revision; 0 if the key is absent
+)
+
+// KVCompareResult is the relation a KVCompare requires between the key's
+// current value or revision and the one given.
+type KVCompareResult uint8
+
+const (
+	KVEqual KVCompareResult = iota + 1
+	KVNotEqual
+	KVLess
+	KVGreater
+)
+
+// KVCompare is a predicate of a transaction, e.g. {Key: k, Target:
+// KVCompareRevision, Result: KVEqual, Revision: 0} holds if k is absent.
+type KVCompare struct {
+	Key      []byte
+	Target   KVCompareTarget
+	Result   KVCompareResult
+	Value    []byte // for KVCompareValue
+	Revision uint64 // for KVCompareRevision
+}
+
+// KVTxn is an etcd-style transaction: if every compare holds, the Success
+// ops run, otherwise the Failure ops, all as a single log entry. Ops are any
+// KVStore commands but transactions; a transaction of GETs only may be sent
+// with Query. It is encoded as Count(uvarint) followed by each compare as
+// Key | Target(1) | Result(1) | Value or Revision, then the Success and
+// Failure lists as Count(uvarint) followed by each encoded op, prefixed with
+// its uvarint length.
+type KVTxn struct {
+	Compares []KVCompare
+	Success  []KVCommand
+	Failure  []KVCommand
+}
+
+// ReadOnly reports whether c only reads, so it may be sent with Query: a
+// GET, RANGE or COUNT, or a transaction of those only.
+func (c KVCommand) ReadOnly() bool {
+	if c.Op != KVTransaction || c.Txn == nil {
+		return c.Op.isRead()
+	}
+	for _, ops := range [][]KVCommand{c.Txn.Success, c.Txn.Failure} {
+		for _, op := range ops {
+			if !op.Op.isRead() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func appendKVTxn(buf []byte, txn *KVTxn) []byte {
+	if txn == nil {
+		txn = &KVTxn{}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(txn.Compares)))
+	for _, cmp := range txn.Compares {
+		buf = appendKVBytes(buf, cmp.Key)
+		buf = append(buf, byte(cmp.Target), byte(cmp.Result))
+		if cmp.Target == KVCompareRevision {
+			buf = binary.AppendUvarint(buf, cmp.Revision)
+		} else {
+			buf = appendKVBytes(buf, cmp.Value)
+		}
+	}
+	for _, ops := range [][]KVCommand{txn.Success, txn.Failure} {
+		buf = binary.AppendUvarint(buf, uint64(len(ops)))
+		for _, op := range ops {
+			buf = appendKVBytes(buf, op.Encode())
+		}
+	}
+	return buf
+}
+
+func readKVTxn(buf []byte) (*KVTxn, []byte, error) {
+	txn := &KVTxn{}
+	n, buf, err := readKVCount(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		var cmp KVCompare
+		if cmp.Key, buf, err = readKVField(buf); err != nil {
+			return nil, nil, fmt.Errorf("compare %d: %w", i, err)
+		}
+		if len(buf) < 2 {
+			return nil, nil, fmt.Errorf("compare %d: truncated", i)
+		}
+		cmp.Target, cmp.Result, buf = KVCompareTarget(buf[0]), KVCompareResult(buf[1]), buf[2:]
+		if cmp.Result < KVEqual || cmp.Result > KVGreater {
+			return nil, nil, fmt.Errorf("compare %d: unknown result %d", i, cmp.Result)
+		}
+		switch cmp.Target {
+		case KVCompareValue:
+			cmp.Value, buf, err = readKVField(buf)
+		case KVCompareRevision:
+			rev, size := binary.Uvarint(buf)
+			if size <= 0 {
+				err = errors.New("bad revision")
+			} else {
+				cmp.Revision, buf = rev, buf[size:]
+			}
+		default:
+			err = fmt.Errorf("unknown target %d", cmp.Target)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("compare %d: %w", i, err)
+		}
+		txn.Compares = append(txn.Compares, cmp)
+	}
+	for _, ops := range []*[]KVCommand{&txn.Success, &txn.Failure} {
+		if n, buf, err = readKVCount(buf); err != nil {
+			return nil, nil, err
+		}
+		for i := uint64(0); i < n; i++ {
+			var enc []byte
+			if enc, buf, err = readKVField(buf); err != nil {
+				return nil, nil, fmt.Errorf("op %d: %w", i, err)
+			}
+			if len(enc) == 0 || enc[0] != kvBinaryMarker {
+				return nil, nil, fmt.Errorf("op %d: not a binary command", i)
+			}
+			op, err := decodeBinaryKVCommand(enc[1:])
+			if err != nil {
+				return nil, nil, fmt.Errorf("op %d: %w", i, err)
+			}
+			if op.Op == KVTransaction {
+				return nil, nil, fmt.Errorf("op %d: transactions cannot be nested", i)
+			}
+			*ops = append(*ops, op)
+		}
+	}
+	return txn, buf, nil
+}
+
+// readKVCount reads the uvarint element count of a list whose elements take
+// at least one byte each.
+func readKVCount(buf []byte) (uint64, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)) {
+		return 0, nil, errors.New("bad count")
+	}
+	return n, buf[size:], nil
+}
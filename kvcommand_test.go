@@ -0,0 +1,204 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var binaryKey = []byte("k \x00\r\n\xff")
+
+func sampleKVCommands() []KVCommand {
+	return []KVCommand{
+		{Op: KVGet, Key: binaryKey},
+		{Op: KVGet, Key: binaryKey, Revision: 12},
+		{Op: KVSet, Key: binaryKey, Value: []byte("a value with spaces\x00")},
+		{Op: KVSet, Key: binaryKey, Value: []byte{}, Lease: 3},
+		{Op: KVDelete, Key: binaryKey},
+		{Op: KVCompareAndSwap, Key: binaryKey, Expect: []byte("old"), Value: []byte("new")},
+		{Op: KVCompareRevisionAndSwap, Key: binaryKey, Revision: 7, Value: []byte("new"), Lease: 1},
+		{Op: KVSetIfAbsent, Key: binaryKey, Value: []byte("v")},
+		{Op: KVCompareAndDelete, Key: binaryKey, Expect: []byte("old")},
+		{Op: KVCompareRevisionAndDelete, Key: binaryKey, Revision: 1 << 40},
+		{Op: KVIncr, Key: binaryKey, Delta: -5},
+		{Op: KVLeaseGrant, Lease: 9, TTL: 1500 * time.Millisecond},
+		{Op: KVLeaseRevoke, Lease: 9},
+		{Op: KVLeaseKeepAlive, Lease: 9},
+		{Op: KVLeaseExpire, Lease: 9, Revision: 2},
+		{Op: KVRange, Key: []byte("a"), End: []byte("b"), Limit: 10, Revision: 4},
+		{Op: KVCount, Key: []byte("a"), End: []byte{}},
+		{Op: KVCompact, Revision: 100},
+		{Op: KVTransaction, Txn: &KVTxn{
+			Compares: []KVCompare{
+				{Key: []byte("a"), Target: KVCompareValue, Result: KVEqual, Value: []byte("1")},
+				{Key: []byte("b"), Target: KVCompareRevision, Result: KVLess, Revision: 3},
+			},
+			Success: []KVCommand{{Op: KVSet, Key: []byte("a"), Value: []byte("2")}, {Op: KVGet, Key: []byte("b")}},
+			Failure: []KVCommand{{Op: KVDelete, Key: []byte("a")}},
+		}},
+	}
+}
+
+func TestKVCommandRoundTrip(t *testing.T) {
+	for _, c := range sampleKVCommands() {
+		enc := c.Encode()
+		if enc[0] != kvBinaryMarker {
+			t.Fatalf("%s: encoding does not start with the binary marker", c.Op)
+		}
+		got, err := DecodeKVCommand(enc)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Op, err)
+		}
+		if !bytes.Equal(got.Encode(), enc) {
+			t.Fatalf("%s: decoded %+v, which encodes differently from %+v", c.Op, got, c)
+		}
+		if got.Op != c.Op || !bytes.Equal(got.Key, c.Key) || !bytes.Equal(got.Value, c.Value) ||
+			got.Revision != c.Revision || got.Lease != c.Lease || got.Delta != c.Delta || got.TTL != c.TTL {
+			t.Fatalf("%s: decoded %+v, want %+v", c.Op, got, c)
+		}
+	}
+}
+
+func TestKVCommandHelpers(t *testing.T) {
+	tests := []struct {
+		cmd  []byte
+		want KVCommand
+	}{
+		{GetCommand(binaryKey), KVCommand{Op: KVGet, Key: binaryKey}},
+		{SetCommand(binaryKey, []byte("v w")), KVCommand{Op: KVSet, Key: binaryKey, Value: []byte("v w")}},
+		{DeleteCommand(binaryKey), KVCommand{Op: KVDelete, Key: binaryKey}},
+		{IncrCommand(binaryKey, 3), KVCommand{Op: KVIncr, Key: binaryKey, Delta: 3}},
+		{SetWithLeaseCommand(binaryKey, []byte("v"), 4), KVCommand{Op: KVSet, Key: binaryKey, Value: []byte("v"), Lease: 4}},
+		{PrefixCommand([]byte("ab"), 5), KVCommand{Op: KVRange, Key: []byte("ab"), End: []byte("ac"), Limit: 5}},
+	}
+	for _, tt := range tests {
+		got, err := DecodeKVCommand(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("decoded %+v, want %+v", got, tt.want)
+		}
+	}
+}
+
+func TestDecodeLegacyTextCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		want KVCommand
+	}{
+		{"GET k", KVCommand{Op: KVGet, Key: []byte("k")}},
+		{"SET k v", KVCommand{Op: KVSet, Key: []byte("k"), Value: []byte("v")}},
+		{"SET  k   v ", KVCommand{Op: KVSet, Key: []byte("k"), Value: []byte("v")}},
+		{"DELETE k", KVCommand{Op: KVDelete, Key: []byte("k")}},
+	}
+	for _, tt := range tests {
+		got, text, err := decodeKVCommand([]byte(tt.text))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.text, err)
+		}
+		if !text || !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%q: decoded %+v (text %v), want %+v", tt.text, got, text, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "GET", "GET k 1", "SET k", "SET k v w", "DELETE", "INCR k", "get k"} {
+		if _, err := DecodeKVCommand([]byte(bad)); !errors.Is(err, ErrInvalidCommand) {
+			t.Fatalf("%q: got %v, want ErrInvalidCommand", bad, err)
+		}
+	}
+}
+
+func TestDecodeMalformedKVCommand(t *testing.T) {
+	// Every proper prefix of these is malformed: none ends in an optional
+	// field.
+	for _, cmd := range [][]byte{
+		DeleteCommand([]byte("key")),
+		IncrCommand([]byte("key"), 1<<20),
+		CompareAndDeleteCommand([]byte("key"), []byte("expect")),
+		LeaseGrantCommand(1, time.Minute),
+		TxnCommand(KVTxn{
+			Compares: []KVCompare{{Key: []byte("a"), Target: KVCompareValue, Result: KVEqual, Value: []byte("1")}},
+			Success:  []KVCommand{{Op: KVDelete, Key: []byte("a")}},
+		}),
+	} {
+		for n := 0; n < len(cmd); n++ {
+			if _, err := DecodeKVCommand(cmd[:n]); !errors.Is(err, ErrInvalidCommand) {
+				t.Fatalf("%q cut to %d bytes: got %v, want ErrInvalidCommand", cmd, n, err)
+			}
+		}
+		if _, err := DecodeKVCommand(append(cmd, 0)); !errors.Is(err, ErrInvalidCommand) {
+			t.Fatalf("%q with a trailing byte: got %v, want ErrInvalidCommand", cmd, err)
+		}
+	}
+
+	nested := KVCommand{Op: KVTransaction, Txn: &KVTxn{Success: []KVCommand{{Op: KVTransaction, Txn: &KVTxn{}}}}}
+	if _, err := DecodeKVCommand(nested.Encode()); !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("nested transaction: got %v, want ErrInvalidCommand", err)
+	}
+	if _, err := DecodeKVCommand([]byte{kvBinaryMarker, 0xee}); !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("unknown operation: got %v, want ErrInvalidCommand", err)
+	}
+}
+
+func TestKVResultRoundTrip(t *testing.T) {
+	res := KVResult{
+		OK: true, Found: true, Value: []byte("v\x00"), Revision: 9, Lease: 2, Key: []byte("next"), More: true, Count: 3,
+		Results: []KVResult{{Found: true, Key: []byte("a"), Value: []byte("1"), Revision: 4}, {OK: true}},
+	}
+	got, err := DecodeKVResult(res.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Encode(), res.Encode()) || !got.More || got.Count != 3 || len(got.Results) != 2 ||
+		string(got.Results[0].Key) != "a" || got.Results[0].Revision != 4 || !got.Results[1].OK {
+		t.Fatalf("decoded %+v, want %+v", got, res)
+	}
+	if _, err := DecodeKVResult(res.Encode()[:5]); err == nil {
+		t.Fatal("DecodeKVResult accepted a truncated result")
+	}
+}
+
+func TestKVStoreRejectsInvalidCommands(t *testing.T) {
+	kv := NewKVStore()
+	if _, err := kv.Apply(SetCommand([]byte("k"), []byte("v"))); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range [][]byte{
+		[]byte("SET k"),
+		[]byte("GET k"), // a read sent as a write
+		GetCommand([]byte("k")),
+		SetCommand([]byte("k"), []byte("v"))[:4],
+	} {
+		if _, err := kv.Apply(cmd); !errors.Is(err, ErrInvalidCommand) {
+			t.Fatalf("Apply(%q) = %v, want ErrInvalidCommand", cmd, err)
+		}
+	}
+	if _, err := kv.Query(SetCommand([]byte("k"), []byte("w"))); !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("Query of a write = %v, want ErrInvalidCommand", err)
+	}
+	if v, err := kv.Query([]byte("GET k")); err != nil || string(v) != "v" {
+		t.Fatalf("Query(GET k) = %q, %v; want the unchanged value", v, err)
+	}
+}
+
+func TestKVStoreLegacyTextResults(t *testing.T) {
+	kv := NewKVStore()
+	for _, step := range []struct{ cmd, want string }{
+		{"SET k v", ""},
+		{"DELETE k", "1"},
+		{"DELETE k", "0"},
+	} {
+		got, err := kv.Apply([]byte(step.cmd))
+		if err != nil {
+			t.Fatalf("%s: %v", step.cmd, err)
+		}
+		if string(got) != step.want {
+			t.Fatalf("%s = %q, want %q", step.cmd, got, step.want)
+		}
+	}
+	if v, err := kv.Query([]byte("GET k")); err != nil || len(v) != 0 {
+		t.Fatalf("GET of a deleted key = %q, %v; want an empty value", v, err)
+	}
+}
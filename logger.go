@@ -1,71 +1,102 @@
 package raft
 
 import (
-	"fmt"
-	"log"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
 )
 
-const (
-	BLUE = iota
-	GREEN
-	RED
-	YELLOW
-	WHITE
-	CYAN
-	PURPLE
-	MAGENTA
-	ORANGE
-	EMERALD
-)
+// newLogger returns the logger a node built from cfg logs to, with the
+// node's ID attached to every record. Without cfg.Logger it is slog.Default,
+// or a debug-level ColorHandler on stderr if cfg.Debug is set.
+func newLogger(cfg Config) *slog.Logger {
+	logger := cfg.Logger
+	if logger == nil {
+		if cfg.Debug {
+			logger = slog.New(NewColorHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		} else {
+			logger = slog.Default()
+		}
+	}
+	return logger.With("node", cfg.ID)
+}
 
-func (r *Raft) logPut(msg string, colour int) {
+// logEvent logs msg with the node's current term and state. The lock is
+// only taken if level is enabled.
+func (r *Raft) logEvent(level slog.Level, msg string, args ...any) {
+	if !r.logger.Enabled(context.Background(), level) {
+		return
+	}
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	r.logPutLocked(msg, colour)
+	r.logEventLocked(level, msg, args...)
 }
 
-func (r *Raft) logPutLocked(msg string, colour int) {
-	if !r.debug {
+// logEventLocked is logEvent for callers that hold r.mu.
+func (r *Raft) logEventLocked(level slog.Level, msg string, args ...any) {
+	if !r.logger.Enabled(context.Background(), level) {
 		return
 	}
-	colors := map[int]string{
-		BLUE:    "\033[34m",
-		GREEN:   "\033[32m",
-		RED:     "\033[31m",
-		YELLOW:  "\033[33m",
-		WHITE:   "\033[37m",
-		CYAN:    "\033[36m",
-		PURPLE:  "\033[35m",
-		MAGENTA: "\033[95m",
-	}
-	color, ok := colors[colour]
-	if !ok {
-		color = "\033[0m"
-	}
-	reset := "\033[0m"
-	stateStr := ""
-	switch r.state {
-	case LEADER:
-		stateStr = "LEADER"
-	case FOLLOWER:
-		stateStr = "FOLLOWER"
-	case CANDIDATE:
-		stateStr = "CANDIDATE"
-	default:
-		stateStr = "UNKNOWN"
+	args = append([]any{"term", r.currentTerm, "state", stateName(r.state)}, args...)
+	r.logger.Log(context.Background(), level, msg, args...)
+}
+
+func levelColor(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "\033[31m"
+	case level >= slog.LevelWarn:
+		return "\033[33m"
+	case level >= slog.LevelInfo:
+		return "\033[36m"
 	}
-	logPrefix := fmt.Sprintf("[Node %d | Term %d | Role %s | VotedFor %d] ", r.me, r.currentTerm, stateStr, r.votedFor)
-	log.Printf("%s%s%s", color, logPrefix+msg, reset)
+	return "\033[90m"
 }
 
-func (r *Raft) printLogEntriesAsString() string {
-	logStr := "["
-	for i, entry := range r.log {
-		logStr += fmt.Sprintf("{Cmd: %v, Term: %d}", entry.Command, entry.Term)
-		if i != len(r.log)-1 {
-			logStr += ", "
-		}
+// ColorHandler is a slog.TextHandler that colours each line by its level,
+// for reading logs in a terminal during development.
+type ColorHandler struct {
+	text slog.Handler
+	out  *colorOutput
+}
+
+// colorOutput is shared by a ColorHandler and the handlers derived from it:
+// a record is formatted into buf and then written to w in one piece.
+type colorOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   io.Writer
+}
+
+// NewColorHandler returns a ColorHandler writing to w.
+func NewColorHandler(w io.Writer, opts *slog.HandlerOptions) *ColorHandler {
+	out := &colorOutput{w: w}
+	return &ColorHandler{text: slog.NewTextHandler(&out.buf, opts), out: out}
+}
+
+func (h *ColorHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *ColorHandler) Handle(ctx context.Context, rec slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.buf.Reset()
+	if err := h.text.Handle(ctx, rec); err != nil {
+		return err
 	}
-	logStr += "]"
-	return logStr
+	line := bytes.TrimSuffix(h.out.buf.Bytes(), []byte("\n"))
+	_, err := io.WriteString(h.out.w, levelColor(rec.Level)+string(line)+"\033[0m\n")
+	return err
+}
+
+func (h *ColorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ColorHandler{text: h.text.WithAttrs(attrs), out: h.out}
+}
+
+func (h *ColorHandler) WithGroup(name string) slog.Handler {
+	return &ColorHandler{text: h.text.WithGroup(name), out: h.out}
 }
@@ -0,0 +1,207 @@
+package raft
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Histogram buckets: latencies from 100µs to ~3s, batch sizes from 1 to 4096.
+var (
+	latencyBuckets   = prometheus.ExponentialBuckets(0.0001, 2, 16)
+	batchSizeBuckets = prometheus.ExponentialBuckets(1, 2, 13)
+)
+
+// raftMetrics holds the Prometheus metrics of a node. It is nil unless
+// Config.MetricsAddr is set, and every method is a no-op on nil.
+type raftMetrics struct {
+	registry *prometheus.Registry
+
+	electionsStarted   prometheus.Counter
+	electionsWon       prometheus.Counter
+	rpcDuration        *prometheus.HistogramVec
+	fsyncDuration      *prometheus.HistogramVec
+	batchSize          *prometheus.HistogramVec
+	readQuorumDuration prometheus.Histogram
+}
+
+func newRaftMetrics(r *Raft) *raftMetrics {
+	m := &raftMetrics{
+		registry: prometheus.NewRegistry(),
+		electionsStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "raft_elections_started_total",
+			Help: "Elections this node started as a candidate.",
+		}),
+		electionsWon: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "raft_elections_won_total",
+			Help: "Elections this node won.",
+		}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "raft_rpc_duration_seconds",
+			Help:    "Round trip time of the AppendEntries and RequestVote RPCs this node sent.",
+			Buckets: latencyBuckets,
+		}, []string{"rpc", "peer"}),
+		fsyncDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "raft_storage_fsync_duration_seconds",
+			Help:    "Time spent in fsync of the log and state files.",
+			Buckets: latencyBuckets,
+		}, []string{"file"}),
+		batchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "raft_client_batch_size",
+			Help:    "Client requests per batch cut by the leader.",
+			Buckets: batchSizeBuckets,
+		}, []string{"kind"}),
+		readQuorumDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "raft_read_quorum_duration_seconds",
+			Help:    "Time a read batch waited for a quorum to confirm the leadership.",
+			Buckets: latencyBuckets,
+		}),
+	}
+	m.registry.MustRegister(
+		m.electionsStarted,
+		m.electionsWon,
+		m.rpcDuration,
+		m.fsyncDuration,
+		m.batchSize,
+		m.readQuorumDuration,
+		nodeCollector{r},
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *raftMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *raftMetrics) electionStarted() {
+	if m != nil {
+		m.electionsStarted.Inc()
+	}
+}
+
+func (m *raftMetrics) electionWon() {
+	if m != nil {
+		m.electionsWon.Inc()
+	}
+}
+
+func (m *raftMetrics) observeRPC(rpc string, peer int, d time.Duration) {
+	if m != nil {
+		m.rpcDuration.WithLabelValues(rpc, strconv.Itoa(peer)).Observe(d.Seconds())
+	}
+}
+
+func (m *raftMetrics) observeFsync(file string, d time.Duration) {
+	if m != nil {
+		m.fsyncDuration.WithLabelValues(file).Observe(d.Seconds())
+	}
+}
+
+func (m *raftMetrics) observeBatch(kind string, n int) {
+	if m != nil {
+		m.batchSize.WithLabelValues(kind).Observe(float64(n))
+	}
+}
+
+func (m *raftMetrics) observeReadQuorum(d time.Duration) {
+	if m != nil {
+		m.readQuorumDuration.Observe(d.Seconds())
+	}
+}
+
+var (
+	termDesc = prometheus.NewDesc("raft_term",
+		"Current term.", nil, nil)
+	stateDesc = prometheus.NewDesc("raft_state",
+		"1 for the role the node is in, 0 for the others.", []string{"state"}, nil)
+	leaderDesc = prometheus.NewDesc("raft_leader_id",
+		"ID of the known leader, -1 if none.", nil, nil)
+	lastLogIndexDesc = prometheus.NewDesc("raft_last_log_index",
+		"Index of the last entry in the log.", nil, nil)
+	commitIndexDesc = prometheus.NewDesc("raft_commit_index",
+		"Highest log index known to be committed.", nil, nil)
+	appliedIndexDesc = prometheus.NewDesc("raft_applied_index",
+		"Highest log index applied to the state machine.", nil, nil)
+	pendingDesc = prometheus.NewDesc("raft_pending_responses",
+		"Client writes in the log waiting to be applied.", nil, nil)
+	matchIndexDesc = prometheus.NewDesc("raft_peer_match_index",
+		"Highest log index known to be replicated on the peer (leader only).", []string{"peer"}, nil)
+	nextIndexDesc = prometheus.NewDesc("raft_peer_next_index",
+		"Index of the next log entry to send to the peer (leader only).", []string{"peer"}, nil)
+	lagDesc = prometheus.NewDesc("raft_peer_replication_lag",
+		"Log entries the peer is behind the leader's last log index (leader only).", []string{"peer"}, nil)
+)
+
+// nodeCollector reports the node's consensus state, read under one lock at
+// scrape time.
+type nodeCollector struct {
+	r *Raft
+}
+
+func (c nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{termDesc, stateDesc, leaderDesc, lastLogIndexDesc,
+		commitIndexDesc, appliedIndexDesc, pendingDesc, matchIndexDesc, nextIndexDesc, lagDesc} {
+		ch <- d
+	}
+}
+
+func (c nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	r := c.r
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	gauge := func(d *prometheus.Desc, v int, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), labels...)
+	}
+	lastLogIndex := len(r.log) - 1
+	gauge(termDesc, r.currentTerm)
+	for _, s := range []int{LEADER, FOLLOWER, CANDIDATE} {
+		v := 0
+		if r.state == s {
+			v = 1
+		}
+		gauge(stateDesc, v, stateName(s))
+	}
+	gauge(leaderDesc, r.leaderID)
+	gauge(lastLogIndexDesc, lastLogIndex)
+	gauge(commitIndexDesc, r.commitIndex)
+	gauge(appliedIndexDesc, r.lastApplied)
+	gauge(pendingDesc, len(r.pendingResponses))
+	if r.state != LEADER {
+		return
+	}
+	for peerID := range r.peerIPPort {
+		if peerID == r.me {
+			continue
+		}
+		peer := strconv.Itoa(peerID)
+		gauge(matchIndexDesc, r.matchIndex[peerID], peer)
+		gauge(nextIndexDesc, r.nextIndex[peerID], peer)
+		gauge(lagDesc, lastLogIndex-r.matchIndex[peerID], peer)
+	}
+}
+
+func stateName(state int) string {
+	switch state {
+	case LEADER:
+		return "leader"
+	case FOLLOWER:
+		return "follower"
+	case CANDIDATE:
+		return "candidate"
+	}
+	return fmt.Sprintf("unknown(%d)", state)
+}
+
+func (r *Raft) serveMetrics() {
+	r.logger.Info("Serving metrics", "addr", r.metricsListener.Addr().String())
+	if err := r.metricsServer.Serve(r.metricsListener); err != nil && err != http.ErrServerClosed {
+		r.logger.Error("Metrics server stopped", "err", err)
+	}
+}
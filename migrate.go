@@ -0,0 +1,165 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// legacyStateSize is the size of the state file body before version 2 and of
+// a headerless state file: Term(8) + VotedFor(8).
+const legacyStateSize = 16
+
+// MigrateStorage upgrades the data files of node id in the working directory
+// to FormatVersion. Headerless files written before versioning are treated
+// as version 0. It returns the names of the files it rewrote; files that are
+// missing or already current are left untouched.
+func MigrateStorage(id int) ([]string, error) {
+	var migrated []string
+	files := []struct {
+		name    string
+		magic   string
+		convert func(r io.Reader, w io.Writer, from uint32, size int64) error
+	}{
+		{stateFilename(id), stateFileMagic, convertState},
+		{logFilename(id), logFileMagic, convertLog},
+	}
+	for _, f := range files {
+		ok, err := migrateFile(f.name, f.magic, f.convert)
+		if err != nil {
+			return migrated, fmt.Errorf("%s: %w", f.name, err)
+		}
+		if ok {
+			migrated = append(migrated, f.name)
+		}
+	}
+	return migrated, nil
+}
+
+// migrateFile rewrites name in the current format. The new contents are
+// written to a temporary file which then replaces the original, so an
+// interrupted migration leaves the old file intact. convert is given the
+// size of the body it reads.
+func migrateFile(name, magic string, convert func(r io.Reader, w io.Writer, from uint32, size int64) error) (bool, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	var from uint32
+	var bodyOffset int64
+	if info.Size() > 0 {
+		version, err := readHeader(f, magic)
+		switch {
+		case err == ErrLegacyFormat:
+		case err != nil:
+			return false, err
+		case version == FormatVersion:
+			return false, nil
+		case version > FormatVersion:
+			return false, fmt.Errorf("%w: version %d", ErrUnsupportedVersion, version)
+		default:
+			from, bodyOffset = version, fileHeaderSize
+		}
+	}
+	if _, err := f.Seek(bodyOffset, 0); err != nil {
+		return false, err
+	}
+
+	tmpName := name + ".migrate"
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpName)
+
+	w := bufio.NewWriter(tmp)
+	if _, err := w.Write(encodeHeader(magic)); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := convert(bufio.NewReader(f), w, from, info.Size()-bodyOffset); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("not a valid version %d data file: %w", from, err)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpName, name); err != nil {
+		return false, err
+	}
+	return true, syncDir(filepath.Dir(name))
+}
+
+// convertState copies the state body, whose layout has not changed since
+// version 0.
+func convertState(r io.Reader, w io.Writer, from uint32, size int64) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(body) != 0 && len(body) != legacyStateSize {
+		return fmt.Errorf("state is %d bytes, expected %d", len(body), legacyStateSize)
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// convertLog rewrites every record of a version 0 or 1 log, whose records
+// are Term(8) | CmdLen(8) | Command, as a current record without a session.
+func convertLog(r io.Reader, w io.Writer, from uint32, size int64) error {
+	for left := size; ; {
+		var term int64
+		err := binary.Read(r, binary.LittleEndian, &term)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var cmdLen int64
+		if err := binary.Read(r, binary.LittleEndian, &cmdLen); err != nil {
+			return fmt.Errorf("truncated record: %w", err)
+		}
+		left -= 16
+		if term < 0 || cmdLen < 0 || cmdLen > left {
+			return fmt.Errorf("corrupt record (term %d, command length %d, %d bytes left)", term, cmdLen, left)
+		}
+		left -= cmdLen
+		cmd := make([]byte, cmdLen)
+		if _, err := io.ReadFull(r, cmd); err != nil {
+			return fmt.Errorf("truncated record: %w", err)
+		}
+		if err := writeLogRecord(w, LogEntry{Term: int(term), Command: cmd}); err != nil {
+			return err
+		}
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,175 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// legacyLog encodes entries as a version 0/1 log body: Term(8) | CmdLen(8) |
+// Command.
+func legacyLog(entries []LogEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		binary.Write(&buf, binary.LittleEndian, int64(e.Term))
+		binary.Write(&buf, binary.LittleEndian, int64(len(e.Command)))
+		buf.Write(e.Command)
+	}
+	return buf.Bytes()
+}
+
+func legacyState(term, votedFor int) []byte {
+	buf := make([]byte, legacyStateSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(term))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(votedFor))
+	return buf
+}
+
+func header(magic string, version uint32) []byte {
+	buf := []byte(magic + "\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(buf[4:], version)
+	return buf
+}
+
+func writeFile(t *testing.T, name string, parts ...[]byte) {
+	t.Helper()
+	if err := os.WriteFile(name, bytes.Join(parts, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateStorage(t *testing.T) {
+	entries := []LogEntry{
+		{Term: 1, Command: []byte("SET a 1")},
+		{Term: 1, Command: []byte{}},
+		{Term: 3, Command: []byte("SET b two words")},
+	}
+	tests := []struct {
+		name         string
+		state, log   []byte
+		wantMigrated int
+	}{
+		{"headerless", legacyState(3, 2), legacyLog(entries), 2},
+		{"version 1", append(header(stateFileMagic, 1), legacyState(3, 2)...), append(header(logFileMagic, 1), legacyLog(entries)...), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			writeFile(t, stateFilename(1), tt.state)
+			writeFile(t, logFilename(1), tt.log)
+
+			if _, err := NewStorage(1, false); err == nil {
+				t.Fatal("NewStorage accepted an old data file")
+			}
+			migrated, err := MigrateStorage(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(migrated) != tt.wantMigrated {
+				t.Fatalf("migrated %v, want %d files", migrated, tt.wantMigrated)
+			}
+
+			s, err := NewStorage(1, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			term, votedFor, err := s.LoadState()
+			if err != nil || term != 3 || votedFor != 2 {
+				t.Fatalf("LoadState = %d, %d, %v; want 3, 2, nil", term, votedFor, err)
+			}
+			got, err := s.LoadLog()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, entries) {
+				t.Fatalf("LoadLog = %+v, want %+v", got, entries)
+			}
+
+			if again, err := MigrateStorage(1); err != nil || len(again) != 0 {
+				t.Fatalf("second MigrateStorage = %v, %v; want nothing to do", again, err)
+			}
+		})
+	}
+}
+
+func TestMigrateStorageCorruptLogKeepsOriginal(t *testing.T) {
+	t.Chdir(t.TempDir())
+	log := legacyLog([]LogEntry{{Term: 1, Command: []byte("SET a 1")}})
+	log = log[:len(log)-2]
+	writeFile(t, logFilename(1), log)
+
+	if _, err := MigrateStorage(1); err == nil {
+		t.Fatal("MigrateStorage accepted a truncated log")
+	}
+	got, err := os.ReadFile(logFilename(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, log) {
+		t.Fatal("failed migration modified the log file")
+	}
+}
+
+func TestNewStorageChecksHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		log  []byte
+		want error
+	}{
+		{"headerless", legacyLog([]LogEntry{{Term: 1, Command: []byte("x")}}), ErrLegacyFormat},
+		{"wrong magic", header(stateFileMagic, FormatVersion), ErrLegacyFormat},
+		{"newer version", header(logFileMagic, FormatVersion+1), ErrUnsupportedVersion},
+		{"older version", header(logFileMagic, 1), ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			writeFile(t, logFilename(1), tt.log)
+			s, err := NewStorage(1, false)
+			if err == nil {
+				s.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("NewStorage = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewStorageWritesHeader(t *testing.T) {
+	t.Chdir(t.TempDir())
+	s, err := NewStorage(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	for name, magic := range map[string]string{stateFilename(1): stateFileMagic, logFilename(1): logFileMagic} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, header(magic, FormatVersion)) {
+			t.Fatalf("%s = %q, want only the header", name, got)
+		}
+	}
+}
+
+func TestMigrateStorageRejectsOversizedCommandLength(t *testing.T) {
+	t.Chdir(t.TempDir())
+	log := legacyLog([]LogEntry{{Term: 1, Command: []byte("SET a 1")}})
+	binary.LittleEndian.PutUint64(log[8:16], 1<<62)
+	writeFile(t, logFilename(1), log)
+
+	_, err := MigrateStorage(1)
+	if err == nil || !strings.Contains(err.Error(), "corrupt record") {
+		t.Fatalf("MigrateStorage of an oversized command length = %v, want a corrupt record error", err)
+	}
+	if got, _ := os.ReadFile(logFilename(1)); !bytes.Equal(got, log) {
+		t.Fatal("the original log was changed")
+	}
+}
@@ -0,0 +1,98 @@
+package raft
+
+import (
+	"fmt"
+	"sort"
+)
+
+// kvVersion is one version of a key: its entry as of the change at
+// entry.revision, or a tombstone if the change deleted it.
+type kvVersion struct {
+	kvEntry
+	deleted bool
+}
+
+// entryAtLocked returns key's entry at store revision rev, or its current
+// one if rev is 0.
+func (kv *KVStore) entryAtLocked(key string, rev uint64) (kvEntry, bool) {
+	if rev == 0 {
+		e, ok := kv.data[key]
+		return e, ok
+	}
+	vs := kv.versions[key]
+	i := sort.Search(len(vs), func(i int) bool { return vs[i].revision > rev }) - 1
+	if i < 0 || vs[i].deleted {
+		return kvEntry{}, false
+	}
+	return vs[i].kvEntry, true
+}
+
+// readRevisionLocked returns the store revision a read at rev sees.
+func (kv *KVStore) readRevisionLocked(rev uint64) uint64 {
+	if rev == 0 {
+		return kv.revision
+	}
+	return rev
+}
+
+// checkReadRevisionLocked reports whether rev (0: the current one) can be
+// read at.
+func (kv *KVStore) checkReadRevisionLocked(rev uint64) error {
+	switch {
+	case rev > kv.revision:
+		return fmt.Errorf("%w: %d, store is at %d", ErrFutureRevision, rev, kv.revision)
+	case rev != 0 && rev < kv.compacted:
+		return fmt.Errorf("%w: %d, compacted up to %d", ErrCompacted, rev, kv.compacted)
+	}
+	return nil
+}
+
+// recordVersionLocked appends the version written by the current change.
+func (kv *KVStore) recordVersionLocked(key string, next kvEntry, ok bool) {
+	next.revision = kv.revision
+	vs, known := kv.versions[key]
+	kv.versions[key] = append(vs, kvVersion{kvEntry: next, deleted: !ok})
+	if !known {
+		kv.keys.ReplaceOrInsert(key)
+	}
+}
+
+// trimVersionsLocked drops the versions of key newer than rev, undoing the
+// changes of a failed transaction.
+func (kv *KVStore) trimVersionsLocked(key string, rev uint64) {
+	vs := kv.versions[key]
+	n := sort.Search(len(vs), func(i int) bool { return vs[i].revision > rev })
+	kv.setVersionsLocked(key, vs[:n])
+}
+
+func (kv *KVStore) setVersionsLocked(key string, vs []kvVersion) {
+	if len(vs) == 0 {
+		delete(kv.versions, key)
+		kv.keys.Delete(key)
+		return
+	}
+	kv.versions[key] = vs
+}
+
+// compactLocked discards the versions that are not needed to read at rev or
+// any later revision.
+func (kv *KVStore) compactLocked(rev uint64) (KVResult, error) {
+	if rev > kv.revision {
+		return KVResult{}, fmt.Errorf("%w: %d, store is at %d", ErrFutureRevision, rev, kv.revision)
+	}
+	if rev <= kv.compacted {
+		return KVResult{OK: true, Revision: kv.compacted}, nil
+	}
+	for key, vs := range kv.versions {
+		// vs[i] is the version in effect at rev; a tombstone is not needed.
+		i := sort.Search(len(vs), func(i int) bool { return vs[i].revision > rev }) - 1
+		if i >= 0 && vs[i].deleted {
+			i++
+		}
+		if i > 0 {
+			kv.setVersionsLocked(key, append([]kvVersion(nil), vs[i:]...))
+		}
+	}
+	kv.compacted = rev
+	return KVResult{OK: true, Revision: rev}, nil
+}
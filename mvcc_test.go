@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// rangeKeys returns the keys and values RANGE sees at revision rev.
+func rangeKeys(t *testing.T, kv *KVStore, rev uint64) []string {
+	t.Helper()
+	res := queryKV(t, kv, KVCommand{Op: KVRange, Revision: rev})
+	var kvs []string
+	for _, r := range res.Results {
+		kvs = append(kvs, string(r.Key)+"="+string(r.Value))
+	}
+	return kvs
+}
+
+// mvccStore returns a store with a history of five revisions.
+func mvccStore(t *testing.T) *KVStore {
+	t.Helper()
+	kv := NewKVStore()
+	for _, cmd := range [][]byte{
+		SetCommand([]byte("a"), []byte("1")), // revision 1
+		SetCommand([]byte("a"), []byte("2")), // 2
+		SetCommand([]byte("b"), []byte("3")), // 3
+		DeleteCommand([]byte("a")),           // 4
+		SetCommand([]byte("c"), []byte("5")), // 5
+	} {
+		if _, err := kv.Apply(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kv
+}
+
+func TestKVStoreReadsAtPastRevisions(t *testing.T) {
+	kv := mvccStore(t)
+	for _, tt := range []struct {
+		rev  uint64
+		want []string
+	}{
+		{1, []string{"a=1"}},
+		{3, []string{"a=2", "b=3"}},
+		{4, []string{"b=3"}},
+		{5, []string{"b=3", "c=5"}},
+		{0, []string{"b=3", "c=5"}},
+	} {
+		if got := rangeKeys(t, kv, tt.rev); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("RANGE at revision %d = %v, want %v", tt.rev, got, tt.want)
+		}
+	}
+	if a := queryKV(t, kv, KVCommand{Op: KVGet, Key: []byte("a"), Revision: 2}); string(a.Value) != "2" || a.Revision != 2 {
+		t.Fatalf("GET a at revision 2 = %q at %d", a.Value, a.Revision)
+	}
+	if n := queryKV(t, kv, KVCommand{Op: KVCount, Revision: 3}); n.Count != 2 {
+		t.Fatalf("COUNT at revision 3 = %d, want 2", n.Count)
+	}
+	if _, err := kv.Query(GetAtCommand([]byte("a"), 6)); !errors.Is(err, ErrFutureRevision) {
+		t.Fatalf("GET at a future revision = %v, want ErrFutureRevision", err)
+	}
+}
+
+func TestKVStoreCompact(t *testing.T) {
+	kv := mvccStore(t)
+	if _, err := kv.Apply(CompactCommand(6)); !errors.Is(err, ErrFutureRevision) {
+		t.Fatalf("COMPACT of a future revision = %v, want ErrFutureRevision", err)
+	}
+	mustApply(t, kv, KVCommand{Op: KVCompact, Revision: 3})
+	if _, err := kv.Query(GetAtCommand([]byte("a"), 2)); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("GET below the compacted revision = %v, want ErrCompacted", err)
+	}
+	if _, err := kv.Query(RangeCommand(nil, nil, 0)); err != nil {
+		t.Fatalf("RANGE at the current revision after COMPACT: %v", err)
+	}
+	// Reads at and after the compacted revision are unchanged.
+	if got := rangeKeys(t, kv, 3); !reflect.DeepEqual(got, []string{"a=2", "b=3"}) {
+		t.Fatalf("RANGE at the compacted revision = %v", got)
+	}
+	if got := rangeKeys(t, kv, 4); !reflect.DeepEqual(got, []string{"b=3"}) {
+		t.Fatalf("RANGE at revision 4 = %v", got)
+	}
+	if vs := kv.versions["a"]; len(vs) != 2 {
+		t.Fatalf("a keeps %d versions after COMPACT 3, want its value at 3 and its deletion", len(vs))
+	}
+
+	// Once its deletion is compacted, a key leaves the index altogether.
+	mustApply(t, kv, KVCommand{Op: KVCompact, Revision: 4})
+	if _, ok := kv.versions["a"]; ok || kv.keys.Has("a") {
+		t.Fatal("deleted key still indexed after its deletion was compacted")
+	}
+	// Compacting an older revision again is a no-op.
+	if res := mustApply(t, kv, KVCommand{Op: KVCompact, Revision: 2}); !res.OK || res.Revision != 4 {
+		t.Fatalf("COMPACT 2 after COMPACT 4 = %+v, want OK at 4", res)
+	}
+}
+
+func TestWatchCompacted(t *testing.T) {
+	kv := NewKVStore()
+	n := uint64(WATCH_HISTORY + 1)
+	for i := uint64(1); i <= n; i++ {
+		applyAt(t, kv, i, SetCommand([]byte(fmt.Sprint(i%10)), []byte("v")))
+	}
+	lost := kv.historyLost
+	if lost == 0 || lost >= n {
+		t.Fatalf("historyLost = %d after %d entries", lost, n)
+	}
+	if _, err := kv.Watch(context.Background(), nil, true, lost); !errors.Is(err, ErrWatchCompacted) {
+		t.Fatalf("watch from a dropped index = %v, want ErrWatchCompacted", err)
+	}
+	w, err := kv.Watch(context.Background(), nil, true, lost+1)
+	if err != nil {
+		t.Fatalf("watch from the oldest retained index: %v", err)
+	}
+	defer w.Close()
+	events := nextEvents(t, w, int(n-lost))
+	if events[0].Index != lost+1 || events[len(events)-1].Index != n {
+		t.Fatalf("replayed indexes %d to %d, want %d to %d", events[0].Index, events[len(events)-1].Index, lost+1, n)
+	}
+}
@@ -0,0 +1,277 @@
+package raft
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OBSERVER_MAX_PENDING is how many events an observer may fall behind before
+// the oldest are dropped.
+const OBSERVER_MAX_PENDING = 1024
+
+// EventType is the kind of change an Event reports.
+type EventType uint8
+
+const (
+	// EventStateChange: the node became a leader, follower or candidate.
+	EventStateChange EventType = iota + 1
+	// EventLeaderChange: the node learned of a new leader, or lost track of
+	// it (Leader -1).
+	EventLeaderChange
+	// EventTermChange: the node moved to a newer term.
+	EventTermChange
+	// EventPeerUnreachable: an RPC to a peer failed or it could not be dialed.
+	EventPeerUnreachable
+	// EventPeerReachable: a connection to a peer was established.
+	EventPeerReachable
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStateChange:
+		return "state-change"
+	case EventLeaderChange:
+		return "leader-change"
+	case EventTermChange:
+		return "term-change"
+	case EventPeerUnreachable:
+		return "peer-unreachable"
+	case EventPeerReachable:
+		return "peer-reachable"
+	}
+	return fmt.Sprintf("EventType(%d)", uint8(t))
+}
+
+// Event is a change of the node's consensus state. Fields that do not apply
+// to its Type are zero.
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	Term      int   // the node's term after the change
+	State     int   // EventStateChange: LEADER, FOLLOWER or CANDIDATE
+	PrevState int   // EventStateChange: the state before
+	Leader    int   // EventLeaderChange: the new leader, -1 if none is known
+	Peer      int   // EventPeer*: the peer's ID
+	Err       error // EventPeerUnreachable: why
+}
+
+// Observer receives the events of a node. Events are queued without ever
+// blocking consensus; if the receiver falls more than OBSERVER_MAX_PENDING
+// events behind, the oldest are dropped and counted in Dropped.
+type Observer struct {
+	// C delivers the events of an observer made with Observe. It is closed
+	// when the observer is closed or the node has shut down.
+	C <-chan Event
+
+	r      *Raft
+	c      chan Event
+	fn     func(Event)
+	filter map[EventType]bool // nil: every type
+
+	mu      sync.Mutex
+	pending []Event
+	dropped uint64
+	notify  chan struct{} // signalled when pending grows
+	done    chan struct{} // closed by Close
+	closed  bool
+	ending  bool // the node shut down: deliver what is pending, then stop
+}
+
+// Observe returns an observer whose C delivers the node's events of the
+// given types, or of every type if none are given. When the node shuts down
+// the events still pending are delivered and C is closed.
+func (r *Raft) Observe(types ...EventType) *Observer {
+	c := make(chan Event)
+	o := r.newObserver(types)
+	o.C, o.c = c, c
+	go o.run()
+	return o
+}
+
+// OnEvent calls fn for each of the node's events of the given types, or of
+// every type if none are given, until the returned observer is closed. fn is
+// called from the observer's own goroutine, one event at a time.
+func (r *Raft) OnEvent(fn func(Event), types ...EventType) *Observer {
+	o := r.newObserver(types)
+	o.fn = fn
+	go o.run()
+	return o
+}
+
+func (r *Raft) newObserver(types []EventType) *Observer {
+	o := &Observer{
+		r:      r,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if len(types) > 0 {
+		o.filter = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			o.filter[t] = true
+		}
+	}
+	r.observersMu.Lock()
+	if r.observersEnded {
+		o.ending = true
+	} else {
+		r.observers[o] = struct{}{}
+	}
+	r.observersMu.Unlock()
+	return o
+}
+
+// Close stops the observer. C is closed and fn is not called again once the
+// event being delivered, if any, has been handled.
+func (o *Observer) Close() {
+	o.r.observersMu.Lock()
+	delete(o.r.observers, o)
+	o.r.observersMu.Unlock()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(o.done)
+	}
+}
+
+// Dropped returns how many events were dropped because the receiver fell
+// behind.
+func (o *Observer) Dropped() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dropped
+}
+
+// push queues ev without blocking.
+func (o *Observer) push(ev Event) {
+	if o.filter != nil && !o.filter[ev.Type] {
+		return
+	}
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	if len(o.pending) >= OBSERVER_MAX_PENDING {
+		o.pending = o.pending[1:]
+		o.dropped++
+	}
+	o.pending = append(o.pending, ev)
+	o.mu.Unlock()
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued events until the observer is closed.
+func (o *Observer) run() {
+	if o.c != nil {
+		defer close(o.c)
+	}
+	for {
+		o.mu.Lock()
+		events := o.pending
+		o.pending = nil
+		o.mu.Unlock()
+		for _, ev := range events {
+			if o.fn != nil {
+				select {
+				case <-o.done:
+					return
+				default:
+				}
+				o.fn(ev)
+				continue
+			}
+			select {
+			case o.c <- ev:
+			case <-o.done:
+				return
+			}
+		}
+		o.mu.Lock()
+		ended := o.ending && len(o.pending) == 0
+		o.mu.Unlock()
+		if ended {
+			return
+		}
+		select {
+		case <-o.notify:
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// endObservers lets every observer finish once it has delivered the events
+// of the shutdown.
+func (r *Raft) endObservers() {
+	r.observersMu.Lock()
+	defer r.observersMu.Unlock()
+	r.observersEnded = true
+	for o := range r.observers {
+		delete(r.observers, o)
+		o.mu.Lock()
+		o.ending = true
+		o.mu.Unlock()
+		select {
+		case o.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// emit hands ev to every observer.
+func (r *Raft) emit(ev Event) {
+	ev.Time = time.Now()
+	r.observersMu.RLock()
+	defer r.observersMu.RUnlock()
+	for o := range r.observers {
+		o.push(ev)
+	}
+}
+
+// setStateLocked moves the node to state, reporting the change.
+func (r *Raft) setStateLocked(state int) {
+	if r.state == state {
+		return
+	}
+	prev := r.state
+	r.state = state
+	r.emit(Event{Type: EventStateChange, Term: r.currentTerm, State: state, PrevState: prev})
+}
+
+// setTermLocked moves the node to term, reporting the change.
+func (r *Raft) setTermLocked(term int) {
+	if r.currentTerm == term {
+		return
+	}
+	r.currentTerm = term
+	r.emit(Event{Type: EventTermChange, Term: term})
+}
+
+// setLeaderLocked records the known leader, reporting a change.
+func (r *Raft) setLeaderLocked(id int) {
+	if r.leaderID == id {
+		return
+	}
+	r.leaderID = id
+	r.emit(Event{Type: EventLeaderChange, Term: r.currentTerm, Leader: id})
+}
+
+// setPeerReachableLocked records whether peer can be reached, reporting the
+// first observation and every change.
+func (r *Raft) setPeerReachableLocked(peer int, reachable bool, err error) {
+	if known, ok := r.peerReachable[peer]; ok && known == reachable {
+		return
+	}
+	r.peerReachable[peer] = reachable
+	ev := Event{Type: EventPeerReachable, Term: r.currentTerm, Peer: peer}
+	if !reachable {
+		ev.Type, ev.Err = EventPeerUnreachable, err
+	}
+	r.emit(ev)
+}
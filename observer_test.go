@@ -0,0 +1,132 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+// emitTerms emits a term change for each term from first to last.
+func emitTerms(r *Raft, first, last int) {
+	for term := first; term <= last; term++ {
+		r.emit(Event{Type: EventTermChange, Term: term})
+	}
+}
+
+// blockingObserver returns an observer whose callback sends each event's
+// term on got, and blocks after the first until release is closed.
+func blockingObserver(r *Raft) (o *Observer, got chan int, release chan struct{}) {
+	got = make(chan int, 2*OBSERVER_MAX_PENDING)
+	release = make(chan struct{})
+	o = r.OnEvent(func(ev Event) {
+		got <- ev.Term
+		<-release
+	})
+	return o, got, release
+}
+
+func TestObserverDropsOldestEvents(t *testing.T) {
+	r := newTestNode(t, nil)
+	o, got, release := blockingObserver(r)
+	defer o.Close()
+	emitTerms(r, 0, 0)
+	<-got // the callback is busy with term 0
+
+	extra := 5
+	emitTerms(r, 1, OBSERVER_MAX_PENDING+extra)
+	if n := o.Dropped(); n != uint64(extra) {
+		t.Fatalf("Dropped = %d, want %d", n, extra)
+	}
+	close(release)
+	for want := extra + 1; want <= OBSERVER_MAX_PENDING+extra; want++ {
+		select {
+		case term := <-got:
+			if term != want {
+				t.Fatalf("got term %d, want %d: the oldest events are dropped", term, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event after term %d", want-1)
+		}
+	}
+}
+
+func TestObserverCloseDuringCallback(t *testing.T) {
+	r := newTestNode(t, nil)
+	o, got, release := blockingObserver(r)
+	emitTerms(r, 1, 3)
+	<-got
+
+	closed := make(chan struct{})
+	go func() {
+		o.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited for the callback")
+	}
+	close(release)
+	emitTerms(r, 4, 4)
+	select {
+	case term := <-got:
+		t.Fatalf("callback got term %d after Close", term)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestObserverFiltersTypes(t *testing.T) {
+	r := newTestNode(t, nil)
+	o := r.Observe(EventLeaderChange)
+	defer o.Close()
+	r.mu.Lock()
+	r.setTermLocked(2)
+	r.setLeaderLocked(3)
+	r.setStateLocked(CANDIDATE)
+	r.setLeaderLocked(-1)
+	r.mu.Unlock()
+	for _, want := range []int{3, -1} {
+		select {
+		case ev := <-o.C:
+			if ev.Type != EventLeaderChange || ev.Leader != want || ev.Term != 2 {
+				t.Fatalf("got %+v, want leader %d in term 2", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for leader %d", want)
+		}
+	}
+}
+
+func TestObserverDeliversPendingEventsAtShutdown(t *testing.T) {
+	r := newTestNode(t, nil)
+	o := r.Observe()
+	emitTerms(r, 1, 3)
+	r.endObservers()
+
+	var terms []int
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case ev, ok := <-o.C:
+			if !ok {
+				done = true
+				break
+			}
+			terms = append(terms, ev.Term)
+		case <-timeout:
+			t.Fatalf("C still open after delivering %v", terms)
+		}
+	}
+	if len(terms) != 3 || terms[0] != 1 || terms[2] != 3 {
+		t.Fatalf("delivered terms %v before closing C, want 1 to 3", terms)
+	}
+
+	// An observer made after the shutdown ends at once.
+	select {
+	case _, ok := <-r.Observe().C:
+		if ok {
+			t.Fatal("observer made after the shutdown got an event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("C of an observer made after the shutdown is not closed")
+	}
+}
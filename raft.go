@@ -1,9 +1,19 @@
 package raft
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"net/rpc"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -15,20 +25,40 @@ const (
 type Config struct {
 	ID             int
 	ConfPath       string
-	WriteBatchSize int // default: 128
-	ReadBatchSize  int // default: 128
-	Debug          bool
+	WriteBatchSize int  // default: 128
+	ReadBatchSize  int  // default: 128
+	Debug          bool // log at debug level to stderr if Logger is nil
 	AsyncLog       bool
+	GroupCommit    bool // flush writes immediately and share fsyncs between batches instead of lingering
+	// SessionTTL is how long a client session may stay idle before it is
+	// forgotten (default: 1h). It must be the same on every node.
+	SessionTTL time.Duration
+	// MetricsAddr is where Prometheus metrics are served at /metrics, e.g.
+	// ":9100". Empty (the default) disables metrics.
+	MetricsAddr string
+	// Logger receives the node's logs, with the node's ID attached. If nil,
+	// slog.Default is used (see Debug).
+	Logger *slog.Logger
+	// TracerProvider enables OpenTelemetry spans for client requests (see
+	// tracing.go). Nil (the default) disables tracing.
+	TracerProvider trace.TracerProvider
 }
 
 type LogEntry struct {
-	Command []byte
-	Term    int
+	Command   []byte
+	Term      int
+	ClientID  uint64 // client session the command belongs to, 0 if none
+	Seq       uint64 // the command's sequence number within that session
+	Timestamp int64  // leader's clock (Unix ms) when the entry was appended
 }
 
 type ClientRequest struct {
 	Command []byte
 	RespCh  chan Response
+	read    bool // serve through the quorum-read path instead of the log
+	future  *ApplyFuture
+	session uint64 // client session ID, 0 if none
+	seq     uint64 // sequence number within the session
 }
 
 type Raft struct {
@@ -43,24 +73,58 @@ type Raft struct {
 	state            int
 	rpcConns         map[int]*rpc.Client
 	heartBeatCh      chan bool
+	timeoutNowCh     chan bool // the leader asked this node to start an election at once
 	clusterSize      int32
 	sm               StateMachine
 	ReqCh            chan ClientRequest
 	ReadCh           chan []ClientRequest
-	pendingResponses map[int]chan Response
+	pendingResponses map[int]*ApplyFuture
 	mu               sync.RWMutex
 	peerIPPort       map[int]string
+	peerHTTP         map[int]string // HTTP API address of the nodes that serve one
+	peerRESP         map[int]string // RESP address of the nodes that serve one
 	storage          *Storage
 	commitCond       *sync.Cond
 	replicating      map[int]bool
 	newLogEntryCh    chan bool
 	writeBatchSize   int
 	readBatchSize    int
-	debug            bool
+	logger           *slog.Logger
+	tracer           trace.Tracer // nil unless Config.TracerProvider is set
+	peerReachable    map[int]bool // last known reachability of each peer, absent if unknown
+	observersMu      sync.RWMutex
+	observers        map[*Observer]struct{}
+	observersEnded   bool // the node has shut down; guarded by observersMu
 	leaderID         int
+	transferring     bool // a leadership transfer is in progress; new requests are refused
+	groupCommit      bool
+	durableIndex     int // last log index known to be on this node's stable storage
+	sessions         *sessionTable
+	leaderSince      time.Time    // when this node last became leader
+	lastTick         time.Time    // when the leader last called Ticker.Tick
+	ticking          atomic.Bool  // a tick's commands are still being proposed
+	metrics          *raftMetrics // nil unless Config.MetricsAddr is set
+
+	rpcServer       *rpc.Server
+	listener        net.Listener
+	httpServer      *http.Server // nil if this node has no http_port
+	httpListener    net.Listener
+	respListener    net.Listener // nil if this node has no resp_port
+	metricsServer   *http.Server // nil unless Config.MetricsAddr is set
+	metricsListener net.Listener
+	inboundConns    map[net.Conn]struct{}
+	shutdown        bool
+	shutdownCh      chan struct{}
+	shutdownOnce    sync.Once
+	shutdownDone    chan struct{}
+	shutdownErr     error
+	wg              sync.WaitGroup // every goroutine the node starts, so Shutdown can wait for them
 }
 
-func New(cfg Config, sm StateMachine) *Raft {
+// New creates a node from cfg and starts its background goroutines; call Run
+// to take part in consensus. Errors match ErrInvalidConfig, ErrAddressInUse,
+// ErrStorageCorrupt or one of the storage format errors.
+func New(cfg Config, sm StateMachine) (*Raft, error) {
 	writeBatchSize := cfg.WriteBatchSize
 	if writeBatchSize == 0 {
 		writeBatchSize = 128
@@ -70,18 +134,67 @@ func New(cfg Config, sm StateMachine) *Raft {
 		readBatchSize = 128
 	}
 
-	peerIPPort := ParseConfig(cfg.ConfPath)
+	peerIPPort, err := ParseConfig(cfg.ConfPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := peerIPPort[cfg.ID]; !ok {
+		return nil, fmt.Errorf("%w: node %d is not listed in %s", ErrInvalidConfig, cfg.ID, cfg.ConfPath)
+	}
+	peerHTTP, err := ParseHTTPConfig(cfg.ConfPath)
+	if err != nil {
+		return nil, err
+	}
+	peerRESP, err := ParseRESPConfig(cfg.ConfPath)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := listen(peerIPPort[cfg.ID])
+	if err != nil {
+		return nil, err
+	}
+	var httpListener, respListener, metricsListener net.Listener
+	closeListeners := func() {
+		for _, l := range []net.Listener{listener, httpListener, respListener, metricsListener} {
+			if l != nil {
+				l.Close()
+			}
+		}
+	}
+	if addr, ok := peerHTTP[cfg.ID]; ok {
+		if httpListener, err = listen(addr); err != nil {
+			closeListeners()
+			return nil, err
+		}
+	}
+	if addr, ok := peerRESP[cfg.ID]; ok {
+		if respListener, err = listen(addr); err != nil {
+			closeListeners()
+			return nil, err
+		}
+	}
+	if cfg.MetricsAddr != "" {
+		if metricsListener, err = listen(cfg.MetricsAddr); err != nil {
+			closeListeners()
+			return nil, err
+		}
+	}
 	storage, err := NewStorage(cfg.ID, cfg.AsyncLog)
 	if err != nil {
-		panic(err)
+		closeListeners()
+		return nil, err
 	}
 	term, votedFor, err := storage.LoadState()
 	if err != nil {
-		panic(err)
+		storage.Close()
+		closeListeners()
+		return nil, fmt.Errorf("%w: %w", ErrStorageCorrupt, err)
 	}
 	logs, err := storage.LoadLog()
 	if err != nil {
-		panic(err)
+		storage.Close()
+		closeListeners()
+		return nil, fmt.Errorf("%w: %w", ErrStorageCorrupt, err)
 	}
 	// Prepend dummy entry
 	fullLog := []LogEntry{{Command: nil, Term: 0}}
@@ -99,31 +212,146 @@ func New(cfg Config, sm StateMachine) *Raft {
 		state:            FOLLOWER,
 		rpcConns:         make(map[int]*rpc.Client),
 		heartBeatCh:      make(chan bool, 1),
+		timeoutNowCh:     make(chan bool, 1),
 		clusterSize:      int32(len(peerIPPort)),
 		sm:               sm,
 		ReqCh:            make(chan ClientRequest, 5000),
 		ReadCh:           make(chan []ClientRequest, 500),
-		pendingResponses: make(map[int]chan Response),
+		pendingResponses: make(map[int]*ApplyFuture),
 		mu:               sync.RWMutex{},
 		peerIPPort:       peerIPPort,
+		peerHTTP:         peerHTTP,
+		peerRESP:         peerRESP,
 		storage:          storage,
 		replicating:      make(map[int]bool),
 		newLogEntryCh:    make(chan bool, 1),
 		writeBatchSize:   writeBatchSize,
 		readBatchSize:    readBatchSize,
-		debug:            cfg.Debug,
+		logger:           newLogger(cfg),
 		leaderID:         -1,
+		groupCommit:      cfg.GroupCommit,
+		durableIndex:     len(fullLog) - 1,
+		sessions:         newSessionTable(cfg.SessionTTL),
+		peerReachable:    make(map[int]bool),
+		observers:        make(map[*Observer]struct{}),
+		rpcServer:        rpc.NewServer(),
+		listener:         listener,
+		httpListener:     httpListener,
+		respListener:     respListener,
+		metricsListener:  metricsListener,
+		inboundConns:     make(map[net.Conn]struct{}),
+		shutdownCh:       make(chan struct{}),
+		shutdownDone:     make(chan struct{}),
 	}
 	r.commitCond = sync.NewCond(&r.mu)
+	if cfg.TracerProvider != nil {
+		r.tracer = cfg.TracerProvider.Tracer(TRACER_NAME)
+	}
 	for peerID := range peerIPPort {
 		r.nextIndex[peerID] = len(fullLog)
 		r.matchIndex[peerID] = 0
 	}
+	_ = r.rpcServer.Register(r)
+	if metricsListener != nil {
+		r.metrics = newRaftMetrics(r)
+		storage.OnSync = r.metrics.observeFsync
+	}
 
-	go r.listenRPC(peerIPPort)
-	go r.handleClientRequest()
-	go r.runApplier()
-	return r
+	r.goFunc(r.listenRPC)
+	r.goFunc(r.handleClientRequest)
+	r.goFunc(r.runApplier)
+	if httpListener != nil {
+		r.httpServer = &http.Server{Handler: r.newHTTPHandler()}
+		r.goFunc(r.serveHTTP)
+	}
+	if respListener != nil {
+		r.goFunc(r.listenRESP)
+	}
+	if metricsListener != nil {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", r.metrics.handler())
+		r.metricsServer = &http.Server{Handler: mux}
+		r.goFunc(r.serveMetrics)
+	}
+	return r, nil
+}
+
+// listen binds addr, reporting a port that is taken as ErrAddressInUse.
+func listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("%w: %w", ErrAddressInUse, err)
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
+// goFunc runs f in a goroutine that Shutdown waits for. It must only be
+// called before Shutdown starts or from another goroutine started this way.
+func (r *Raft) goFunc(f func()) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+}
+
+// Shutdown stops the node: it stops accepting requests, fails those still
+// waiting for a result, closes the listener and every peer connection, waits
+// for all of the node's goroutines (including Run) to exit and finally
+// flushes and closes storage. It may be called more than once; if ctx ends
+// first the shutdown keeps going in the background and ctx.Err() is returned.
+func (r *Raft) Shutdown(ctx context.Context) error {
+	r.shutdownOnce.Do(func() { go r.shutdownNode() })
+	select {
+	case <-r.shutdownDone:
+		return r.shutdownErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Raft) shutdownNode() {
+	r.mu.Lock()
+	r.shutdown = true
+	close(r.shutdownCh)
+	r.setStateLocked(FOLLOWER)
+	r.failPendingLocked(ErrShutdown)
+	var clients []*rpc.Client
+	for peerID, client := range r.rpcConns {
+		if client != nil {
+			clients = append(clients, client)
+		}
+		r.rpcConns[peerID] = nil
+	}
+	for conn := range r.inboundConns {
+		conn.Close()
+	}
+	r.commitCond.Broadcast()
+	r.mu.Unlock()
+
+	r.listener.Close()
+	if r.httpServer != nil {
+		r.httpServer.Close()
+	}
+	if r.respListener != nil {
+		r.respListener.Close()
+	}
+	if r.metricsServer != nil {
+		r.metricsServer.Close()
+	}
+	for _, client := range clients {
+		client.Close()
+	}
+	r.wg.Wait()
+
+	r.mu.Lock()
+	r.shutdownErr = r.storage.Close()
+	r.mu.Unlock()
+	r.endObservers()
+	close(r.shutdownDone)
 }
 
 func (r *Raft) sendRead(server int) bool {
@@ -142,8 +370,8 @@ func (r *Raft) sendRead(server int) bool {
 	reply := &ReadReply{}
 	if err := client.Call(Read, args, reply); err != nil {
 		r.mu.Lock()
-		logMsg := fmt.Sprintf("Error sending Read RPC to node %d: %v", server, err)
-		r.logPutLocked(logMsg, PURPLE)
+		r.logEventLocked(slog.LevelWarn, "Read RPC failed", "peer", server, "err", err)
+		r.setPeerReachableLocked(server, false, err)
 		r.rpcConns[server] = nil
 		r.mu.Unlock()
 		r.dialRPCToPeer(server)
@@ -153,8 +381,6 @@ func (r *Raft) sendRead(server int) bool {
 	return reply.Success
 }
 
-func (r *Raft) persistState() {
-	if err := r.storage.SaveState(r.currentTerm, r.votedFor); err != nil {
-		fmt.Printf("Error persisting state: %v\n", err)
-	}
+func (r *Raft) persistState() error {
+	return r.storage.SaveState(r.currentTerm, r.votedFor)
 }
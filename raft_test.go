@@ -0,0 +1,96 @@
+package raft
+
+import (
+	"io"
+	"log/slog"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestNode returns a node of a three-node cluster that is not running:
+// no listeners or goroutines, only its log and storage in a temporary
+// directory, so tests can drive its methods directly. The log holds entries
+// after the dummy entry; storage is left empty.
+func newTestNode(t *testing.T, sm StateMachine, entries ...LogEntry) *Raft {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	storage, err := NewStorage(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	r := &Raft{
+		log:              append([]LogEntry{{}}, entries...),
+		commitIndex:      -1,
+		lastApplied:      -1,
+		nextIndex:        make(map[int]int),
+		matchIndex:       map[int]int{1: 0, 2: 0, 3: 0},
+		me:               1,
+		state:            FOLLOWER,
+		votedFor:         NOTVOTED,
+		clusterSize:      3,
+		sm:               sm,
+		pendingResponses: make(map[int]*ApplyFuture),
+		mu:               sync.RWMutex{},
+		peerIPPort:       map[int]string{1: "n1", 2: "n2", 3: "n3"},
+		storage:          storage,
+		rpcConns:         make(map[int]*rpc.Client),
+		logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		leaderID:         -1,
+		durableIndex:     len(entries),
+		sessions:         newSessionTable(0),
+		peerReachable:    make(map[int]bool),
+		observers:        make(map[*Observer]struct{}),
+		shutdownCh:       make(chan struct{}),
+	}
+	r.commitCond = sync.NewCond(&r.mu)
+	return r
+}
+
+// newTestLeader returns a node that leads without running consensus: it
+// serves reads from kv at once and applies writes in order, each after delay,
+// so a read submitted while a write is in flight overtakes it as it can on
+// the quorum-read path.
+func newTestLeader(t *testing.T, kv *KVStore, delay time.Duration) *Raft {
+	t.Helper()
+	r := newTestNode(t, kv)
+	r.state, r.currentTerm, r.leaderID = LEADER, 1, 1
+	r.ReqCh = make(chan ClientRequest)
+	writes := make(chan ClientRequest, 128)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(writes)
+		for {
+			select {
+			case req := <-r.ReqCh:
+				if !req.read {
+					writes <- req
+					continue
+				}
+				value, err := kv.Query(req.Command)
+				req.future.respond(Response{value: value, err: err})
+			case <-r.shutdownCh:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		index := 0
+		for req := range writes {
+			time.Sleep(delay)
+			index++
+			res := kv.ApplyBatch([]CommittedEntry{{Index: uint64(index), Timestamp: time.Now().UnixMilli(), Command: req.Command}})[0]
+			req.future.respond(Response{value: res.Value, err: res.Err, index: index, term: 1})
+		}
+	}()
+	t.Cleanup(func() {
+		close(r.shutdownCh)
+		wg.Wait()
+	})
+	return r
+}
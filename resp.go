@@ -0,0 +1,404 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// RESP_MAX_ARGS bounds the number of arguments of one RESP command.
+	RESP_MAX_ARGS = 1024
+	// RESP_MAX_BULK bounds the size of one bulk string argument.
+	RESP_MAX_BULK = 1 << 20
+	// RESP_PIPELINE_DEPTH is how many commands of one connection may be in
+	// flight before the node stops reading from it.
+	RESP_PIPELINE_DEPTH = 128
+)
+
+// respPending is a command whose reply is still being computed. Calling it
+// blocks until the encoded reply is ready.
+type respPending func() []byte
+
+// respConn is the state of one RESP connection. Its commands must take
+// effect in order, but reads and writes take different paths: a read
+// submitted before an earlier write is applied could miss it, and a write
+// applied before an earlier read is served could be seen by it. Such a
+// command is delayed until the replies before it have been written, and so
+// is every command after it until the delayed ones have completed.
+type respConn struct {
+	lastWrite []*ApplyFuture // the latest write submitted right away
+	lastRead  []*ApplyFuture // the latest read submitted right away
+	delayed   atomic.Int32   // delayed commands not yet completed
+}
+
+func (r *Raft) listenRESP() {
+	r.logger.Info("Serving RESP", "addr", r.respListener.Addr().String())
+	for {
+		conn, err := r.respListener.Accept()
+		if err != nil {
+			select {
+			case <-r.shutdownCh:
+				return
+			default:
+			}
+			r.logger.Warn("Failed to accept RESP connection", "err", err)
+			continue
+		}
+
+		r.mu.Lock()
+		if r.shutdown {
+			r.mu.Unlock()
+			conn.Close()
+			return
+		}
+		r.inboundConns[conn] = struct{}{}
+		r.mu.Unlock()
+
+		r.goFunc(func() {
+			r.serveRESPConn(conn)
+			r.mu.Lock()
+			delete(r.inboundConns, conn)
+			r.mu.Unlock()
+		})
+	}
+}
+
+// serveRESPConn reads commands from conn and writes their replies in order.
+// Commands are submitted as soon as they are read, so the writes of a
+// pipeline share the leader's batches.
+func (r *Raft) serveRESPConn(conn net.Conn) {
+	defer conn.Close()
+	pending := make(chan respPending, RESP_PIPELINE_DEPTH)
+	written := make(chan struct{})
+	r.goFunc(func() {
+		defer close(written)
+		w := bufio.NewWriter(conn)
+		for reply := range pending {
+			w.Write(reply())
+			if len(pending) == 0 {
+				if err := w.Flush(); err != nil {
+					conn.Close()
+				}
+			}
+		}
+		w.Flush()
+	})
+	defer func() {
+		close(pending)
+		<-written
+	}()
+
+	rd := bufio.NewReader(conn)
+	c := &respConn{}
+	for {
+		args, err := readRESPCommand(rd)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				pending <- respReady(respError("ERR Protocol error: " + err.Error()))
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(args[0])
+		pending <- r.dispatchRESP(c, name, args[1:])
+		if name == "QUIT" {
+			return
+		}
+	}
+}
+
+// dispatchRESP starts executing a command and returns its pending reply.
+func (r *Raft) dispatchRESP(c *respConn, name string, args []string) respPending {
+	switch name {
+	case "PING":
+		switch len(args) {
+		case 0:
+			return respReady(respSimple("PONG"))
+		case 1:
+			return respReady(respBulk(args[0]))
+		}
+	case "ECHO":
+		if len(args) == 1 {
+			return respReady(respBulk(args[0]))
+		}
+	case "QUIT", "SELECT":
+		return respReady(respSimple("OK"))
+	case "COMMAND", "CONFIG":
+		// Enough for clients such as redis-benchmark that probe the server.
+		return respReady(respArray(nil))
+	case "GET":
+		if len(args) == 1 {
+			return r.respRead(c, args, func(results []KVResult) []byte {
+				return respValue(results[0])
+			})
+		}
+	case "MGET":
+		if len(args) >= 1 {
+			return r.respRead(c, args, func(results []KVResult) []byte {
+				items := make([][]byte, len(results))
+				for i, res := range results {
+					items[i] = respValue(res)
+				}
+				return respArray(items)
+			})
+		}
+	case "EXISTS":
+		if len(args) >= 1 {
+			return r.respRead(c, args, func(results []KVResult) []byte {
+				return respInt(countFound(results))
+			})
+		}
+	case "DBSIZE":
+		if len(args) == 0 {
+			return r.respSubmit(c, [][]byte{CountCommand(nil, nil)}, true, func(results []KVResult) []byte {
+				return respInt(int(results[0].Count))
+			})
+		}
+	case "SET":
+		if len(args) == 2 {
+			return r.respWrite(c, [][]byte{SetCommand([]byte(args[0]), []byte(args[1]))}, func([]KVResult) []byte {
+				return respSimple("OK")
+			})
+		}
+	case "SETNX":
+		if len(args) == 2 {
+			return r.respWrite(c, [][]byte{SetIfAbsentCommand([]byte(args[0]), []byte(args[1]))}, func(results []KVResult) []byte {
+				if results[0].OK {
+					return respInt(1)
+				}
+				return respInt(0)
+			})
+		}
+	case "MSET":
+		if len(args) >= 2 && len(args)%2 == 0 {
+			var txn KVTxn
+			for i := 0; i < len(args); i += 2 {
+				txn.Success = append(txn.Success, KVCommand{Op: KVSet, Key: []byte(args[i]), Value: []byte(args[i+1])})
+			}
+			return r.respWrite(c, [][]byte{TxnCommand(txn)}, func([]KVResult) []byte {
+				return respSimple("OK")
+			})
+		}
+	case "DEL":
+		if len(args) >= 1 {
+			var txn KVTxn
+			for _, key := range args {
+				txn.Success = append(txn.Success, KVCommand{Op: KVDelete, Key: []byte(key)})
+			}
+			return r.respWrite(c, [][]byte{TxnCommand(txn)}, func(results []KVResult) []byte {
+				return respInt(countFound(results[0].Results))
+			})
+		}
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		delta := int64(1)
+		if name == "INCRBY" || name == "DECRBY" {
+			if len(args) != 2 {
+				break
+			}
+			var err error
+			if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return respReady(respError("ERR value is not an integer or out of range"))
+			}
+		} else if len(args) != 1 {
+			break
+		}
+		if name == "DECR" || name == "DECRBY" {
+			delta = -delta
+		}
+		return r.respWrite(c, [][]byte{IncrCommand([]byte(args[0]), delta)}, func(results []KVResult) []byte {
+			return []byte(":" + string(results[0].Value) + "\r\n")
+		})
+	default:
+		return respReady(respError(fmt.Sprintf("ERR unknown command '%s'", name)))
+	}
+	return respReady(respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))))
+}
+
+// respRead queries the value of every key through the quorum-read path.
+func (r *Raft) respRead(c *respConn, keys []string, reply func(results []KVResult) []byte) respPending {
+	cmds := make([][]byte, len(keys))
+	for i, key := range keys {
+		cmds[i] = GetCommand([]byte(key))
+	}
+	return r.respSubmit(c, cmds, true, reply)
+}
+
+// respWrite proposes cmds, one log entry each. Multi-key commands are sent
+// as a single transaction, so they are atomic.
+func (r *Raft) respWrite(c *respConn, cmds [][]byte, reply func(results []KVResult) []byte) respPending {
+	return r.respSubmit(c, cmds, false, reply)
+}
+
+func (r *Raft) respSubmit(c *respConn, cmds [][]byte, read bool, reply func(results []KVResult) []byte) respPending {
+	ctx, cancel := context.WithTimeout(context.Background(), EXECUTE_TIMEOUT)
+	futures := make([]*ApplyFuture, len(cmds))
+	submit := func() {
+		for i, cmd := range cmds {
+			futures[i] = r.submit(ctx, ClientRequest{Command: cmd, read: read})
+		}
+	}
+	conflicting := c.lastRead
+	if read {
+		conflicting = c.lastWrite
+	}
+	delayed := c.delayed.Load() > 0 || !allDone(conflicting)
+	if delayed {
+		c.delayed.Add(1)
+	} else {
+		submit()
+		if read {
+			c.lastRead = futures
+		} else {
+			c.lastWrite = futures
+		}
+	}
+	return func() []byte {
+		defer cancel()
+		if delayed {
+			defer c.delayed.Add(-1)
+			submit()
+		}
+		results := make([]KVResult, len(futures))
+		for i, f := range futures {
+			resp, err := f.wait(ctx)
+			if err == nil {
+				results[i], err = DecodeKVResult(resp.value)
+			}
+			if err != nil {
+				return r.respErrorFor(err)
+			}
+		}
+		return reply(results)
+	}
+}
+
+func allDone(futures []*ApplyFuture) bool {
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// respErrorFor encodes err. A follower answers with a Redis Cluster style
+// MOVED error pointing at the leader's RESP address.
+func (r *Raft) respErrorFor(err error) []byte {
+	var notLeader *NotLeaderError
+	if errors.As(err, &notLeader) {
+		if addr, ok := r.peerRESP[notLeader.LeaderID]; ok {
+			return respError("MOVED 0 " + addr)
+		}
+		if notLeader.LeaderID == -1 {
+			return respError("CLUSTERDOWN no leader is known")
+		}
+	}
+	return respError("ERR " + err.Error())
+}
+
+func respReady(reply []byte) respPending {
+	return func() []byte { return reply }
+}
+
+// readRESPCommand reads one command, either a RESP array of bulk strings or
+// an inline command. It returns no arguments for an empty inline command.
+func readRESPCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > RESP_MAX_ARGS {
+		return nil, fmt.Errorf("invalid multibulk length %q", line[1:])
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, fmt.Errorf("invalid bulk length %q", line[1:])
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, errors.New("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readRESPLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errors.New("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func respSimple(s string) []byte {
+	return []byte("+" + s + "\r\n")
+}
+
+func respError(s string) []byte {
+	return []byte("-" + s + "\r\n")
+}
+
+func respInt(n int) []byte {
+	return []byte(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func respBulk(s string) []byte {
+	return []byte("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+// respValue encodes the value read by a GET, or nil for a missing key.
+func respValue(res KVResult) []byte {
+	if !res.Found {
+		return []byte("$-1\r\n")
+	}
+	return respBulk(string(res.Value))
+}
+
+func countFound(results []KVResult) int {
+	n := 0
+	for _, res := range results {
+		if res.Found {
+			n++
+		}
+	}
+	return n
+}
+
+func respArray(items [][]byte) []byte {
+	out := []byte("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"array", "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nv a\r\n\r\n", []string{"SET", "k", "v a\r\n"}},
+		{"binary value", "*2\r\n$3\r\nGET\r\n$3\r\n\x00\r\x01\r\n", []string{"GET", "\x00\r\x01"}},
+		{"empty bulk", "*2\r\n$3\r\nGET\r\n$0\r\n\r\n", []string{"GET", ""}},
+		{"empty array", "*0\r\n", []string{}},
+		{"inline", "PING  hello\r\n", []string{"PING", "hello"}},
+		{"inline without CR", "GET k\n", []string{"GET", "k"}},
+		{"empty inline", "\r\n", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The whole command at once, and one byte per read as a slow
+			// client would send it.
+			for _, r := range []io.Reader{strings.NewReader(tt.input), iotest.OneByteReader(strings.NewReader(tt.input))} {
+				got, err := readRESPCommand(bufio.NewReader(r))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("got %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadRESPCommandPipelined(t *testing.T) {
+	rd := bufio.NewReader(iotest.HalfReader(strings.NewReader("*1\r\n$4\r\nPING\r\nGET k\r\n*2\r\n$3\r\nDEL\r\n$1\r\nk\r\n")))
+	for _, want := range [][]string{{"PING"}, {"GET", "k"}, {"DEL", "k"}} {
+		got, err := readRESPCommand(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := readRESPCommand(rd); err != io.EOF {
+		t.Fatalf("after the last command got %v, want io.EOF", err)
+	}
+}
+
+func TestReadRESPCommandErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string // substring; empty for io.ErrUnexpectedEOF
+	}{
+		{"bulk too large", fmt.Sprintf("*1\r\n$%d\r\n", RESP_MAX_BULK+1), "invalid bulk length"},
+		{"negative bulk", "*1\r\n$-1\r\n", "invalid bulk length"},
+		{"too many args", fmt.Sprintf("*%d\r\n", RESP_MAX_ARGS+1), "invalid multibulk length"},
+		{"bad array length", "*x\r\n", "invalid multibulk length"},
+		{"not a bulk", "*1\r\n:1\r\n", "expected '$'"},
+		{"missing CRLF", "*1\r\n$2\r\nabcd", "not terminated by CRLF"},
+		{"line too long", strings.Repeat("a", 8192) + "\r\n", "line too long"},
+		{"cut in bulk", "*1\r\n$5\r\nab", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readRESPCommand(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.wantErr == "" {
+				if err != io.ErrUnexpectedEOF {
+					t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadRESPCommandMaxBulk(t *testing.T) {
+	value := strings.Repeat("v", RESP_MAX_BULK)
+	input := fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(value), value)
+	got, err := readRESPCommand(bufio.NewReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1] != value {
+		t.Fatalf("a bulk string of RESP_MAX_BULK bytes was not read whole")
+	}
+}
+
+// dispatchAll dispatches cmds as one pipeline on a connection and returns
+// their replies in order.
+func dispatchAll(r *Raft, cmds ...[]string) []string {
+	c := &respConn{}
+	pending := make([]respPending, len(cmds))
+	for i, cmd := range cmds {
+		pending[i] = r.dispatchRESP(c, cmd[0], cmd[1:])
+	}
+	replies := make([]string, len(cmds))
+	for i, p := range pending {
+		replies[i] = string(p())
+	}
+	return replies
+}
+
+func TestDispatchRESPKeepsPipelineOrder(t *testing.T) {
+	// Writes take a while to apply; reads would overtake them.
+	r := newTestLeader(t, NewKVStore(), 20*time.Millisecond)
+	for _, tt := range []struct {
+		name string
+		cmds [][]string
+		want []string
+	}{
+		{"read after write", [][]string{{"SET", "a", "1"}, {"GET", "a"}},
+			[]string{"+OK\r\n", "$1\r\n1\r\n"}},
+		{"write between reads", [][]string{{"GET", "b"}, {"SET", "b", "2"}, {"GET", "b"}},
+			[]string{"$-1\r\n", "+OK\r\n", "$1\r\n2\r\n"}},
+		{"reads after several writes", [][]string{{"SET", "c", "1"}, {"INCR", "c"}, {"MGET", "a", "c"}, {"DEL", "c"}, {"EXISTS", "c"}},
+			[]string{"+OK\r\n", ":2\r\n", "*2\r\n$1\r\n1\r\n$1\r\n2\r\n", ":1\r\n", ":0\r\n"}},
+	} {
+		if got := dispatchAll(r, tt.cmds...); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: replies %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
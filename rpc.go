@@ -1,8 +1,17 @@
 package raft
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/rpc"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -10,48 +19,74 @@ const (
 	RequestVote   = "Raft.RequestVote"
 	Read          = "Raft.Read"
 	Execute       = "Raft.Execute"
+	Status        = "Raft.Status"
+	Admin         = "Raft.Admin"
+	TimeoutNow    = "Raft.TimeoutNow"
 )
 
 type ExecuteArgs struct {
-	Command []byte
+	Command  []byte
+	Read     bool   // serve through the quorum-read path instead of the log
+	ClientID uint64 // client session for safe retries of writes, 0 if none
+	Seq      uint64 // increases with every new command of the session; reused on retry
+	// TraceContext carries the caller's trace context (see TracePropagator).
+	TraceContext map[string]string
 }
 
 type ExecuteReply struct {
-	Success  bool
-	Value    []byte
-	IsLeader bool
-	LeaderID int // -1 if unknown
+	Success bool
+	Value   []byte
+	Index   uint64 // log index the command was committed at (writes only)
+	// CommitIndex is the leader's commit index when it answered, -1 if
+	// nothing is committed yet.
+	CommitIndex int
+	IsLeader    bool
+	LeaderID    int    // -1 if unknown
+	Error       string // set when the leader could not process the command
 }
 
-func (r *Raft) Execute(args *ExecuteArgs, reply *ExecuteReply) error {
-	r.mu.RLock()
-	isLeader := r.state == LEADER
-	leaderID := r.leaderID
-	r.mu.RUnlock()
+// EXECUTE_TIMEOUT bounds how long the Execute RPC waits for a result.
+const EXECUTE_TIMEOUT = 5 * time.Second
 
-	if !isLeader {
-		reply.IsLeader = false
-		reply.LeaderID = leaderID
-		return nil
+func (r *Raft) Execute(args *ExecuteArgs, reply *ExecuteReply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), EXECUTE_TIMEOUT)
+	defer cancel()
+	if r.tracer != nil {
+		ctx = TracePropagator.Extract(ctx, propagation.MapCarrier(args.TraceContext))
+		var span trace.Span
+		ctx, span = r.tracer.Start(ctx, "raft.Execute", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.Bool("raft.read", args.Read)))
+		defer span.End()
 	}
 
-	reply.IsLeader = true
 	req := ClientRequest{
 		Command: args.Command,
-		RespCh:  make(chan Response, 1),
+		read:    args.Read,
+		session: args.ClientID,
+		seq:     args.Seq,
 	}
-
-	select {
-	case r.ReqCh <- req:
-	case <-time.After(5 * time.Second):
+	resp, err := r.submit(ctx, req).wait(ctx)
+	var notLeader *NotLeaderError
+	switch {
+	case errors.As(err, &notLeader):
+		reply.IsLeader = false
+		reply.LeaderID = notLeader.LeaderID
 		return nil
+	case err == ErrShutdown:
+		return err
 	}
 
-	select {
-	case resp := <-req.RespCh:
-		reply.Success = resp.success
-		reply.Value = resp.value
-	case <-time.After(5 * time.Second):
+	reply.IsLeader = true
+	reply.Success = resp.success
+	reply.Value = resp.value
+	reply.Index = uint64(resp.index)
+	r.mu.RLock()
+	reply.CommitIndex = r.commitIndex
+	r.mu.RUnlock()
+	if err != nil {
+		reply.Success = false
+		reply.Error = err.Error()
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, err.Error())
 	}
 	return nil
 }
@@ -97,6 +132,9 @@ type RequestVoteReply struct {
 func (r *Raft) Read(args *ReadArgs, reply *ReadReply) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.shutdown {
+		return ErrShutdown
+	}
 
 	if r.currentTerm <= args.Term {
 		reply.Success = true
@@ -109,12 +147,15 @@ func (r *Raft) Read(args *ReadArgs, reply *ReadReply) error {
 func (r *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.shutdown {
+		return ErrShutdown
+	}
 	//0. If term > currentTerm, set currentTerm = term, convert to follower
 	if r.currentTerm < args.Term {
-		r.currentTerm = args.Term
-		r.state = FOLLOWER
-		r.votedFor = NOTVOTED
-		r.persistState()
+		r.becomeFollowerLocked(args.Term)
+		if err := r.persistState(); err != nil {
+			return fmt.Errorf("persist state: %w", err)
+		}
 	}
 	//1. Reply false if term < currentTerm
 	if args.Term < r.currentTerm {
@@ -147,11 +188,14 @@ func (r *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply)
 		logIndex := args.PrevLogIndex + 1 + i
 		if logIndex < len(r.log) {
 			if r.log[logIndex].Term != entry.Term {
-				r.log = r.log[:logIndex]
+				// Storage first, so that memory still matches it if it fails.
 				// storage index is logIndex - 1 because r.log has dummy entry at 0
 				if err := r.storage.TruncateLog(logIndex - 1); err != nil {
-					fmt.Printf("Error truncating log: %v\n", err)
+					return fmt.Errorf("truncate log: %w", err)
 				}
+				r.log = r.log[:logIndex]
+				r.durableIndex = min(r.durableIndex, logIndex-1)
+				r.failPendingFromLocked(logIndex, ErrEntryOverwritten)
 				break
 			}
 		}
@@ -167,8 +211,14 @@ func (r *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply)
 	}
 	if len(newEntries) > 0 {
 		if err := r.storage.AppendEntries(newEntries); err != nil {
-			fmt.Printf("Error appending entries: %v\n", err)
+			// Forget what could not be persisted so that it is neither
+			// acknowledged now nor counted as present later.
+			if rbErr := r.rollbackLogLocked(r.durableIndex + 1); rbErr != nil {
+				return fmt.Errorf("append entries: %w (then %w)", err, rbErr)
+			}
+			return fmt.Errorf("append entries: %w", err)
 		}
+		r.durableIndex = len(r.log) - 1
 	}
 	//5. If leaderCommit > commitIndex, set commitIndex = min(leaderCommit, index of last new entry)
 	if r.commitIndex < args.LeaderCommit {
@@ -180,7 +230,7 @@ func (r *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply)
 		}
 		r.commitCond.Broadcast()
 	}
-	r.leaderID = args.LeaderID
+	r.setLeaderLocked(args.LeaderID)
 	reply.Term = r.currentTerm
 	reply.Success = true
 	select {
@@ -193,7 +243,10 @@ func (r *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply)
 func (r *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.logPutLocked("Received RequestVote RPC", CYAN)
+	if r.shutdown {
+		return ErrShutdown
+	}
+	r.logEventLocked(slog.LevelDebug, "Received RequestVote", "candidate", args.CandidateID, "candidate_term", args.Term)
 	//0. If term > currentTerm, set currentTerm = term, convert to follower
 	//1. Reply false if term < currentTerm
 	if args.Term < r.currentTerm {
@@ -201,9 +254,10 @@ func (r *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error
 		reply.VoteGranted = false
 		return nil
 	} else if r.currentTerm < args.Term {
-		r.votedFor = NOTVOTED
-		r.currentTerm = args.Term
-		r.state = FOLLOWER
+		r.becomeFollowerLocked(args.Term)
+		if err := r.persistState(); err != nil {
+			return fmt.Errorf("persist state: %w", err)
+		}
 	}
 
 	if r.currentTerm == args.Term && r.votedFor != NOTVOTED && r.votedFor != args.CandidateID {
@@ -218,7 +272,11 @@ func (r *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error
 	upToDate := (lastLogTerm < args.LastLogTerm) || (args.LastLogTerm == lastLogTerm && lastLogIndex <= args.LastLogIndex)
 	if (r.votedFor == NOTVOTED || r.votedFor == args.CandidateID) && upToDate {
 		r.votedFor = args.CandidateID
-		r.state = FOLLOWER
+		r.setStateLocked(FOLLOWER)
+		// The vote must be durable before it is granted.
+		if err := r.persistState(); err != nil {
+			return fmt.Errorf("persist state: %w", err)
+		}
 		reply.VoteGranted = true
 	} else {
 		reply.VoteGranted = false
@@ -249,13 +307,27 @@ func (r *Raft) sendAppendEntries(server int) bool {
 		Entries:      entries,
 		LeaderCommit: r.commitIndex,
 	}
+	traced := r.tracedFuturesLocked(args.PrevLogIndex + 1)
 	r.mu.Unlock()
 
 	reply := &AppendEntriesReply{}
-	if err := client.Call(AppendEntries, args, reply); err != nil {
+	start := time.Now()
+	err := client.Call(AppendEntries, args, reply)
+	r.metrics.observeRPC("AppendEntries", server, time.Since(start))
+	for _, f := range traced {
+		r.recordSpan(f, "raft.AppendEntries", start, time.Now(), err,
+			attribute.Int("raft.peer", server), attribute.Int("raft.entries", len(args.Entries)))
+	}
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); ok {
+			// The peer is reachable but failed to handle the request,
+			// e.g. because its storage rejected the write.
+			r.logEvent(slog.LevelWarn, "AppendEntries rejected", "peer", server, "err", err)
+			return false
+		}
 		r.mu.Lock()
-		logMsg := fmt.Sprintf("Error sending AppendEntries RPC to node %d: %v", server, err)
-		r.logPutLocked(logMsg, PURPLE)
+		r.logEventLocked(slog.LevelWarn, "AppendEntries RPC failed", "peer", server, "err", err)
+		r.setPeerReachableLocked(server, false, err)
 		r.rpcConns[server] = nil
 		r.mu.Unlock()
 		r.dialRPCToPeer(server)
@@ -277,9 +349,7 @@ func (r *Raft) sendAppendEntries(server int) bool {
 		r.nextIndex[server] = max(1, r.nextIndex[server]-1)
 	}
 	if r.currentTerm < reply.Term {
-		r.currentTerm = reply.Term
-		r.state = FOLLOWER
-		r.votedFor = NOTVOTED
+		r.becomeFollowerLocked(reply.Term)
 	}
 	return reply.Success
 }
@@ -301,10 +371,13 @@ func (r *Raft) sendRequestVote(server int) bool {
 	r.mu.Unlock()
 
 	reply := &RequestVoteReply{}
-	if err := client.Call(RequestVote, args, reply); err != nil {
+	start := time.Now()
+	err := client.Call(RequestVote, args, reply)
+	r.metrics.observeRPC("RequestVote", server, time.Since(start))
+	if err != nil {
 		r.mu.Lock()
-		logMsg := fmt.Sprintf("Error sending RequestVote RPC to node %d: %v", server, err)
-		r.logPutLocked(logMsg, PURPLE)
+		r.logEventLocked(slog.LevelWarn, "RequestVote RPC failed", "peer", server, "err", err)
+		r.setPeerReachableLocked(server, false, err)
 		r.rpcConns[server] = nil
 		r.mu.Unlock()
 		r.dialRPCToPeer(server)
@@ -319,9 +392,7 @@ func (r *Raft) sendRequestVote(server int) bool {
 	}
 
 	if r.currentTerm < reply.Term {
-		r.currentTerm = reply.Term
-		r.state = FOLLOWER
-		r.votedFor = NOTVOTED
+		r.becomeFollowerLocked(reply.Term)
 	}
 	return reply.VoteGranted
 }
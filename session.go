@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SESSION_TTL = 1 * time.Hour
+	// Expired sessions are dropped whenever the applier reaches a log index
+	// that is a multiple of SESSION_SWEEP_INTERVAL.
+	SESSION_SWEEP_INTERVAL = 1024
+)
+
+type clientSession struct {
+	lastSeq    uint64
+	lastResult []byte
+	lastErr    error
+	lastActive int64 // Timestamp of the session's latest entry
+}
+
+// sessionTable remembers, per client, the last applied sequence number and
+// its result so that a retried write is answered from the cache instead of
+// being applied twice. It is part of the replicated state: it only changes as
+// entries are applied and uses their leader-assigned timestamps as its clock,
+// so every node expires the same sessions at the same point in the log. The
+// log is never compacted into a snapshot, so a restarted node rebuilds the
+// table by replaying the whole log.
+type sessionTable struct {
+	mu       sync.Mutex
+	ttl      int64 // milliseconds
+	sessions map[uint64]*clientSession
+}
+
+func newSessionTable(ttl time.Duration) *sessionTable {
+	if ttl <= 0 {
+		ttl = DEFAULT_SESSION_TTL
+	}
+	return &sessionTable{ttl: ttl.Milliseconds(), sessions: make(map[uint64]*clientSession)}
+}
+
+// lookup reports whether entry was already applied, and if so the result to
+// answer it with. A session idle for longer than the TTL is treated as new.
+func (t *sessionTable) lookup(entry LogEntry) ([]byte, error, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sessions[entry.ClientID]
+	if !ok || t.expired(s.lastActive, entry.Timestamp) {
+		return nil, nil, false
+	}
+	switch {
+	case entry.Seq == s.lastSeq:
+		return s.lastResult, s.lastErr, true
+	case entry.Seq < s.lastSeq:
+		return nil, ErrStaleSequence, true
+	}
+	return nil, nil, false
+}
+
+// record stores the outcome of applying entry as its session's latest.
+func (t *sessionTable) record(entry LogEntry, result []byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[entry.ClientID] = &clientSession{
+		lastSeq:    entry.Seq,
+		lastResult: result,
+		lastErr:    err,
+		lastActive: entry.Timestamp,
+	}
+}
+
+// expired reports whether a session last active at lastActive has expired as
+// of now. Both are entry timestamps, never the local clock.
+func (t *sessionTable) expired(lastActive, now int64) bool {
+	return now-lastActive > t.ttl
+}
+
+// sweep drops the sessions that have expired as of now.
+func (t *sessionTable) sweep(now int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, s := range t.sessions {
+		if t.expired(s.lastActive, now) {
+			delete(t.sessions, id)
+		}
+	}
+}
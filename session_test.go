@@ -0,0 +1,146 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type appliedOutcome struct {
+	value string
+	err   error
+}
+
+// applyEntries appends entries to r's log and applies them in batches of
+// batchSize (or one at a time with Apply if batchSize is 0), returning each
+// entry's outcome as its submitter would see it.
+func applyEntries(t *testing.T, r *Raft, entries []LogEntry, batchSize int) []appliedOutcome {
+	t.Helper()
+	start := len(r.log)
+	futures := make([]*ApplyFuture, len(entries))
+	for i, e := range entries {
+		r.log = append(r.log, e)
+		futures[i] = newApplyFuture(nil)
+		futures[i].term = e.Term
+		r.pendingResponses[start+i] = futures[i]
+	}
+	if batchSize == 0 {
+		for i, e := range entries {
+			r.applyCommand(e, start+i)
+		}
+	} else {
+		for i := 0; i < len(entries); i += batchSize {
+			end := min(i+batchSize, len(entries))
+			r.applyBatch(r.sm.(BatchApplier), entries[i:end], start+i)
+		}
+	}
+	outcomes := make([]appliedOutcome, len(entries))
+	for i, f := range futures {
+		if err := f.Error(); err != nil {
+			outcomes[i].err = err
+			continue
+		}
+		res, err := DecodeKVResult(f.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcomes[i].value = string(res.Value)
+	}
+	return outcomes
+}
+
+func incr(clientID, seq uint64, ts int64) LogEntry {
+	return LogEntry{Term: 1, Command: IncrCommand([]byte("n"), 1), ClientID: clientID, Seq: seq, Timestamp: ts}
+}
+
+func counter(t *testing.T, kv *KVStore) string {
+	t.Helper()
+	buf, err := kv.Query(GetCommand([]byte("n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := DecodeKVResult(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(res.Value)
+}
+
+func TestSessionDeduplicatesRetries(t *testing.T) {
+	entries := []LogEntry{
+		incr(7, 1, 0),
+		incr(7, 1, 1), // retry of the first, in the same batch
+		incr(0, 0, 2), // no session: always applied
+		incr(7, 2, 3),
+		incr(8, 1, 4),
+		incr(7, 2, 5), // retry of seq 2, in a later batch
+		incr(7, 1, 6), // older than the session's last applied
+	}
+	want := []appliedOutcome{{"1", nil}, {"1", nil}, {"2", nil}, {"3", nil}, {"4", nil}, {"3", nil}, {"", ErrStaleSequence}}
+	for _, batchSize := range []int{0, 1, 2, 3, len(entries)} {
+		t.Run(fmt.Sprintf("batch size %d", batchSize), func(t *testing.T) {
+			kv := NewKVStore()
+			r := newTestNode(t, kv)
+			got := applyEntries(t, r, entries, batchSize)
+			for i := range want {
+				if got[i].value != want[i].value || !errors.Is(got[i].err, want[i].err) {
+					t.Fatalf("entry %d: got %+v, want %+v", i, got[i], want[i])
+				}
+			}
+			if n := counter(t, kv); n != "4" {
+				t.Fatalf("counter = %s after 4 distinct increments", n)
+			}
+		})
+	}
+}
+
+func TestSessionReplayRebuildsTable(t *testing.T) {
+	// A node that applied the log before a restart and one replaying it
+	// afterwards in different batches must end in the same state and
+	// answer a retry that arrives after the restart from the cache.
+	entries := []LogEntry{incr(7, 1, 0), incr(7, 2, 1), incr(9, 1, 2), incr(7, 2, 3)}
+	before := NewKVStore()
+	first := newTestNode(t, before)
+	want := applyEntries(t, first, entries, 1)
+
+	kv := NewKVStore()
+	replayed := newTestNode(t, kv)
+	got := applyEntries(t, replayed, entries, len(entries))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("entry %d: replay got %+v, first run %+v", i, got[i], want[i])
+		}
+	}
+	if counter(t, kv) != "3" || counter(t, before) != "3" {
+		t.Fatalf("counter = %s after replay, %s before; want 3", counter(t, kv), counter(t, before))
+	}
+	got = applyEntries(t, replayed, []LogEntry{incr(7, 2, 4), incr(9, 2, 5)}, 2)
+	if got[0].value != "2" || got[1].value != "4" {
+		t.Fatalf("after replay got %+v, want the cached 2 and a new 4", got)
+	}
+}
+
+func TestSessionExpiresByEntryTimestamps(t *testing.T) {
+	ttl := time.Minute
+	kv := NewKVStore()
+	r := newTestNode(t, kv)
+	r.sessions = newSessionTable(ttl)
+	got := applyEntries(t, r, []LogEntry{
+		incr(7, 5, 0),
+		incr(7, 5, ttl.Milliseconds()),     // still within the TTL
+		incr(7, 5, 2*ttl.Milliseconds()+1), // idle too long: a new session
+		incr(7, 4, 2*ttl.Milliseconds()+2), // older than the new session's
+	}, 2)
+	want := []appliedOutcome{{"1", nil}, {"1", nil}, {"2", nil}, {"", ErrStaleSequence}}
+	for i := range want {
+		if got[i].value != want[i].value || !errors.Is(got[i].err, want[i].err) {
+			t.Fatalf("entry %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	r.sessions.sweep(4 * ttl.Milliseconds())
+	if len(r.sessions.sessions) != 0 {
+		t.Fatalf("%d sessions left after sweeping past their TTL", len(r.sessions.sessions))
+	}
+}
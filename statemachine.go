@@ -1,85 +1,630 @@
 package raft
 
-import "sync"
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/btree"
+	"go.opentelemetry.io/otel/attribute"
+)
 
 // StateMachine is the interface users implement to plug in custom state.
 // Apply is called after a log entry is committed (write path).
 // Query is called after quorum confirmation without touching the log (read path).
+// An error from Apply is the command's outcome, returned to its submitter: it
+// must be deterministic and leave the state unchanged, since every node
+// applies the same entry.
 type StateMachine interface {
-	Apply(cmd []byte) []byte
-	Query(cmd []byte) []byte
+	Apply(cmd []byte) ([]byte, error)
+	Query(cmd []byte) ([]byte, error)
+}
+
+// CommittedEntry is a committed log entry handed to a BatchApplier.
+type CommittedEntry struct {
+	Index     uint64
+	Term      uint64
+	Timestamp int64 // leader's clock (Unix ms) when the entry was appended
+	Command   []byte
+}
+
+// ApplyResult is the outcome of applying one entry with a BatchApplier.
+type ApplyResult struct {
+	Value []byte
+	Err   error
+}
+
+// BatchApplier is optionally implemented by a StateMachine to apply all the
+// entries committed together in one call, e.g. to take its lock or write to
+// disk once per batch. It returns one result per entry, in order, and is used
+// instead of Apply when present.
+type BatchApplier interface {
+	ApplyBatch(entries []CommittedEntry) []ApplyResult
+}
+
+// Ticker is optionally implemented by a StateMachine whose state changes
+// with time, e.g. to expire leases. The leader calls Tick every
+// TICK_INTERVAL and proposes the commands it returns, so every node applies
+// the change at the same point of the log. leaderSince is when this node
+// became leader; clocks of earlier leaders should not count against clients.
+type Ticker interface {
+	Tick(now, leaderSince time.Time) [][]byte
 }
 
-// KVStore is the built-in in-memory key-value state machine (SET/GET/DELETE).
+// KVStore is the built-in in-memory key-value state machine. It accepts the
+// binary commands built by SetCommand, GetCommand, CompareAndSwapCommand and
+// the other helpers, including atomic multi-key transactions (TxnCommand),
+// whose results are encoded KVResults, and the legacy text
+// commands "SET key value", "GET key" and "DELETE key". A legacy DELETE
+// returns "1" if the key existed and "0" otherwise. Malformed commands fail
+// with ErrInvalidCommand.
+//
+// Keys are kept in order, so RANGE and COUNT can scan a range or a prefix.
+// Every change is kept as a version of its key until COMPACT discards it, so
+// GET, RANGE and COUNT can also read the store as of a past revision.
+// Keys may be attached to a lease, which is granted, kept alive and revoked
+// through the log and deleted with its keys once its TTL passes without a
+// keep-alive. Expiry is decided by the leader's clock (see Ticker) and
+// applied as a log entry, so it happens at the same point on every node.
 type KVStore struct {
-	mu   sync.RWMutex
-	data map[string]string
+	mu        sync.RWMutex
+	data      map[string]kvEntry
+	versions  map[string][]kvVersion // every kept version of each key, oldest first
+	keys      *btree.BTreeG[string]  // the keys of versions, in order, for RANGE and COUNT
+	revision  uint64                 // bumped by every change
+	compacted uint64                 // reads before this revision are no longer possible
+	leases    map[uint64]*kvLease
+	lastLease uint64 // highest lease ID granted
+
+	changes     []WatchEvent // made by the entry being applied
+	history     []WatchEvent // the latest changes, see WATCH_HISTORY
+	historyLost uint64       // index of the latest entry whose changes left history
+	watchers    map[*Watcher]struct{}
+}
+
+type kvEntry struct {
+	value    string
+	revision uint64 // store revision of the key's last change
+	lease    uint64 // lease the key is attached to, 0 if none
+}
+
+type kvLease struct {
+	ttl      time.Duration
+	keys     map[string]struct{}
+	renewals uint64 // keep-alives applied, so an expiry can tell it is stale
+
+	// renewedAt is the timestamp of the entry that last granted or kept the
+	// lease alive, so it is the same on every node and after replay.
+	// expiring, local to this node, is when it last asked for the lease to
+	// be expired.
+	renewedAt time.Time
+	expiring  time.Time
 }
 
+const (
+	// MIN_LEASE_TTL is the shortest TTL a lease may be granted with.
+	MIN_LEASE_TTL = time.Second
+	// leaseExpireRetry is how long the leader waits for a proposed expiry
+	// before proposing it again.
+	leaseExpireRetry = time.Second
+	// MAX_RANGE_LIMIT is the most keys one RANGE returns.
+	MAX_RANGE_LIMIT = 10000
+)
+
 func NewKVStore() *KVStore {
-	return &KVStore{data: make(map[string]string)}
+	return &KVStore{
+		data:     make(map[string]kvEntry),
+		versions: make(map[string][]kvVersion),
+		keys:     btree.NewOrderedG[string](32),
+		leases:   make(map[uint64]*kvLease),
+		watchers: make(map[*Watcher]struct{}),
+	}
 }
 
-func (kv *KVStore) Apply(cmd []byte) []byte {
-	parts := splitCommand(string(cmd))
-	if len(parts) == 0 {
-		return nil
+func (kv *KVStore) Apply(cmd []byte) ([]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.applyLocked(cmd, 0, time.Now())
+}
+
+// ApplyBatch implements BatchApplier, taking the lock once for the batch. The
+// node always applies a KVStore through it, so watch events carry the index
+// of their entry and leases are renewed as of its timestamp; with Apply, which
+// has no entry, the index is 0 and the time is the local clock's.
+func (kv *KVStore) ApplyBatch(entries []CommittedEntry) []ApplyResult {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	results := make([]ApplyResult, len(entries))
+	for i, entry := range entries {
+		results[i].Value, results[i].Err = kv.applyLocked(entry.Command, entry.Index, time.UnixMilli(entry.Timestamp))
 	}
-	switch parts[0] {
-	case "SET":
-		if len(parts) != 3 {
-			return nil
-		}
-		kv.mu.Lock()
-		kv.data[parts[1]] = parts[2]
-		kv.mu.Unlock()
-	case "DELETE":
-		if len(parts) != 2 {
-			return nil
-		}
-		kv.mu.Lock()
-		delete(kv.data, parts[1])
-		kv.mu.Unlock()
+	return results
+}
+
+// applyLocked applies the entry at index, appended at time at, and publishes
+// its changes to watchers. A failed command leaves the state unchanged and
+// publishes none.
+func (kv *KVStore) applyLocked(cmd []byte, index uint64, at time.Time) ([]byte, error) {
+	c, text, err := decodeKVCommand(cmd)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if c.Op.isRead() {
+		return nil, fmt.Errorf("%w: %s is a read, not a write", ErrInvalidCommand, c.Op)
+	}
+	var res KVResult
+	if c.Op.isLease() {
+		res, err = kv.leaseLocked(c, at)
+	} else {
+		res, err = kv.execLocked(c)
+	}
+	if err != nil {
+		kv.changes = kv.changes[:0]
+		return nil, err
+	}
+	kv.publishLocked(index)
+	if text {
+		return legacyKVResult(c.Op, res), nil
+	}
+	return res.Encode(), nil
 }
 
-func (kv *KVStore) Query(cmd []byte) []byte {
-	parts := splitCommand(string(cmd))
-	if len(parts) != 2 || parts[0] != "GET" {
-		return nil
+func (kv *KVStore) Query(cmd []byte) ([]byte, error) {
+	c, text, err := decodeKVCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if !c.ReadOnly() {
+		return nil, fmt.Errorf("%w: %s is a write, not a read", ErrInvalidCommand, c.Op)
 	}
 	kv.mu.RLock()
-	val := kv.data[parts[1]]
+	res, err := kv.execLocked(c)
 	kv.mu.RUnlock()
-	return []byte(val)
+	if err != nil {
+		return nil, err
+	}
+	if text {
+		return legacyKVResult(c.Op, res), nil
+	}
+	return res.Encode(), nil
 }
 
-func (r *Raft) applyCommand(command []byte, index int) {
-	result := r.sm.Apply(command)
+// execLocked runs c. A failed condition is not an error: the result's OK is
+// false and it carries the key's current value and revision.
+func (kv *KVStore) execLocked(c KVCommand) (KVResult, error) {
+	switch {
+	case c.Op == KVCompact:
+		return kv.compactLocked(c.Revision)
+	case c.Op.isRead():
+		if err := kv.checkReadRevisionLocked(c.Revision); err != nil {
+			return KVResult{}, err
+		}
+	}
+	switch c.Op {
+	case KVRange:
+		return kv.rangeLocked(c), nil
+	case KVCount:
+		res := KVResult{OK: true, Revision: kv.readRevisionLocked(c.Revision)}
+		kv.ascendLocked(c.Key, c.End, func(key string) bool {
+			if _, ok := kv.entryAtLocked(key, c.Revision); ok {
+				res.Count++
+			}
+			return true
+		})
+		return res, nil
+	}
+	key := string(c.Key)
+	cur, found := kv.data[key]
+	if c.Op == KVGet {
+		cur, found = kv.entryAtLocked(key, c.Revision)
+	}
+	current := KVResult{Found: found, Value: []byte(cur.value), Revision: cur.revision, Lease: cur.lease}
+	if _, ok := kv.leases[c.Lease]; c.Lease != 0 && !ok {
+		return KVResult{}, fmt.Errorf("%w: %d", ErrLeaseNotFound, c.Lease)
+	}
+
+	switch c.Op {
+	case KVGet:
+		current.OK = true
+		return current, nil
+	case KVSet:
+		return kv.putLocked(key, string(c.Value), c.Lease, cur, found), nil
+	case KVDelete:
+		return kv.deleteLocked(key, cur, found), nil
+	case KVCompareAndSwap:
+		if !found || cur.value != string(c.Expect) {
+			return current, nil
+		}
+		return kv.putLocked(key, string(c.Value), c.Lease, cur, found), nil
+	case KVCompareRevisionAndSwap:
+		if cur.revision != c.Revision {
+			return current, nil
+		}
+		return kv.putLocked(key, string(c.Value), c.Lease, cur, found), nil
+	case KVSetIfAbsent:
+		if found {
+			return current, nil
+		}
+		return kv.putLocked(key, string(c.Value), c.Lease, cur, found), nil
+	case KVCompareAndDelete:
+		if !found || cur.value != string(c.Expect) {
+			return current, nil
+		}
+		return kv.deleteLocked(key, cur, found), nil
+	case KVCompareRevisionAndDelete:
+		if !found || cur.revision != c.Revision {
+			return current, nil
+		}
+		return kv.deleteLocked(key, cur, found), nil
+	case KVIncr:
+		var n int64
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(cur.value, 10, 64); err != nil {
+				return KVResult{}, fmt.Errorf("%w: %q", ErrNotInteger, cur.value)
+			}
+		}
+		if (c.Delta > 0 && n > math.MaxInt64-c.Delta) || (c.Delta < 0 && n < math.MinInt64-c.Delta) {
+			return KVResult{}, fmt.Errorf("%w: %d%+d overflows", ErrNotInteger, n, c.Delta)
+		}
+		// Like Redis, INCR keeps the key's lease.
+		return kv.putLocked(key, strconv.FormatInt(n+c.Delta, 10), cur.lease, cur, found), nil
+	case KVTransaction:
+		return kv.txnLocked(c.Txn)
+	}
+	return KVResult{}, fmt.Errorf("%w: unknown operation %s", ErrInvalidCommand, c.Op)
+}
 
-	resp := Response{
-		success: true,
-		value:   result,
+// txnLocked runs the ops of the branch of txn its compares select. If an op
+// fails, the changes of the ops before it are undone and the transaction
+// fails as a whole.
+func (kv *KVStore) txnLocked(txn *KVTxn) (KVResult, error) {
+	succeeded := true
+	for _, cmp := range txn.Compares {
+		if !kv.compareLocked(cmp) {
+			succeeded = false
+			break
+		}
+	}
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+	for _, op := range ops {
+		if op.Op == KVTransaction || op.Op == KVCompact || op.Op.isLease() {
+			return KVResult{}, fmt.Errorf("%w: %s cannot run in a transaction", ErrInvalidCommand, op.Op)
+		}
 	}
 
-	r.mu.Lock()
-	if r.state == LEADER {
-		ch, ok := r.pendingResponses[index]
-		if ok {
-			delete(r.pendingResponses, index)
-		}
-		r.mu.Unlock()
-		if ok {
-			select {
-			case ch <- resp:
-			default:
+	type saved struct {
+		entry kvEntry
+		found bool
+	}
+	undo := make(map[string]saved)
+	revision := kv.revision
+	results := make([]KVResult, len(ops))
+	for i, op := range ops {
+		key := string(op.Key)
+		if _, ok := undo[key]; !ok && op.Op != KVGet {
+			entry, found := kv.data[key]
+			undo[key] = saved{entry, found}
+		}
+		res, err := kv.execLocked(op)
+		if err != nil {
+			for key, s := range undo {
+				cur, found := kv.data[key]
+				kv.setLocked(key, cur, found, s.entry, s.found)
+				kv.trimVersionsLocked(key, revision)
 			}
+			kv.revision = revision
+			return KVResult{}, fmt.Errorf("%w (transaction op %d)", err, i)
 		}
+		results[i] = res
+	}
+	return KVResult{OK: succeeded, Results: results}, nil
+}
+
+func (kv *KVStore) compareLocked(pred KVCompare) bool {
+	cur, found := kv.data[string(pred.Key)]
+	var c int
+	if pred.Target == KVCompareRevision {
+		c = cmp.Compare(cur.revision, pred.Revision)
+	} else if !found {
+		return false
 	} else {
-		r.mu.Unlock()
+		c = strings.Compare(cur.value, string(pred.Value))
+	}
+	switch pred.Result {
+	case KVEqual:
+		return c == 0
+	case KVNotEqual:
+		return c != 0
+	case KVLess:
+		return c < 0
+	case KVGreater:
+		return c > 0
+	}
+	return false
+}
+
+func (kv *KVStore) putLocked(key, value string, lease uint64, cur kvEntry, found bool) KVResult {
+	kv.revision++
+	kv.setLocked(key, cur, found, kvEntry{value: value, revision: kv.revision, lease: lease}, true)
+	return KVResult{OK: true, Found: found, Value: []byte(value), Revision: kv.revision, Lease: lease}
+}
+
+func (kv *KVStore) deleteLocked(key string, cur kvEntry, found bool) KVResult {
+	if found {
+		kv.revision++
+		kv.setLocked(key, cur, found, kvEntry{}, false)
+	}
+	return KVResult{OK: true, Found: found}
+}
+
+// rangeLocked returns the keys c's range holds, up to its limit. If more
+// are left, the result's More is set and its Key is the first of them.
+func (kv *KVStore) rangeLocked(c KVCommand) KVResult {
+	limit := c.Limit
+	if limit == 0 || limit > MAX_RANGE_LIMIT {
+		limit = MAX_RANGE_LIMIT
+	}
+	res := KVResult{OK: true, Revision: kv.readRevisionLocked(c.Revision)}
+	kv.ascendLocked(c.Key, c.End, func(key string) bool {
+		e, ok := kv.entryAtLocked(key, c.Revision)
+		if !ok {
+			return true
+		}
+		if uint64(len(res.Results)) == limit {
+			res.More, res.Key = true, []byte(key)
+			return false
+		}
+		res.Results = append(res.Results, KVResult{
+			OK: true, Found: true, Key: []byte(key), Value: []byte(e.value), Revision: e.revision, Lease: e.lease,
+		})
+		return true
+	})
+	return res
+}
+
+// ascendLocked calls fn for each key from start up to but not including end
+// (empty: no bound), in order, until fn returns false.
+func (kv *KVStore) ascendLocked(start, end []byte, fn func(key string) bool) {
+	if len(end) == 0 {
+		kv.keys.AscendGreaterOrEqual(string(start), fn)
+		return
+	}
+	kv.keys.AscendRange(string(start), string(end), fn)
+}
+
+// setLocked replaces the entry cur of key, if found, with next, if ok, moves
+// the key between the leases of the two and records the change for watchers.
+func (kv *KVStore) setLocked(key string, cur kvEntry, found bool, next kvEntry, ok bool) {
+	ev := WatchEvent{Type: WatchPut, Key: []byte(key), Value: []byte(next.value), Revision: kv.revision, Lease: next.lease}
+	if !ok {
+		ev.Type, ev.Value = WatchDelete, nil
+	}
+	kv.changes = append(kv.changes, ev)
+	kv.recordVersionLocked(key, next, ok)
+
+	if found && cur.lease != 0 {
+		if l := kv.leases[cur.lease]; l != nil {
+			delete(l.keys, key)
+		}
+	}
+	if !ok {
+		delete(kv.data, key)
+		return
+	}
+	kv.data[key] = next
+	if next.lease != 0 {
+		kv.leases[next.lease].keys[key] = struct{}{}
+	}
+}
+
+// leaseLocked runs a lease command from an entry appended at time at. Its
+// result's Lease is the lease's ID and its OK whether the lease existed
+// (LEASE_GRANT: was created).
+func (kv *KVStore) leaseLocked(c KVCommand, at time.Time) (KVResult, error) {
+	l, found := kv.leases[c.Lease]
+	res := KVResult{Found: found, Lease: c.Lease}
+	switch c.Op {
+	case KVLeaseGrant:
+		if c.TTL < MIN_LEASE_TTL {
+			return KVResult{}, fmt.Errorf("%w: lease TTL %v is shorter than %v", ErrInvalidCommand, c.TTL, MIN_LEASE_TTL)
+		}
+		if found {
+			return res, nil
+		}
+		if res.Lease == 0 {
+			res.Lease = kv.lastLease + 1
+			for kv.leases[res.Lease] != nil || res.Lease == 0 {
+				res.Lease++
+			}
+		}
+		kv.lastLease = max(kv.lastLease, res.Lease)
+		kv.leases[res.Lease] = &kvLease{ttl: c.TTL, keys: make(map[string]struct{}), renewedAt: at}
+		res.OK = true
+	case KVLeaseKeepAlive:
+		if !found {
+			return KVResult{}, fmt.Errorf("%w: %d", ErrLeaseNotFound, c.Lease)
+		}
+		l.renewals++
+		l.renewedAt = at
+		res.OK = true
+	case KVLeaseRevoke, KVLeaseExpire:
+		if !found || (c.Op == KVLeaseExpire && l.renewals != c.Revision) {
+			return res, nil
+		}
+		for key := range l.keys {
+			kv.deleteLocked(key, kv.data[key], true)
+		}
+		delete(kv.leases, c.Lease)
+		res.OK = true
+	default:
+		return KVResult{}, fmt.Errorf("%w: unknown operation %s", ErrInvalidCommand, c.Op)
+	}
+	return res, nil
+}
+
+// Tick implements Ticker, returning an expiry for each lease whose TTL has
+// passed since it was last kept alive, or since this node became leader.
+func (kv *KVStore) Tick(now, leaderSince time.Time) [][]byte {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	var cmds [][]byte
+	for id, l := range kv.leases {
+		renewed := l.renewedAt
+		if leaderSince.After(renewed) {
+			renewed = leaderSince
+		}
+		if now.Sub(renewed) < l.ttl || now.Sub(l.expiring) < leaseExpireRetry {
+			continue
+		}
+		l.expiring = now
+		cmds = append(cmds, KVCommand{Op: KVLeaseExpire, Lease: id, Revision: l.renewals}.Encode())
+	}
+	return cmds
+}
+
+// legacyKVResult is the result of a legacy text command.
+func legacyKVResult(op KVOp, res KVResult) []byte {
+	switch op {
+	case KVGet:
+		return res.Value
+	case KVDelete:
+		if res.Found {
+			return []byte("1")
+		}
+		return []byte("0")
+	}
+	return nil
+}
+
+func (r *Raft) applyCommand(entry LogEntry, index int) {
+	r.sweepSessions(entry, index)
+	if entry.ClientID != 0 {
+		if result, err, dup := r.sessions.lookup(entry); dup {
+			r.resolveApplied(entry, index, result, err)
+			return
+		}
+	}
+	f := r.tracedFuture(index)
+	start := time.Now()
+	result, err := r.sm.Apply(entry.Command)
+	r.recordSpan(f, "raft.apply", start, time.Now(), err, attribute.Int("raft.index", index))
+	if entry.ClientID != 0 {
+		r.sessions.record(entry, result, err)
+	}
+	r.resolveApplied(entry, index, result, err)
+}
+
+// applyBatch applies entries, which start at log index startIdx, with a
+// single ApplyBatch call. Session duplicates are answered without being
+// passed on, with the same outcome as applying the entries one at a time.
+func (r *Raft) applyBatch(ba BatchApplier, entries []LogEntry, startIdx int) {
+	type outcome struct {
+		result []byte
+		err    error
+		dupOf  int // position of the in-batch entry this one repeats, or -1
+	}
+	outcomes := make([]outcome, len(entries))
+	var batch []CommittedEntry
+	var positions []int            // position in entries of each command in batch
+	latest := make(map[uint64]int) // session -> position of its latest command in batch
+
+	for i, entry := range entries {
+		outcomes[i].dupOf = -1
+		r.sweepSessions(entry, startIdx+i)
+		if entry.ClientID != 0 {
+			if j, ok := latest[entry.ClientID]; ok && !r.sessions.expired(entries[j].Timestamp, entry.Timestamp) {
+				if entry.Seq == entries[j].Seq {
+					outcomes[i].dupOf = j
+					continue
+				}
+				if entry.Seq < entries[j].Seq {
+					outcomes[i].err = ErrStaleSequence
+					continue
+				}
+			} else if !ok {
+				if result, err, dup := r.sessions.lookup(entry); dup {
+					outcomes[i].result, outcomes[i].err = result, err
+					continue
+				}
+			}
+			latest[entry.ClientID] = i
+		}
+		batch = append(batch, CommittedEntry{
+			Index:     uint64(startIdx + i),
+			Term:      uint64(entry.Term),
+			Timestamp: entry.Timestamp,
+			Command:   entry.Command,
+		})
+		positions = append(positions, i)
+	}
+
+	var traced []*ApplyFuture
+	for _, i := range positions {
+		if f := r.tracedFuture(startIdx + i); f != nil {
+			traced = append(traced, f)
+		}
+	}
+	var results []ApplyResult
+	start := time.Now()
+	if len(batch) > 0 {
+		results = ba.ApplyBatch(batch)
+	}
+	end := time.Now()
+	for _, f := range traced {
+		r.recordSpan(f, "raft.apply", start, end, nil, attribute.Int("raft.batch_size", len(batch)))
+	}
+	for k, i := range positions {
+		if k < len(results) {
+			outcomes[i].result, outcomes[i].err = results[k].Value, results[k].Err
+		}
+		if entries[i].ClientID != 0 {
+			r.sessions.record(entries[i], outcomes[i].result, outcomes[i].err)
+		}
+	}
+	for i, entry := range entries {
+		o := outcomes[i]
+		if o.dupOf >= 0 {
+			o.result, o.err = outcomes[o.dupOf].result, outcomes[o.dupOf].err
+		}
+		r.resolveApplied(entry, startIdx+i, o.result, o.err)
+	}
+	r.logEvent(slog.LevelDebug, "Applied log entries in one batch", "index", startIdx, "last_index", startIdx+len(entries)-1)
+}
+
+func (r *Raft) sweepSessions(entry LogEntry, index int) {
+	if index%SESSION_SWEEP_INTERVAL == 0 {
+		r.sessions.sweep(entry.Timestamp)
+	}
+}
+
+// resolveApplied completes the future waiting for the entry at index, if any.
+func (r *Raft) resolveApplied(entry LogEntry, index int, result []byte, err error) {
+	r.mu.Lock()
+	f, ok := r.pendingResponses[index]
+	if ok {
+		delete(r.pendingResponses, index)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	switch {
+	case f.term != entry.Term:
+		f.fail(ErrEntryOverwritten)
+	case err != nil:
+		f.fail(err)
+	default:
+		f.respond(Response{value: result, index: index, term: entry.Term})
 	}
-	r.logPut("State Machine after applying command", GREEN)
 }
 
 func splitCommand(command string) []string {
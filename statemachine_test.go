@@ -0,0 +1,230 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// mustApply applies c to kv and decodes its result.
+func mustApply(t *testing.T, kv *KVStore, c KVCommand) KVResult {
+	t.Helper()
+	res, err := applyKV(kv, c)
+	if err != nil {
+		t.Fatalf("%s %q: %v", c.Op, c.Key, err)
+	}
+	return res
+}
+
+func applyKV(kv *KVStore, c KVCommand) (KVResult, error) {
+	buf, err := kv.Apply(c.Encode())
+	if err != nil {
+		return KVResult{}, err
+	}
+	return DecodeKVResult(buf)
+}
+
+func queryKV(t *testing.T, kv *KVStore, c KVCommand) KVResult {
+	t.Helper()
+	buf, err := kv.Query(c.Encode())
+	if err != nil {
+		t.Fatalf("%s %q: %v", c.Op, c.Key, err)
+	}
+	res, err := DecodeKVResult(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestKVStoreConditionalWrites(t *testing.T) {
+	kv := NewKVStore()
+	k := []byte("k")
+	steps := []struct {
+		name     string
+		cmd      KVCommand
+		ok       bool
+		value    string // the key's value afterwards, "" if absent
+		revision uint64 // the result's revision
+	}{
+		{"CAS of an absent key", KVCommand{Op: KVCompareAndSwap, Key: k, Expect: []byte(""), Value: []byte("a")}, false, "", 0},
+		{"SETNX of an absent key", KVCommand{Op: KVSetIfAbsent, Key: k, Value: []byte("a")}, true, "a", 1},
+		{"SETNX of a present key", KVCommand{Op: KVSetIfAbsent, Key: k, Value: []byte("b")}, false, "a", 1},
+		{"CAS with the wrong value", KVCommand{Op: KVCompareAndSwap, Key: k, Expect: []byte("x"), Value: []byte("b")}, false, "a", 1},
+		{"CAS with the current value", KVCommand{Op: KVCompareAndSwap, Key: k, Expect: []byte("a"), Value: []byte("b")}, true, "b", 2},
+		{"CAS_REVISION with an old revision", KVCommand{Op: KVCompareRevisionAndSwap, Key: k, Revision: 1, Value: []byte("c")}, false, "b", 2},
+		{"CAS_REVISION with the current revision", KVCommand{Op: KVCompareRevisionAndSwap, Key: k, Revision: 2, Value: []byte("c")}, true, "c", 3},
+		{"CAD with the wrong value", KVCommand{Op: KVCompareAndDelete, Key: k, Expect: []byte("b")}, false, "c", 3},
+		{"CAD_REVISION with the wrong revision", KVCommand{Op: KVCompareRevisionAndDelete, Key: k, Revision: 2}, false, "c", 3},
+		{"CAD_REVISION with the current revision", KVCommand{Op: KVCompareRevisionAndDelete, Key: k, Revision: 3}, true, "", 0},
+		{"CAS_REVISION 0 creates an absent key", KVCommand{Op: KVCompareRevisionAndSwap, Key: k, Revision: 0, Value: []byte("d")}, true, "d", 5},
+		{"CAD with the current value", KVCommand{Op: KVCompareAndDelete, Key: k, Expect: []byte("d")}, true, "", 0},
+	}
+	for _, s := range steps {
+		res := mustApply(t, kv, s.cmd)
+		if res.OK != s.ok || res.Revision != s.revision {
+			t.Fatalf("%s: OK %v, revision %d; want %v, %d", s.name, res.OK, res.Revision, s.ok, s.revision)
+		}
+		if !s.ok && string(res.Value) != s.value {
+			t.Fatalf("%s: a failed condition returned value %q, want the current %q", s.name, res.Value, s.value)
+		}
+		if got := queryKV(t, kv, KVCommand{Op: KVGet, Key: k}); string(got.Value) != s.value || got.Found != (s.value != "") {
+			t.Fatalf("%s: key is %q (found %v), want %q", s.name, got.Value, got.Found, s.value)
+		}
+	}
+	// Failed conditions do not change the store's revision.
+	if kv.revision != 6 {
+		t.Fatalf("store revision %d after 6 changes", kv.revision)
+	}
+}
+
+func TestKVStoreIncr(t *testing.T) {
+	kv := NewKVStore()
+	k := []byte("n")
+	if res := mustApply(t, kv, KVCommand{Op: KVIncr, Key: k, Delta: 5}); string(res.Value) != "5" || res.Found {
+		t.Fatalf("INCR of an absent key = %q (found %v), want 5", res.Value, res.Found)
+	}
+	if res := mustApply(t, kv, KVCommand{Op: KVIncr, Key: k, Delta: -7}); string(res.Value) != "-2" {
+		t.Fatalf("INCR by -7 = %q, want -2", res.Value)
+	}
+	mustApply(t, kv, KVCommand{Op: KVSet, Key: k, Value: []byte("9223372036854775807")})
+	if _, err := applyKV(kv, KVCommand{Op: KVIncr, Key: k, Delta: 1}); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("overflowing INCR = %v, want ErrNotInteger", err)
+	}
+	mustApply(t, kv, KVCommand{Op: KVSet, Key: k, Value: []byte("one")})
+	revision := kv.revision
+	if _, err := applyKV(kv, KVCommand{Op: KVIncr, Key: k, Delta: 1}); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("INCR of a non-integer = %v, want ErrNotInteger", err)
+	}
+	if kv.revision != revision || string(queryKV(t, kv, KVCommand{Op: KVGet, Key: k}).Value) != "one" {
+		t.Fatal("a failed INCR changed the store")
+	}
+}
+
+func TestKVStoreTxnBranches(t *testing.T) {
+	kv := NewKVStore()
+	mustApply(t, kv, KVCommand{Op: KVSet, Key: []byte("a"), Value: []byte("1")})
+	txn := func(expect string) KVCommand {
+		return KVCommand{Op: KVTransaction, Txn: &KVTxn{
+			Compares: []KVCompare{
+				{Key: []byte("a"), Target: KVCompareValue, Result: KVEqual, Value: []byte(expect)},
+				{Key: []byte("b"), Target: KVCompareRevision, Result: KVEqual, Revision: 0},
+			},
+			Success: []KVCommand{{Op: KVSet, Key: []byte("b"), Value: []byte("2")}, {Op: KVGet, Key: []byte("a")}},
+			Failure: []KVCommand{{Op: KVGet, Key: []byte("b")}},
+		}}
+	}
+
+	res := mustApply(t, kv, txn("0"))
+	if res.OK || len(res.Results) != 1 || res.Results[0].Found {
+		t.Fatalf("txn with a false compare = %+v, want the failure branch's GET of absent b", res)
+	}
+	res = mustApply(t, kv, txn("1"))
+	if !res.OK || len(res.Results) != 2 || res.Results[0].Revision != 2 || string(res.Results[1].Value) != "1" {
+		t.Fatalf("txn with true compares = %+v, want the success branch", res)
+	}
+	// b exists now, so the same transaction takes the failure branch.
+	res = mustApply(t, kv, txn("1"))
+	if res.OK || string(res.Results[0].Value) != "2" {
+		t.Fatalf("repeated txn = %+v, want the failure branch reading b", res)
+	}
+}
+
+func TestKVStoreFailedTxnIsUndone(t *testing.T) {
+	kv := NewKVStore()
+	w, err := kv.Watch(context.Background(), nil, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	mustApply(t, kv, KVCommand{Op: KVSet, Key: []byte("a"), Value: []byte("1")})
+	mustApply(t, kv, KVCommand{Op: KVSet, Key: []byte("n"), Value: []byte("not a number")})
+	revision := kv.revision
+
+	_, err = applyKV(kv, KVCommand{Op: KVTransaction, Txn: &KVTxn{Success: []KVCommand{
+		{Op: KVSet, Key: []byte("a"), Value: []byte("2")},
+		{Op: KVDelete, Key: []byte("a")},
+		{Op: KVSet, Key: []byte("c"), Value: []byte("3")},
+		{Op: KVIncr, Key: []byte("n"), Delta: 1},
+	}}})
+	if !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("txn = %v, want the INCR's ErrNotInteger", err)
+	}
+	if kv.revision != revision {
+		t.Fatalf("store revision %d after a failed txn, want %d", kv.revision, revision)
+	}
+	if a := queryKV(t, kv, KVCommand{Op: KVGet, Key: []byte("a")}); string(a.Value) != "1" || a.Revision != 1 {
+		t.Fatalf("a = %q at revision %d after a failed txn, want 1 at 1", a.Value, a.Revision)
+	}
+	if c := queryKV(t, kv, KVCommand{Op: KVGet, Key: []byte("c")}); c.Found {
+		t.Fatal("key set by a failed txn exists")
+	}
+	if n := queryKV(t, kv, KVCommand{Op: KVCount}); n.Count != 2 {
+		t.Fatalf("%d keys after a failed txn, want 2", n.Count)
+	}
+	// No versions of the undone changes are left to read at their
+	// revisions, and the next change reuses the first of them.
+	if res := mustApply(t, kv, KVCommand{Op: KVSet, Key: []byte("d"), Value: []byte("4")}); res.Revision != revision+1 {
+		t.Fatalf("next change got revision %d, want %d", res.Revision, revision+1)
+	}
+	if a := queryKV(t, kv, KVCommand{Op: KVGet, Key: []byte("a"), Revision: revision + 1}); string(a.Value) != "1" {
+		t.Fatalf("a at revision %d = %q, want 1", revision+1, a.Value)
+	}
+	// Watchers see the successful writes only.
+	for _, want := range []string{"a", "n", "d"} {
+		ev := <-w.C
+		if string(ev.Key) != want {
+			t.Fatalf("watch event for %q, want %q", ev.Key, want)
+		}
+	}
+	select {
+	case ev := <-w.C:
+		t.Fatalf("unexpected watch event %+v", ev)
+	default:
+	}
+}
+
+func TestKVStoreTxnRejectsNonKeyOps(t *testing.T) {
+	kv := NewKVStore()
+	for _, op := range []KVCommand{
+		{Op: KVLeaseGrant, TTL: MIN_LEASE_TTL},
+		{Op: KVCompact, Revision: 1},
+	} {
+		_, err := applyKV(kv, KVCommand{Op: KVTransaction, Txn: &KVTxn{Success: []KVCommand{{Op: KVSet, Key: []byte("a")}, op}}})
+		if !errors.Is(err, ErrInvalidCommand) {
+			t.Fatalf("txn with %s = %v, want ErrInvalidCommand", op.Op, err)
+		}
+		if kv.revision != 0 {
+			t.Fatalf("txn with %s left revision %d", op.Op, kv.revision)
+		}
+	}
+}
+
+func TestKVStoreLeaseTTLFollowsEntryTimestamps(t *testing.T) {
+	t0 := time.UnixMilli(1700000000000)
+	entries := []CommittedEntry{
+		{Index: 1, Timestamp: t0.UnixMilli(), Command: LeaseGrantCommand(1, 10*time.Second)},
+		{Index: 2, Timestamp: t0.Add(5 * time.Second).UnixMilli(), Command: LeaseKeepAliveCommand(1)},
+	}
+	// However long after the entries a node applies them, e.g. replaying
+	// its log after a restart, the TTL counts from the keep-alive's entry.
+	for _, kv := range []*KVStore{NewKVStore(), NewKVStore()} {
+		for _, res := range kv.ApplyBatch(entries) {
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+		}
+		if cmds := kv.Tick(t0.Add(15*time.Second-time.Millisecond), t0); len(cmds) != 0 {
+			t.Fatalf("Tick before the TTL passed proposed %d expiries", len(cmds))
+		}
+		cmds := kv.Tick(t0.Add(15*time.Second), t0)
+		if len(cmds) != 1 {
+			t.Fatalf("Tick after the TTL passed proposed %d expiries, want 1", len(cmds))
+		}
+		c, err := DecodeKVCommand(cmds[0])
+		if err != nil || c.Op != KVLeaseExpire || c.Lease != 1 || c.Revision != 1 {
+			t.Fatalf("Tick proposed %+v, %v; want LEASE_EXPIRE of lease 1 after 1 keep-alive", c, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"sort"
+	"time"
+)
+
+// NodeStatus is a node's view of itself and of the cluster, as returned by
+// the Status RPC and GET /status.
+type NodeStatus struct {
+	ID       int    `json:"id"`
+	State    string `json:"state"` // "leader", "follower" or "candidate"
+	Term     int    `json:"term"`
+	VotedFor int    `json:"voted_for"` // NOTVOTED if the node has not voted in Term
+	LeaderID int    `json:"leader_id"` // -1 if unknown
+
+	// The log holds the entries from FirstLogIndex to LastLogIndex;
+	// LastLogIndex is FirstLogIndex-1 when it is empty. CommitIndex and
+	// AppliedIndex are -1 until the node learns of a commit.
+	FirstLogIndex int `json:"first_log_index"`
+	LastLogIndex  int `json:"last_log_index"`
+	CommitIndex   int `json:"commit_index"`
+	AppliedIndex  int `json:"applied_index"`
+	Pending       int `json:"pending"` // client writes in the log waiting to be applied
+
+	Peers []PeerStatus `json:"peers"` // the other nodes, by ID
+
+	LogFileSize   int64 `json:"log_file_size"`
+	StateFileSize int64 `json:"state_file_size"`
+
+	Config StatusConfig `json:"config"`
+}
+
+// PeerStatus is a node's view of one of its peers. The replication fields
+// are only known to the leader and are zero on the other nodes.
+type PeerStatus struct {
+	ID        int    `json:"id"`
+	Addr      string `json:"addr"`
+	Connected bool   `json:"connected"` // the node holds an open RPC connection to the peer
+	// Reachable is false once an RPC to the peer or a dial of it has failed,
+	// until a connection succeeds again. Nodes the node has not tried to
+	// reach yet count as reachable.
+	Reachable  bool `json:"reachable"`
+	MatchIndex int  `json:"match_index,omitempty"`
+	NextIndex  int  `json:"next_index,omitempty"`
+	Lag        int  `json:"lag,omitempty"` // entries behind the leader's last log index
+}
+
+// StatusConfig is the configuration a node runs with.
+type StatusConfig struct {
+	Addr           string        `json:"addr"`
+	HTTPAddr       string        `json:"http_addr,omitempty"`
+	RESPAddr       string        `json:"resp_addr,omitempty"`
+	MetricsAddr    string        `json:"metrics_addr,omitempty"`
+	ClusterSize    int           `json:"cluster_size"`
+	WriteBatchSize int           `json:"write_batch_size"`
+	ReadBatchSize  int           `json:"read_batch_size"`
+	AsyncLog       bool          `json:"async_log"`
+	GroupCommit    bool          `json:"group_commit"`
+	SessionTTL     time.Duration `json:"session_ttl_ns"`
+	Tracing        bool          `json:"tracing"`
+}
+
+type StatusArgs struct{}
+
+// Status is the RPC form of GetStatus.
+func (r *Raft) Status(args *StatusArgs, reply *NodeStatus) error {
+	s, err := r.GetStatus()
+	if err != nil {
+		return err
+	}
+	*reply = s
+	return nil
+}
+
+// GetStatus returns the node's current status. It fails with ErrShutdown
+// once the node is shutting down.
+func (r *Raft) GetStatus() (NodeStatus, error) {
+	r.mu.RLock()
+	if r.shutdown {
+		r.mu.RUnlock()
+		return NodeStatus{}, ErrShutdown
+	}
+	lastLogIndex := len(r.log) - 1
+	s := NodeStatus{
+		ID:            r.me,
+		State:         stateName(r.state),
+		Term:          r.currentTerm,
+		VotedFor:      r.votedFor,
+		LeaderID:      r.leaderID,
+		FirstLogIndex: 1, // r.log[0] is the dummy entry
+		LastLogIndex:  lastLogIndex,
+		CommitIndex:   r.commitIndex,
+		AppliedIndex:  r.lastApplied,
+		Pending:       len(r.pendingResponses),
+		Config: StatusConfig{
+			Addr:           r.peerIPPort[r.me],
+			HTTPAddr:       r.peerHTTP[r.me],
+			RESPAddr:       r.peerRESP[r.me],
+			ClusterSize:    int(r.clusterSize),
+			WriteBatchSize: r.writeBatchSize,
+			ReadBatchSize:  r.readBatchSize,
+			AsyncLog:       r.storage.async,
+			GroupCommit:    r.groupCommit,
+			SessionTTL:     time.Duration(r.sessions.ttl) * time.Millisecond,
+			Tracing:        r.tracer != nil,
+		},
+	}
+	if r.metricsListener != nil {
+		s.Config.MetricsAddr = r.metricsListener.Addr().String()
+	}
+	for peerID, addr := range r.peerIPPort {
+		if peerID == r.me {
+			continue
+		}
+		reachable, known := r.peerReachable[peerID]
+		p := PeerStatus{
+			ID:        peerID,
+			Addr:      addr,
+			Connected: r.rpcConns[peerID] != nil,
+			Reachable: reachable || !known,
+		}
+		if r.state == LEADER {
+			p.MatchIndex = r.matchIndex[peerID]
+			p.NextIndex = r.nextIndex[peerID]
+			p.Lag = lastLogIndex - r.matchIndex[peerID]
+		}
+		s.Peers = append(s.Peers, p)
+	}
+	r.mu.RUnlock()
+	sort.Slice(s.Peers, func(i, j int) bool { return s.Peers[i].ID < s.Peers[j].ID })
+
+	var err error
+	if s.LogFileSize, s.StateFileSize, err = r.storage.Sizes(); err != nil {
+		return NodeStatus{}, err
+	}
+	return s, nil
+}
@@ -3,11 +3,47 @@ package raft
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
+// Every data file starts with a fixed header: a 4-byte magic identifying the
+// file kind followed by a little-endian uint32 format version.
+const (
+	stateFileMagic = "RFTS"
+	logFileMagic   = "RFTL"
+	fileHeaderSize = 8
+
+	// FormatVersion is the on-disk format version written by this build.
+	// Version 2 added the entry timestamp and client session to log records.
+	FormatVersion uint32 = 2
+
+	// Log records are Term(8) | Timestamp(8) | Flags(1) | CmdLen(8) |
+	// [ClientID(8) | Seq(8)] | Command(CmdLen). The timestamp is the clock
+	// session and lease expiry is decided by, so every entry has one; the
+	// session fields are only written for entries of a client session.
+	logRecordHeaderSize  = 25
+	logRecordSessionSize = 16
+
+	recordSession = 1 << 0 // Flags: ClientID and Seq follow
+)
+
+var (
+	// ErrLegacyFormat is returned for data files written before the header
+	// was introduced. They can be upgraded with the migrate subcommand.
+	ErrLegacyFormat = errors.New("data file has no format header (run `migrate` to upgrade it)")
+	// ErrUnsupportedVersion is returned for data files whose format version
+	// this build does not understand.
+	ErrUnsupportedVersion = errors.New("unsupported data file format version")
+)
+
+func stateFilename(id int) string { return fmt.Sprintf("raft_state_%d.bin", id) }
+func logFilename(id int) string   { return fmt.Sprintf("raft_log_%d.bin", id) }
+
 type Storage struct {
 	id         int
 	stateFile  *os.File
@@ -15,35 +51,105 @@ type Storage struct {
 	logWriter  *bufio.Writer
 	logOffsets []int64
 	async      bool
+
+	// OnSync, if set, is called after every fsync with the file synced
+	// ("log" or "state") and how long it took. Set it before the first write.
+	OnSync func(file string, d time.Duration)
+
+	// mu guards the files and the group-commit bookkeeping below. Log writes
+	// are numbered by writtenSeq; syncedSeq is the highest write known to be
+	// on stable storage. At most one fsync runs at a time, and writes that
+	// land while it runs are made durable together by the next one.
+	mu         sync.Mutex
+	syncCond   *sync.Cond
+	writtenSeq uint64
+	syncedSeq  uint64
+	syncing    bool
 }
 
 func NewStorage(id int, async bool) (*Storage, error) {
-	stateFilename := fmt.Sprintf("raft_state_%d.bin", id)
-	logFilename := fmt.Sprintf("raft_log_%d.bin", id)
-
-	sFile, err := os.OpenFile(stateFilename, os.O_RDWR|os.O_CREATE, 0644)
+	sFile, err := os.OpenFile(stateFilename(id), os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkHeader(sFile, stateFileMagic); err != nil {
+		sFile.Close()
+		return nil, err
+	}
 
-	lFile, err := os.OpenFile(logFilename, os.O_RDWR|os.O_CREATE, 0644)
+	lFile, err := os.OpenFile(logFilename(id), os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		sFile.Close()
 		return nil, err
 	}
+	if err := checkHeader(lFile, logFileMagic); err != nil {
+		sFile.Close()
+		lFile.Close()
+		return nil, err
+	}
 
-	return &Storage{
+	s := &Storage{
 		id:         id,
 		stateFile:  sFile,
 		logFile:    lFile,
 		logWriter:  bufio.NewWriter(lFile),
 		logOffsets: []int64{},
 		async:      async,
-	}, nil
+	}
+	s.syncCond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// checkHeader validates the header of f, writing a fresh one if f is empty.
+func checkHeader(f *os.File, magic string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := f.Write(encodeHeader(magic)); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+
+	version, err := readHeader(f, magic)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	if version != FormatVersion {
+		return fmt.Errorf("%w: %s: version %d (this build supports %d)", ErrUnsupportedVersion, f.Name(), version, FormatVersion)
+	}
+	return nil
+}
+
+func encodeHeader(magic string) []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf[0:4], magic)
+	binary.LittleEndian.PutUint32(buf[4:8], FormatVersion)
+	return buf
+}
+
+// readHeader returns the format version stored in the header of f, or
+// ErrLegacyFormat if f does not start with the expected magic.
+func readHeader(f *os.File, magic string) (uint32, error) {
+	buf := make([]byte, fileHeaderSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		if err == io.EOF {
+			return 0, ErrLegacyFormat
+		}
+		return 0, err
+	}
+	if string(buf[0:4]) != magic {
+		return 0, ErrLegacyFormat
+	}
+	return binary.LittleEndian.Uint32(buf[4:8]), nil
 }
 
 func (s *Storage) SaveState(term int, votedFor int) error {
-	if _, err := s.stateFile.Seek(0, 0); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.stateFile.Seek(fileHeaderSize, 0); err != nil {
 		return err
 	}
 
@@ -56,21 +162,23 @@ func (s *Storage) SaveState(term int, votedFor int) error {
 	}
 
 	if !s.async {
-		return s.stateFile.Sync()
+		return s.syncFile(s.stateFile, "state")
 	}
 	return nil
 }
 
 func (s *Storage) LoadState() (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	info, err := s.stateFile.Stat()
 	if err != nil {
 		return 0, -2, err
 	}
-	if info.Size() == 0 {
+	if info.Size() <= fileHeaderSize {
 		return 0, -2, nil
 	}
 
-	if _, err := s.stateFile.Seek(0, 0); err != nil {
+	if _, err := s.stateFile.Seek(fileHeaderSize, 0); err != nil {
 		return 0, 0, err
 	}
 
@@ -86,70 +194,81 @@ func (s *Storage) LoadState() (int, int, error) {
 }
 
 func (s *Storage) AppendEntry(entry LogEntry) error {
-	offset, err := s.logFile.Seek(0, io.SeekEnd)
-	if err != nil {
-		return err
-	}
-	s.logOffsets = append(s.logOffsets, offset)
-
-	if err := binary.Write(s.logWriter, binary.LittleEndian, int64(entry.Term)); err != nil {
-		return err
-	}
-	cmdLen := int64(len(entry.Command))
-	if err := binary.Write(s.logWriter, binary.LittleEndian, cmdLen); err != nil {
-		return err
-	}
-	// Write Command
-	if _, err := s.logWriter.Write(entry.Command); err != nil {
-		return err
-	}
+	return s.AppendEntries([]LogEntry{entry})
+}
 
-	if err := s.logWriter.Flush(); err != nil {
+// AppendEntries writes entries to the log and waits until they are durable.
+func (s *Storage) AppendEntries(entries []LogEntry) error {
+	seq, err := s.WriteEntries(entries)
+	if err != nil {
 		return err
 	}
-	if !s.async {
-		return s.logFile.Sync()
-	}
-	return nil
+	return s.Sync(seq)
 }
 
-func (s *Storage) AppendEntries(entries []LogEntry) error {
+// WriteEntries hands entries to the OS without waiting for an fsync and
+// returns a sequence number to pass to Sync.
+func (s *Storage) WriteEntries(entries []LogEntry) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if err := s.logWriter.Flush(); err != nil {
-		return err
+		return 0, err
 	}
 	currentOffset, err := s.logFile.Seek(0, io.SeekEnd)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	for _, entry := range entries {
 		s.logOffsets = append(s.logOffsets, currentOffset)
+		if err := writeLogRecord(s.logWriter, entry); err != nil {
+			return 0, err
+		}
+		currentOffset += logRecordSize(entry)
+	}
+	if err := s.logWriter.Flush(); err != nil {
+		return 0, err
+	}
+	s.writtenSeq++
+	return s.writtenSeq, nil
+}
 
-		if err := binary.Write(s.logWriter, binary.LittleEndian, int64(entry.Term)); err != nil {
-			return err
+// Sync blocks until the write numbered seq is on stable storage. If another
+// fsync is already in flight the caller waits for it and, if that was not
+// enough, joins the next one, so concurrent writers share fsyncs.
+func (s *Storage) Sync(seq uint64) error {
+	if s.async {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.syncedSeq < seq {
+		if s.syncing {
+			s.syncCond.Wait()
+			continue
 		}
-		cmdLen := int64(len(entry.Command))
-		if err := binary.Write(s.logWriter, binary.LittleEndian, cmdLen); err != nil {
+		s.syncing = true
+		target := s.writtenSeq
+		s.mu.Unlock()
+		err := s.syncFile(s.logFile, "log")
+		s.mu.Lock()
+		s.syncing = false
+		s.syncCond.Broadcast()
+		if err != nil {
 			return err
 		}
-		if _, err := s.logWriter.Write(entry.Command); err != nil {
-			return err
+		if target > s.syncedSeq {
+			s.syncedSeq = target
 		}
-
-		// Term(8) + CmdLen(8) + Command(len)
-		currentOffset += 16 + int64(len(entry.Command))
-	}
-	if err := s.logWriter.Flush(); err != nil {
-		return err
-	}
-	//return nil
-	if !s.async {
-		return s.logFile.Sync()
 	}
 	return nil
 }
 
 func (s *Storage) TruncateLog(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if index < 0 {
 		return nil
 	}
@@ -176,60 +295,153 @@ func (s *Storage) TruncateLog(index int) error {
 	s.logWriter.Reset(s.logFile)
 
 	if !s.async {
-		return s.logFile.Sync()
+		return s.syncFile(s.logFile, "log")
 	}
 	return nil
 }
 
+// Sizes returns the size in bytes of the log file, including writes still
+// buffered, and of the state file.
+func (s *Storage) Sizes() (logSize, stateSize int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := s.logFile.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	logSize = info.Size() + int64(s.logWriter.Buffered())
+	if info, err = s.stateFile.Stat(); err != nil {
+		return 0, 0, err
+	}
+	return logSize, info.Size(), nil
+}
+
+// syncFile fsyncs f and reports the time it took to OnSync.
+func (s *Storage) syncFile(f *os.File, name string) error {
+	start := time.Now()
+	err := f.Sync()
+	if s.OnSync != nil {
+		s.OnSync(name, time.Since(start))
+	}
+	return err
+}
+
 func (s *Storage) LoadLog() ([]LogEntry, error) {
-	if _, err := s.logFile.Seek(0, 0); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.logFile.Seek(fileHeaderSize, 0); err != nil {
 		return nil, err
 	}
 
 	var logs []LogEntry
 	s.logOffsets = []int64{}
 
+	info, err := s.logFile.Stat()
+	if err != nil {
+		return nil, err
+	}
 	reader := bufio.NewReader(s.logFile)
-	offset := int64(0)
+	offset := int64(fileHeaderSize)
 
 	for {
-		startOffset := offset
-
-		var term int64
-		err := binary.Read(reader, binary.LittleEndian, &term)
+		entry, err := readLogRecord(reader, info.Size()-offset)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		offset += 8
+		s.logOffsets = append(s.logOffsets, offset)
+		logs = append(logs, entry)
+		offset += logRecordSize(entry)
+	}
 
-		var cmdLen int64
-		err = binary.Read(reader, binary.LittleEndian, &cmdLen)
-		if err != nil {
-			return nil, err
-		}
-		offset += 8
+	return logs, nil
+}
 
-		cmd := make([]byte, cmdLen)
-		if _, err := io.ReadFull(reader, cmd); err != nil {
-			return nil, err
-		}
-		offset += cmdLen
+func logRecordSize(entry LogEntry) int64 {
+	size := logRecordHeaderSize + int64(len(entry.Command))
+	if entry.ClientID != 0 {
+		size += logRecordSessionSize
+	}
+	return size
+}
+
+func writeLogRecord(w io.Writer, entry LogEntry) error {
+	var hdr [logRecordHeaderSize + logRecordSessionSize]byte
+	binary.LittleEndian.PutUint64(hdr[0:8], uint64(entry.Term))
+	binary.LittleEndian.PutUint64(hdr[8:16], uint64(entry.Timestamp))
+	binary.LittleEndian.PutUint64(hdr[17:25], uint64(len(entry.Command)))
+	n := logRecordHeaderSize
+	if entry.ClientID != 0 {
+		hdr[16] |= recordSession
+		binary.LittleEndian.PutUint64(hdr[25:33], entry.ClientID)
+		binary.LittleEndian.PutUint64(hdr[33:41], entry.Seq)
+		n += logRecordSessionSize
+	}
+	if _, err := w.Write(hdr[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(entry.Command)
+	return err
+}
 
-		s.logOffsets = append(s.logOffsets, startOffset)
-		logs = append(logs, LogEntry{
-			Term:    int(term),
-			Command: cmd,
-		})
+// readLogRecord reads a record from r, which has left bytes from the
+// record's start on. It returns io.EOF at a clean end of the log and
+// io.ErrUnexpectedEOF if it ends in the middle of a record, including when
+// the record's command length runs past the end, so a corrupt length fails
+// before anything is allocated for it.
+func readLogRecord(r io.Reader, left int64) (LogEntry, error) {
+	var hdr [logRecordHeaderSize + logRecordSessionSize]byte
+	if _, err := io.ReadFull(r, hdr[:logRecordHeaderSize]); err != nil {
+		return LogEntry{}, err
+	}
+	flags := hdr[16]
+	cmdLen := int64(binary.LittleEndian.Uint64(hdr[17:25]))
+	if cmdLen < 0 || flags&^recordSession != 0 {
+		return LogEntry{}, fmt.Errorf("corrupt record (flags %#x, command length %d)", flags, cmdLen)
+	}
+	entry := LogEntry{
+		Term:      int(binary.LittleEndian.Uint64(hdr[0:8])),
+		Timestamp: int64(binary.LittleEndian.Uint64(hdr[8:16])),
+	}
+	if flags&recordSession != 0 {
+		if _, err := io.ReadFull(r, hdr[25:41]); err != nil {
+			return LogEntry{}, unexpectedEOF(err)
+		}
+		entry.ClientID = binary.LittleEndian.Uint64(hdr[25:33])
+		entry.Seq = binary.LittleEndian.Uint64(hdr[33:41])
 	}
+	if left -= logRecordSize(entry); cmdLen > left {
+		return LogEntry{}, fmt.Errorf("corrupt record (command length %d, %d bytes left): %w", cmdLen, left, io.ErrUnexpectedEOF)
+	}
+	entry.Command = make([]byte, cmdLen)
+	if _, err := io.ReadFull(r, entry.Command); err != nil {
+		return LogEntry{}, unexpectedEOF(err)
+	}
+	return entry, nil
+}
 
-	return logs, nil
+// unexpectedEOF reports an end of file in the middle of a record as
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
+// Close flushes the buffered log writes and closes the files. It returns the
+// first error, so that writes lost in async mode are reported.
 func (s *Storage) Close() error {
-	s.logWriter.Flush()
-	s.stateFile.Close()
-	return s.logFile.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.logWriter.Flush()
+	if cerr := s.stateFile.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := s.logFile.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
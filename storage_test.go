@@ -0,0 +1,210 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T, async bool) (*Storage, *atomic.Int32) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	s, err := NewStorage(1, async)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	var fsyncs atomic.Int32
+	s.OnSync = func(file string, d time.Duration) {
+		if file == "log" {
+			fsyncs.Add(1)
+		}
+	}
+	return s, &fsyncs
+}
+
+func TestStorageSyncCoversEarlierWrites(t *testing.T) {
+	s, fsyncs := newTestStorage(t, false)
+	var seqs []uint64
+	for i := range 3 {
+		seq, err := s.WriteEntries([]LogEntry{{Term: 1, Command: []byte{byte(i)}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+	if seqs[0] != 1 || seqs[1] != 2 || seqs[2] != 3 {
+		t.Fatalf("write sequence numbers %v, want 1 2 3", seqs)
+	}
+	if err := s.Sync(seqs[2]); err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range seqs {
+		if err := s.Sync(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fsyncs.Load(); n != 1 {
+		t.Fatalf("%d fsyncs, want 1 for all three writes", n)
+	}
+	if s.syncedSeq != 3 {
+		t.Fatalf("syncedSeq = %d, want 3", s.syncedSeq)
+	}
+}
+
+func TestStorageConcurrentSyncsShareFsyncs(t *testing.T) {
+	s, fsyncs := newTestStorage(t, false)
+	const writers = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq, err := s.WriteEntries([]LogEntry{{Term: 1, Command: []byte(fmt.Sprint(i))}})
+			if err == nil {
+				err = s.Sync(seq)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.syncedSeq != writers || s.writtenSeq != writers {
+		t.Fatalf("writtenSeq %d, syncedSeq %d; want both %d", s.writtenSeq, s.syncedSeq, writers)
+	}
+	if n := fsyncs.Load(); n < 1 || n > writers {
+		t.Fatalf("%d fsyncs for %d writes", n, writers)
+	}
+	logs, err := s.LoadLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != writers {
+		t.Fatalf("log holds %d entries, want %d", len(logs), writers)
+	}
+}
+
+func TestStorageAsyncSyncDoesNotFsync(t *testing.T) {
+	s, fsyncs := newTestStorage(t, true)
+	seq, err := s.WriteEntries([]LogEntry{{Term: 1, Command: []byte("x")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sync(seq); err != nil {
+		t.Fatal(err)
+	}
+	if n := fsyncs.Load(); n != 0 {
+		t.Fatalf("%d fsyncs in async mode, want 0", n)
+	}
+}
+
+func TestStorageLogRecordRoundTrip(t *testing.T) {
+	s, _ := newTestStorage(t, false)
+	entries := []LogEntry{
+		{Term: 1, Command: []byte("SET a 1")},
+		{Term: 2, Command: []byte("SET b 2"), ClientID: 7, Seq: 3, Timestamp: 1700000000000},
+		{Term: 2, Command: []byte{}, Timestamp: 1700000000001},
+	}
+	if err := s.AppendEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TruncateLog(2); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := s.LoadLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[1].ClientID != 7 || logs[1].Seq != 3 || logs[1].Timestamp != 1700000000000 || string(logs[1].Command) != "SET b 2" {
+		t.Fatalf("LoadLog = %+v after truncating to 2 entries", logs)
+	}
+}
+
+func TestLogRecordSessionFieldsOnlyOnSessionEntries(t *testing.T) {
+	var buf bytes.Buffer
+	plain := LogEntry{Term: 1, Command: []byte("SET a 1"), Timestamp: 5}
+	session := LogEntry{Term: 1, Command: []byte("SET a 1"), Timestamp: 5, ClientID: 9, Seq: 1}
+	for _, e := range []LogEntry{plain, session} {
+		buf.Reset()
+		if err := writeLogRecord(&buf, e); err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) != logRecordSize(e) {
+			t.Fatalf("record of %+v is %d bytes, logRecordSize says %d", e, buf.Len(), logRecordSize(e))
+		}
+		got, err := readLogRecord(&buf, int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Fatalf("readLogRecord = %+v, want %+v", got, e)
+		}
+	}
+	if d := logRecordSize(session) - logRecordSize(plain); d != logRecordSessionSize {
+		t.Fatalf("session fields take %d bytes, want %d", d, logRecordSessionSize)
+	}
+
+	buf.Reset()
+	writeLogRecord(&buf, session)
+	cut := buf.Bytes()[:logRecordHeaderSize+4]
+	if _, err := readLogRecord(bytes.NewReader(cut), int64(len(cut))); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("readLogRecord of a cut record = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestLoadLogRejectsOversizedCommandLength(t *testing.T) {
+	s, _ := newTestStorage(t, false)
+	if err := s.AppendEntries([]LogEntry{{Term: 1, Command: []byte("SET a 1")}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Rewrite the record's command length as 1<<62: loading must fail
+	// rather than try to allocate it.
+	data, err := os.ReadFile(logFilename(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint64(data[fileHeaderSize+17:], 1<<62)
+	writeFile(t, logFilename(1), data)
+
+	s, err = NewStorage(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.LoadLog(); err == nil || !strings.Contains(err.Error(), "corrupt record") {
+		t.Fatalf("LoadLog of an oversized command length = %v, want a corrupt record error", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestStorageCloseReportsLostWrites(t *testing.T) {
+	s, _ := newTestStorage(t, true)
+	// A buffered write that cannot be flushed must fail Close even though
+	// the files themselves close cleanly.
+	s.logWriter = bufio.NewWriter(failingWriter{})
+	s.logWriter.WriteString("record")
+	if err := s.Close(); err == nil || err.Error() != "disk full" {
+		t.Fatalf("Close = %v, want the flush's error", err)
+	}
+}
@@ -0,0 +1,148 @@
+package raft
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TRACER_NAME is the instrumentation name of the spans a node records.
+const TRACER_NAME = "raft"
+
+// TracePropagator carries a request's trace context in ExecuteArgs.TraceContext
+// (W3C traceparent/tracestate).
+var TracePropagator = propagation.TraceContext{}
+
+// A traced write records these spans under the context it was submitted with:
+//
+//	raft.queue           waiting in handleClientRequest for its batch to be cut
+//	raft.storage.append  the leader's write and fsync of that batch
+//	raft.AppendEntries   each RPC that carried the entry to a follower
+//	raft.commit          from being appended until a quorum has it
+//	raft.apply           applying it to the state machine
+//
+// A traced read records raft.queue, raft.read_quorum and raft.query.
+
+// startTrace starts the spans of a submitted request if tracing is enabled
+// and ctx is sampled.
+func (r *Raft) startTrace(ctx context.Context, f *ApplyFuture, read bool) {
+	if r.tracer == nil {
+		return
+	}
+	queueCtx, span := r.tracer.Start(ctx, "raft.queue", trace.WithAttributes(attribute.Bool("raft.read", read)))
+	if !span.IsRecording() {
+		return
+	}
+	// The later spans are siblings of raft.queue, unless it is the root.
+	f.traceCtx = ctx
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		f.traceCtx = queueCtx
+	}
+	f.queueSpan = span
+}
+
+// endQueue ends the raft.queue span of every traced request of a batch.
+func endQueue(reqs []ClientRequest) {
+	for _, req := range reqs {
+		if req.future.queueSpan != nil {
+			req.future.queueSpan.SetAttributes(attribute.Int("raft.batch_size", len(reqs)))
+			req.future.queueSpan.End()
+		}
+	}
+}
+
+// recordSpan records a finished span covering [start, end] under f if its
+// request is traced.
+func (r *Raft) recordSpan(f *ApplyFuture, name string, start, end time.Time, err error, attrs ...attribute.KeyValue) {
+	if f == nil || f.traceCtx == nil {
+		return
+	}
+	_, span := r.tracer.Start(f.traceCtx, name, trace.WithTimestamp(start), trace.WithAttributes(attrs...))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// recordBatchSpan records the span under every traced request of a batch, so
+// that the work the batch shares shows up in each request's trace.
+func (r *Raft) recordBatchSpan(reqs []ClientRequest, name string, start, end time.Time, err error, attrs ...attribute.KeyValue) {
+	if r.tracer == nil {
+		return
+	}
+	attrs = append(attrs, attribute.Int("raft.batch_size", len(reqs)))
+	for _, req := range reqs {
+		r.recordSpan(req.future, name, start, end, err, attrs...)
+	}
+}
+
+// tracedFuturesLocked returns the pending futures of the traced requests in
+// the log from index on, or nil if there are none.
+func (r *Raft) tracedFuturesLocked(index int) []*ApplyFuture {
+	if r.tracer == nil {
+		return nil
+	}
+	var futures []*ApplyFuture
+	for i := index; i < len(r.log); i++ {
+		if f := r.pendingResponses[i]; f != nil && f.traceCtx != nil {
+			futures = append(futures, f)
+		}
+	}
+	return futures
+}
+
+// tracedFuture returns the pending future of the entry at index if its
+// request is traced.
+func (r *Raft) tracedFuture(index int) *ApplyFuture {
+	if r.tracer == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if f := r.pendingResponses[index]; f != nil && f.traceCtx != nil {
+		return f
+	}
+	return nil
+}
+
+// startCommitLocked starts the raft.commit span of a traced request appended
+// at index.
+func (r *Raft) startCommitLocked(f *ApplyFuture, index int) {
+	if f.traceCtx == nil {
+		return
+	}
+	_, f.commitSpan = r.tracer.Start(f.traceCtx, "raft.commit", trace.WithAttributes(
+		attribute.Int("raft.index", index),
+		attribute.Int("raft.term", r.currentTerm),
+	))
+}
+
+// endCommitLocked ends the raft.commit spans of the entries after from up to
+// the commit index.
+func (r *Raft) endCommitLocked(from int) {
+	if r.tracer == nil {
+		return
+	}
+	for i := from + 1; i <= r.commitIndex; i++ {
+		if f := r.pendingResponses[i]; f != nil && f.commitSpan != nil {
+			f.commitSpan.End()
+		}
+	}
+}
+
+// endTrace ends the spans still open when a future resolves.
+func (f *ApplyFuture) endTrace(err error) {
+	for _, span := range []trace.Span{f.queueSpan, f.commitSpan} {
+		if span == nil {
+			continue
+		}
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,213 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	// WATCH_HISTORY bounds how many recent KVStore changes are kept for
+	// watches that start from a past log index; at least half as many are.
+	WATCH_HISTORY = 4096
+	// WATCH_MAX_PENDING is how many events a watcher may fall behind before
+	// it is closed with ErrWatchLagged.
+	WATCH_MAX_PENDING = 4096
+)
+
+// WatchEventType is the kind of change a WatchEvent reports.
+type WatchEventType uint8
+
+const (
+	WatchPut WatchEventType = iota + 1
+	WatchDelete
+)
+
+func (t WatchEventType) String() string {
+	switch t {
+	case WatchPut:
+		return "put"
+	case WatchDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("WatchEventType(%d)", uint8(t))
+}
+
+// WatchEvent is a change of one key. The changes made by one log entry, e.g.
+// a transaction or a lease expiry, share its Index and are reported together.
+type WatchEvent struct {
+	Type     WatchEventType
+	Key      []byte
+	Value    []byte // the new value of a put
+	Revision uint64 // the store's revision after the change
+	Lease    uint64 // the lease of a put key, 0 if none
+	Index    uint64 // log index of the entry that made the change
+}
+
+// Watcher receives the changes of a key or a prefix in commit order. C is
+// closed when the watch ends; Err then tells why.
+type Watcher struct {
+	C <-chan WatchEvent
+
+	c      chan WatchEvent
+	key    []byte
+	prefix bool
+	start  uint64 // log index of the first entry whose changes are reported
+
+	mu      sync.Mutex
+	pending []WatchEvent
+	notify  chan struct{} // signalled when pending grows
+	done    chan struct{} // closed when the watch ends
+	err     error
+}
+
+// Watch reports the changes of key, or of every key starting with key if
+// prefix is set, until ctx is done or Close is called. With startIndex 0 it
+// reports changes from now on; otherwise it first replays the retained
+// changes made by entries from log index startIndex on, failing with
+// ErrWatchCompacted if some of them are no longer retained, and reports no
+// change of an earlier entry even if startIndex is not applied yet. Changes
+// applied with Apply instead of ApplyBatch have no log index, so they carry
+// Index 0 and only reach watches with startIndex 0. Every node applies every
+// entry, so followers serve watches as well as the leader.
+func (kv *KVStore) Watch(ctx context.Context, key []byte, prefix bool, startIndex uint64) (*Watcher, error) {
+	c := make(chan WatchEvent)
+	w := &Watcher{
+		C:      c,
+		c:      c,
+		key:    append([]byte(nil), key...),
+		prefix: prefix,
+		start:  startIndex,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	kv.mu.Lock()
+	if startIndex != 0 {
+		if kv.historyLost != 0 && startIndex <= kv.historyLost {
+			kv.mu.Unlock()
+			return nil, fmt.Errorf("%w: index %d, changes up to index %d are gone", ErrWatchCompacted, startIndex, kv.historyLost)
+		}
+		for _, ev := range kv.history {
+			if w.wants(ev) {
+				w.pending = append(w.pending, ev)
+			}
+		}
+	}
+	kv.watchers[w] = struct{}{}
+	kv.mu.Unlock()
+
+	go w.run(ctx)
+	go func() {
+		<-w.done
+		kv.mu.Lock()
+		delete(kv.watchers, w)
+		kv.mu.Unlock()
+	}()
+	return w, nil
+}
+
+// Close ends the watch.
+func (w *Watcher) Close() {
+	w.stop(context.Canceled)
+}
+
+// Err returns why the watch ended: ErrWatchLagged if the receiver fell more
+// than WATCH_MAX_PENDING events behind, or the context's error. It returns
+// nil while C is open.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// wants reports whether ev is for the watch: of a watched key and made by an
+// entry from its start index on.
+func (w *Watcher) wants(ev WatchEvent) bool {
+	if ev.Index < w.start {
+		return false
+	}
+	if w.prefix {
+		return bytes.HasPrefix(ev.Key, w.key)
+	}
+	return bytes.Equal(ev.Key, w.key)
+}
+
+// push queues ev without blocking the applier.
+func (w *Watcher) push(ev WatchEvent) {
+	w.mu.Lock()
+	if w.err != nil {
+		w.mu.Unlock()
+		return
+	}
+	if len(w.pending) >= WATCH_MAX_PENDING {
+		w.mu.Unlock()
+		w.stop(ErrWatchLagged)
+		return
+	}
+	w.pending = append(w.pending, ev)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watcher) stop(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		close(w.done)
+	}
+}
+
+// run delivers the queued events to C until the watch ends.
+func (w *Watcher) run(ctx context.Context) {
+	defer close(w.c)
+	for {
+		w.mu.Lock()
+		events := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		for _, ev := range events {
+			select {
+			case w.c <- ev:
+			case <-w.done:
+				return
+			case <-ctx.Done():
+				w.stop(ctx.Err())
+				return
+			}
+		}
+		select {
+		case <-w.notify:
+		case <-w.done:
+			return
+		case <-ctx.Done():
+			w.stop(ctx.Err())
+			return
+		}
+	}
+}
+
+// publishLocked records the changes made by the entry at index and hands
+// them to the matching watchers.
+func (kv *KVStore) publishLocked(index uint64) {
+	for _, ev := range kv.changes {
+		ev.Index = index
+		if len(kv.history) == WATCH_HISTORY {
+			// Drop the older half at once, so trimming stays cheap.
+			kv.historyLost = kv.history[WATCH_HISTORY/2-1].Index
+			kv.history = append(kv.history[:0], kv.history[WATCH_HISTORY/2:]...)
+		}
+		kv.history = append(kv.history, ev)
+		for w := range kv.watchers {
+			if w.wants(ev) {
+				w.push(ev)
+			}
+		}
+	}
+	kv.changes = kv.changes[:0]
+}
@@ -0,0 +1,150 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// applyAt applies cmds to kv as the entries at log index first on.
+func applyAt(t *testing.T, kv *KVStore, first uint64, cmds ...[]byte) {
+	t.Helper()
+	entries := make([]CommittedEntry, len(cmds))
+	for i, cmd := range cmds {
+		entries[i] = CommittedEntry{Index: first + uint64(i), Command: cmd}
+	}
+	for _, res := range kv.ApplyBatch(entries) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+}
+
+// nextEvents receives n events from w.
+func nextEvents(t *testing.T, w *Watcher, n int) []WatchEvent {
+	t.Helper()
+	var events []WatchEvent
+	for range n {
+		select {
+		case ev := <-w.C:
+			events = append(events, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d of %d watch events", len(events), n)
+		}
+	}
+	return events
+}
+
+func expectNoEvent(t *testing.T, w *Watcher) {
+	t.Helper()
+	select {
+	case ev := <-w.C:
+		t.Fatalf("unexpected watch event %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestWatchReportsMatchingChanges(t *testing.T) {
+	kv := NewKVStore()
+	w, err := kv.Watch(context.Background(), []byte("/a/"), true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	applyAt(t, kv, 1,
+		SetCommand([]byte("/a/1"), []byte("x")),
+		SetCommand([]byte("/b/1"), []byte("y")),
+		TxnCommand(KVTxn{Success: []KVCommand{
+			{Op: KVSet, Key: []byte("/a/2"), Value: []byte("z")},
+			{Op: KVDelete, Key: []byte("/a/1")},
+		}}),
+	)
+	events := nextEvents(t, w, 3)
+	want := []WatchEvent{
+		{Type: WatchPut, Key: []byte("/a/1"), Value: []byte("x"), Revision: 1, Index: 1},
+		{Type: WatchPut, Key: []byte("/a/2"), Value: []byte("z"), Revision: 3, Index: 3},
+		{Type: WatchDelete, Key: []byte("/a/1"), Revision: 4, Index: 3},
+	}
+	for i, ev := range events {
+		if ev.Type != want[i].Type || string(ev.Key) != string(want[i].Key) || string(ev.Value) != string(want[i].Value) ||
+			ev.Revision != want[i].Revision || ev.Index != want[i].Index {
+			t.Fatalf("event %d = %+v, want %+v", i, ev, want[i])
+		}
+	}
+	expectNoEvent(t, w)
+}
+
+func TestWatchStartIndex(t *testing.T) {
+	kv := NewKVStore()
+	for i := uint64(1); i <= 4; i++ {
+		applyAt(t, kv, i, SetCommand([]byte("k"), []byte(fmt.Sprint(i))))
+	}
+
+	// A start within the history replays from there, then goes on live.
+	w, err := kv.Watch(context.Background(), []byte("k"), false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	applyAt(t, kv, 5, SetCommand([]byte("k"), []byte("5")))
+	for i, ev := range nextEvents(t, w, 3) {
+		if ev.Index != uint64(3+i) {
+			t.Fatalf("event %d has index %d, want %d", i, ev.Index, 3+i)
+		}
+	}
+
+	// A start ahead of the store skips the live changes before it.
+	ahead, err := kv.Watch(context.Background(), []byte("k"), false, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ahead.Close()
+	for i := uint64(6); i <= 9; i++ {
+		applyAt(t, kv, i, SetCommand([]byte("k"), []byte(fmt.Sprint(i))))
+	}
+	for i, ev := range nextEvents(t, ahead, 2) {
+		if ev.Index != uint64(8+i) {
+			t.Fatalf("watch from index 8 got index %d", ev.Index)
+		}
+	}
+	expectNoEvent(t, ahead)
+
+	// Changes made through Apply have no index: only a watch from 0 sees them.
+	if _, err := kv.Apply(SetCommand([]byte("k"), []byte("direct"))); err != nil {
+		t.Fatal(err)
+	}
+	expectNoEvent(t, ahead)
+}
+
+func TestWatchEnds(t *testing.T) {
+	kv := NewKVStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := kv.Watch(ctx, []byte("k"), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for range w.C {
+	}
+	if !errors.Is(w.Err(), context.Canceled) {
+		t.Fatalf("Err = %v after cancelling the context", w.Err())
+	}
+
+	// A watcher nobody reads from is closed once too far behind.
+	lagging, err := kv.Watch(context.Background(), []byte("k"), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The watcher may hold up to WATCH_MAX_PENDING events it has taken off
+	// its queue besides the queued ones.
+	for i := range 2*WATCH_MAX_PENDING + 1 {
+		applyAt(t, kv, uint64(i+1), SetCommand([]byte("k"), []byte("v")))
+	}
+	for range lagging.C {
+	}
+	if !errors.Is(lagging.Err(), ErrWatchLagged) {
+		t.Fatalf("Err = %v for a lagging watcher, want ErrWatchLagged", lagging.Err())
+	}
+}